@@ -0,0 +1,353 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HanzalaGun/pifi/hooks"
+	"github.com/HanzalaGun/pifi/networkmanager"
+	"github.com/HanzalaGun/pifi/webhooks"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is where the daemon looks for its configuration file.
+const DefaultPath = "/etc/pifi/config.yaml"
+
+// DefaultSSID gives every device a stable AP name based on its wifi MAC address.
+const DefaultSSID = "Optistok-AP-{mac}"
+
+// Config holds the daemon settings read from the configuration file.
+type Config struct {
+	// Listen is the address of the web interface
+	Listen string `yaml:"listen"`
+	// Backend is one of auto, nmcli, dbus, wpa or iwd
+	Backend string `yaml:"backend"`
+	// StateDir keeps data generated at runtime
+	StateDir     string       `yaml:"state_dir"`
+	Interfaces   Interfaces   `yaml:"interfaces"`
+	AP           AP           `yaml:"ap"`
+	Connectivity Connectivity `yaml:"connectivity"`
+	Auth         Auth         `yaml:"auth"`
+	TLS          TLS          `yaml:"tls"`
+	Audit        Audit        `yaml:"audit"`
+	Hooks        []Hook       `yaml:"hooks"`
+	Webhooks     []Webhook    `yaml:"webhooks"`
+}
+
+type Interfaces struct {
+	Wifi     string `yaml:"wifi"`
+	Ethernet string `yaml:"ethernet"`
+}
+
+type AP struct {
+	// SSID is a template, see networkmanager.ExpandAPSSID
+	SSID string `yaml:"ssid"`
+	// Passphrase enables WPA2 or WPA3 depending on Security, the AP is open without it
+	Passphrase string `yaml:"passphrase"`
+	Security   string `yaml:"security"`
+	// Auto enables the AP after being offline for Timeout
+	Auto    bool          `yaml:"auto"`
+	Timeout time.Duration `yaml:"timeout"`
+	// CaptiveDNS resolves every host name to the AP while AP mode is active
+	CaptiveDNS bool `yaml:"captive_dns"`
+	// PortalListen serves connectivity checks and captive portal redirects, empty disables it
+	PortalListen string `yaml:"portal_listen"`
+}
+
+type Auth struct {
+	// PasswordHash is the bcrypt hash of the admin password, see -hash-password.
+	// The web interface and API are open without it.
+	PasswordHash string `yaml:"password_hash"`
+	// SessionTTL is how long a login lasts
+	SessionTTL time.Duration `yaml:"session_ttl"`
+}
+
+type TLS struct {
+	// Enabled serves the web interface over HTTPS on Listen
+	Enabled bool   `yaml:"enabled"`
+	Listen  string `yaml:"listen"`
+	// CertFile and KeyFile are PEM files, a self-signed certificate is generated without them
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Redirect sends plain HTTP requests for the web interface to HTTPS
+	Redirect bool `yaml:"redirect"`
+}
+
+type Audit struct {
+	// Enabled records configuration changes in audit.jsonl in StateDir
+	Enabled bool `yaml:"enabled"`
+	// MaxSize is the size in bytes at which the file is rotated
+	MaxSize int64 `yaml:"max_size"`
+	// Backups is the number of rotated files kept
+	Backups int `yaml:"backups"`
+}
+
+// Hook runs a shell command or restarts a systemd unit on an event, see hooks.Events
+type Hook struct {
+	Name    string `yaml:"name"`
+	Event   string `yaml:"event"`
+	Command string `yaml:"command"`
+	Unit    string `yaml:"unit"`
+	// Timeout defaults to hooks.DefaultTimeout
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Webhook receives status events as JSON, signed with Secret
+type Webhook struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+	// Events limits the events sent, see webhooks.Events
+	Events []string `yaml:"events"`
+}
+
+type Connectivity struct {
+	PingTarget   string        `yaml:"ping_target"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// Default returns the settings used when no configuration file exists.
+func Default() Config {
+	settings := networkmanager.DefaultSettings()
+	return Config{
+		Listen:   "0.0.0.0:8088",
+		Backend:  networkmanager.BackendAuto,
+		StateDir: "/var/lib/pifi",
+		Interfaces: Interfaces{
+			Wifi:     settings.WifiInterface,
+			Ethernet: settings.EthernetInterface,
+		},
+		AP: AP{
+			SSID:         DefaultSSID,
+			Security:     settings.APSecurity,
+			Auto:         true,
+			Timeout:      30 * time.Second,
+			CaptiveDNS:   settings.CaptiveDNS,
+			PortalListen: "0.0.0.0:80",
+		},
+		Connectivity: Connectivity{
+			PingTarget:   settings.PingTarget,
+			PollInterval: settings.PollInterval,
+		},
+		Auth: Auth{
+			SessionTTL: 24 * time.Hour,
+		},
+		TLS: TLS{
+			Listen:   "0.0.0.0:8443",
+			Redirect: true,
+		},
+		Audit: Audit{
+			Enabled: true,
+			MaxSize: 1 << 20,
+			Backups: 3,
+		},
+	}
+}
+
+// Load reads the YAML file at path on top of the defaults. Unknown keys are rejected
+// so typos don't silently fall back to defaults. The result is not validated.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %v", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate reports the first invalid setting.
+func (c Config) Validate() error {
+	if err := validateListen("listen", c.Listen); err != nil {
+		return err
+	}
+
+	switch c.Backend {
+	case networkmanager.BackendAuto, networkmanager.BackendNMCLI, networkmanager.BackendDBus,
+		networkmanager.BackendWPA, networkmanager.BackendIWD:
+	default:
+		return fmt.Errorf("invalid backend %q: expected auto, nmcli, dbus, wpa or iwd", c.Backend)
+	}
+
+	if err := validateInterface("interfaces.wifi", c.Interfaces.Wifi); err != nil {
+		return err
+	}
+	if err := validateInterface("interfaces.ethernet", c.Interfaces.Ethernet); err != nil {
+		return err
+	}
+
+	if c.StateDir == "" {
+		return fmt.Errorf("invalid state_dir: must not be empty")
+	}
+
+	if err := networkmanager.CheckAPSSIDTemplate(c.AP.SSID); err != nil {
+		return fmt.Errorf("invalid ap.ssid %q: %v", c.AP.SSID, err)
+	}
+	if c.AP.Passphrase != "" && !networkmanager.ValidPassphrase(c.AP.Passphrase) {
+		return fmt.Errorf("invalid ap.passphrase: must be 8 to 63 printable ASCII characters")
+	}
+	if c.AP.Security != networkmanager.APSecurityWPA2 && c.AP.Security != networkmanager.APSecurityWPA3 {
+		return fmt.Errorf("invalid ap.security %q: expected wpa2 or wpa3", c.AP.Security)
+	}
+	if c.AP.Timeout < time.Second {
+		return fmt.Errorf("invalid ap.timeout %s: must be at least 1s", c.AP.Timeout)
+	}
+	if c.AP.PortalListen != "" {
+		if err := validateListen("ap.portal_listen", c.AP.PortalListen); err != nil {
+			return err
+		}
+	}
+
+	target := c.Connectivity.PingTarget
+	if target == "" || strings.HasPrefix(target, "-") || strings.ContainsAny(target, " \t\n/") {
+		return fmt.Errorf("invalid connectivity.ping_target %q: must be a host name or IP address", target)
+	}
+	if c.Connectivity.PollInterval < time.Second {
+		return fmt.Errorf("invalid connectivity.poll_interval %s: must be at least 1s", c.Connectivity.PollInterval)
+	}
+
+	if c.Auth.PasswordHash != "" {
+		if _, err := bcrypt.Cost([]byte(c.Auth.PasswordHash)); err != nil {
+			return fmt.Errorf("invalid auth.password_hash: must be a bcrypt hash: %v", err)
+		}
+	}
+	if c.Auth.SessionTTL < time.Minute {
+		return fmt.Errorf("invalid auth.session_ttl %s: must be at least 1m", c.Auth.SessionTTL)
+	}
+
+	if c.TLS.Enabled {
+		if err := validateListen("tls.listen", c.TLS.Listen); err != nil {
+			return err
+		}
+		_, port, _ := net.SplitHostPort(c.Listen)
+		if _, tlsPort, _ := net.SplitHostPort(c.TLS.Listen); tlsPort == port {
+			return fmt.Errorf("invalid tls.listen address %q: must use a different port than listen", c.TLS.Listen)
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("invalid tls.cert_file and tls.key_file: set both or neither")
+	}
+
+	if c.Audit.MaxSize < 4096 {
+		return fmt.Errorf("invalid audit.max_size %d: must be at least 4096 bytes", c.Audit.MaxSize)
+	}
+	if c.Audit.Backups < 0 || c.Audit.Backups > 100 {
+		return fmt.Errorf("invalid audit.backups %d: must be between 0 and 100", c.Audit.Backups)
+	}
+
+	for i, hook := range c.Hooks {
+		if !slices.Contains(hooks.Events, hook.Event) {
+			return fmt.Errorf("invalid hooks[%d].event %q: expected one of %s", i, hook.Event, strings.Join(hooks.Events, ", "))
+		}
+		if (hook.Command == "") == (hook.Unit == "") {
+			return fmt.Errorf("invalid hooks[%d]: set either command or unit", i)
+		}
+		if hook.Unit != "" && (strings.HasPrefix(hook.Unit, "-") || strings.ContainsAny(hook.Unit, " \t\n/")) {
+			return fmt.Errorf("invalid hooks[%d].unit %q: must be a systemd unit name", i, hook.Unit)
+		}
+		if hook.Timeout != 0 && (hook.Timeout < time.Second || hook.Timeout > 10*time.Minute) {
+			return fmt.Errorf("invalid hooks[%d].timeout %s: must be between 1s and 10m", i, hook.Timeout)
+		}
+	}
+
+	urls := make(map[string]bool)
+	for i, hook := range c.Webhooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhooks[%d].url %q: must be an http or https URL", i, hook.URL)
+		}
+		if urls[hook.URL] {
+			return fmt.Errorf("invalid webhooks[%d].url %q: configured twice", i, hook.URL)
+		}
+		urls[hook.URL] = true
+		if hook.Secret == "" {
+			return fmt.Errorf("invalid webhooks[%d].secret: must not be empty", i)
+		}
+		for _, event := range hook.Events {
+			if !slices.Contains(webhooks.Events, event) {
+				return fmt.Errorf("invalid webhooks[%d].events %q: expected one of %s", i, event, strings.Join(webhooks.Events, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// Listen addresses are host:port with an optional host
+func validateListen(key, address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid %s address %q: %v", key, address, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid %s address %q: port must be between 1 and 65535", key, address)
+	}
+	return nil
+}
+
+// Interface names are limited to 15 characters by the kernel
+func validateInterface(key, name string) error {
+	if name == "" || len(name) > 15 || strings.HasPrefix(name, "-") || strings.ContainsAny(name, " \t\n/:") {
+		return fmt.Errorf("invalid %s %q: must be a network interface name", key, name)
+	}
+	return nil
+}
+
+// NetworkSettings returns the backend settings described by the config.
+// The AP SSID is expanded from its template.
+func (c Config) NetworkSettings() networkmanager.Settings {
+	return networkmanager.Settings{
+		WifiInterface:     c.Interfaces.Wifi,
+		EthernetInterface: c.Interfaces.Ethernet,
+		APSSID:            networkmanager.ExpandAPSSID(c.AP.SSID, c.Interfaces.Wifi, c.StateDir),
+		APPassphrase:      c.AP.Passphrase,
+		APSecurity:        c.AP.Security,
+		PingTarget:        c.Connectivity.PingTarget,
+		PollInterval:      c.Connectivity.PollInterval,
+		CertDir:           filepath.Join(c.StateDir, "certs"),
+		CaptiveDNS:        c.AP.CaptiveDNS,
+		DnsmasqSharedDir:  networkmanager.DefaultSettings().DnsmasqSharedDir,
+	}
+}
+
+// HookSettings returns the configured hooks
+func (c Config) HookSettings() []hooks.Hook {
+	list := make([]hooks.Hook, 0, len(c.Hooks))
+	for _, hook := range c.Hooks {
+		list = append(list, hooks.Hook{
+			Name:    hook.Name,
+			Event:   hook.Event,
+			Command: hook.Command,
+			Unit:    hook.Unit,
+			Timeout: hook.Timeout,
+		})
+	}
+	return list
+}
+
+// WebhookSettings returns the configured webhooks
+func (c Config) WebhookSettings() []webhooks.Webhook {
+	list := make([]webhooks.Webhook, 0, len(c.Webhooks))
+	for _, hook := range c.Webhooks {
+		list = append(list, webhooks.Webhook{
+			URL:    hook.URL,
+			Secret: hook.Secret,
+			Events: hook.Events,
+		})
+	}
+	return list
+}
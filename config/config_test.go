@@ -0,0 +1,164 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	return path
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Errorf("Default().Validate() = %v", err)
+	}
+}
+
+func TestNetworkSettings(t *testing.T) {
+	cfg := Default()
+	cfg.AP.SSID = "PiFi"
+	cfg.StateDir = t.TempDir()
+	settings := cfg.NetworkSettings()
+	if settings.APSSID != "PiFi" || settings.CertDir != filepath.Join(cfg.StateDir, "certs") {
+		t.Errorf("NetworkSettings() = %+v", settings)
+	}
+	// NetworkManager's dnsmasq is configured for captive DNS
+	if settings.DnsmasqSharedDir == "" {
+		t.Error("NetworkSettings() has no DnsmasqSharedDir")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+listen: 127.0.0.1:9000
+interfaces:
+  wifi: wlan1
+ap:
+  ssid: PiFi-{serial}
+  passphrase: technician
+  security: wpa3
+  timeout: 2m
+  captive_dns: false
+connectivity:
+  ping_target: 9.9.9.9
+  poll_interval: 15s
+hooks:
+  - event: network-added
+    command: systemctl restart scraper
+  - name: vpn
+    event: connected
+    unit: wg-quick@wg0.service
+    timeout: 1m
+webhooks:
+  - url: https://backend.example.com/pifi
+    secret: s3cret
+    events: [connected, ap-fallback]
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	want := Default()
+	want.Listen = "127.0.0.1:9000"
+	want.Interfaces.Wifi = "wlan1"
+	want.AP.SSID = "PiFi-{serial}"
+	want.AP.Passphrase = "technician"
+	want.AP.Security = "wpa3"
+	want.AP.Timeout = 2 * time.Minute
+	want.AP.CaptiveDNS = false
+	want.Connectivity.PingTarget = "9.9.9.9"
+	want.Connectivity.PollInterval = 15 * time.Second
+	want.Hooks = []Hook{
+		{Event: "network-added", Command: "systemctl restart scraper"},
+		{Name: "vpn", Event: "connected", Unit: "wg-quick@wg0.service", Timeout: time.Minute},
+	}
+	want.Webhooks = []Webhook{
+		{URL: "https://backend.example.com/pifi", Secret: "s3cret", Events: []string{"connected", "ap-fallback"}},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("Load() = %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoadEmptyFile(t *testing.T) {
+	cfg, err := Load(writeConfig(t, ""))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("Load() = %+v, want defaults", cfg)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("expected error loading a missing file")
+	}
+	if _, err := Load(writeConfig(t, "interface:\n  wifi: wlan1\n")); err == nil {
+		t.Error("expected error for an unknown key")
+	}
+	if _, err := Load(writeConfig(t, "connectivity:\n  poll_interval: often\n")); err == nil {
+		t.Error("expected error for an invalid duration")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	webhook := Webhook{URL: "https://backend.example.com", Secret: "s3cret"}
+	withEvent := Webhook{URL: webhook.URL, Secret: webhook.Secret, Events: []string{"network-added"}}
+	for name, tc := range map[string]struct {
+		modify func(*Config)
+		want   string
+	}{
+		"listen without port": {func(c *Config) { c.Listen = "0.0.0.0" }, "listen"},
+		"listen bad port":     {func(c *Config) { c.Listen = ":http" }, "listen"},
+		"portal listen":       {func(c *Config) { c.AP.PortalListen = "80" }, "ap.portal_listen"},
+		"password hash":       {func(c *Config) { c.Auth.PasswordHash = "secret" }, "auth.password_hash"},
+		"session ttl":         {func(c *Config) { c.Auth.SessionTTL = time.Second }, "auth.session_ttl"},
+		"tls listen":          {func(c *Config) { c.TLS.Enabled, c.TLS.Listen = true, "8443" }, "tls.listen"},
+		"tls same port":       {func(c *Config) { c.TLS.Enabled, c.TLS.Listen = true, "[::]:8088" }, "tls.listen"},
+		"tls key file":        {func(c *Config) { c.TLS.CertFile = "/etc/pifi/cert.pem" }, "tls.key_file"},
+		"audit max size":      {func(c *Config) { c.Audit.MaxSize = 100 }, "audit.max_size"},
+		"audit backups":       {func(c *Config) { c.Audit.Backups = -1 }, "audit.backups"},
+		"hook event":          {func(c *Config) { c.Hooks = []Hook{{Event: "booted", Command: "true"}} }, "hooks[0].event"},
+		"hook action":         {func(c *Config) { c.Hooks = []Hook{{Event: "connected"}} }, "hooks[0]"},
+		"hook unit":           {func(c *Config) { c.Hooks = []Hook{{Event: "connected", Unit: "--now"}} }, "hooks[0].unit"},
+		"hook timeout":        {func(c *Config) { c.Hooks = []Hook{{Event: "connected", Command: "true", Timeout: time.Hour}} }, "hooks[0].timeout"},
+		"webhook url":         {func(c *Config) { c.Webhooks = []Webhook{{URL: "backend.example.com", Secret: "s"}} }, "webhooks[0].url"},
+		"webhook secret":      {func(c *Config) { c.Webhooks = []Webhook{{URL: "https://backend.example.com"}} }, "webhooks[0].secret"},
+		"webhook event":       {func(c *Config) { c.Webhooks = []Webhook{withEvent} }, "webhooks[0].events"},
+		"webhook twice":       {func(c *Config) { c.Webhooks = []Webhook{webhook, webhook} }, "webhooks[1].url"},
+		"backend":             {func(c *Config) { c.Backend = "connman" }, "backend"},
+		"wifi interface":      {func(c *Config) { c.Interfaces.Wifi = "" }, "interfaces.wifi"},
+		"ethernet interface":  {func(c *Config) { c.Interfaces.Ethernet = "eth0 eth1" }, "interfaces.ethernet"},
+		"state dir":           {func(c *Config) { c.StateDir = "" }, "state_dir"},
+		"ssid length":         {func(c *Config) { c.AP.SSID = strings.Repeat("x", 33) }, "ap.ssid"},
+		"ssid placeholder":    {func(c *Config) { c.AP.SSID = "PiFi-{hostname}" }, "ap.ssid"},
+		"short passphrase":    {func(c *Config) { c.AP.Passphrase = "secret" }, "ap.passphrase"},
+		"control characters":  {func(c *Config) { c.AP.Passphrase = "secret\npassword" }, "ap.passphrase"},
+		"ap security":         {func(c *Config) { c.AP.Security = "wep" }, "ap.security"},
+		"ap timeout":          {func(c *Config) { c.AP.Timeout = 0 }, "ap.timeout"},
+		"ping target":         {func(c *Config) { c.Connectivity.PingTarget = "-f" }, "connectivity.ping_target"},
+		"poll interval":       {func(c *Config) { c.Connectivity.PollInterval = time.Millisecond }, "connectivity.poll_interval"},
+	} {
+		cfg := Default()
+		tc.modify(&cfg)
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: Validate() = %v, want error mentioning %s", name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package hooks runs the commands and systemd units configured for network events.
+package hooks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/HanzalaGun/pifi/networkmanager"
+)
+
+// EventNetworkAdded is triggered when a network is added or modified through the API
+// or the web interface. The other events are the types of networkmanager.StatusEvent.
+const EventNetworkAdded = "network-added"
+
+// Events hooks can be configured for
+var Events = []string{
+	EventNetworkAdded,
+	networkmanager.EventConnected,
+	networkmanager.EventDisconnected,
+	networkmanager.EventModeChanged,
+	networkmanager.EventAPEnabled,
+	networkmanager.EventAPFallback,
+	networkmanager.EventIPChanged,
+}
+
+// DefaultTimeout applies to hooks without a timeout
+const DefaultTimeout = 30 * time.Second
+
+// Output kept open by processes that left the process group is abandoned after this delay
+const waitDelay = 5 * time.Second
+
+// Hook runs Command with sh -c, or restarts the systemd Unit, on every Event
+type Hook struct {
+	// Name identifies the hook in logs and results, the command or unit by default
+	Name    string
+	Event   string
+	Command string
+	Unit    string
+	Timeout time.Duration
+}
+
+// Result is the outcome of one hook
+type Result struct {
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Runner runs the hooks of an event one after another, in the configured order.
+// A nil Runner has no hooks.
+type Runner struct {
+	hooks []Hook
+}
+
+func New(hooks []Hook) *Runner {
+	return &Runner{hooks: hooks}
+}
+
+// Has reports whether hooks are configured for event
+func (r *Runner) Has(event string) bool {
+	return r != nil && slices.ContainsFunc(r.hooks, func(h Hook) bool { return h.Event == event })
+}
+
+// Run runs the hooks of event.Type and returns their results, or nil without hooks.
+// Failed hooks don't stop the following ones.
+func (r *Runner) Run(ctx context.Context, event networkmanager.StatusEvent) []Result {
+	if r == nil {
+		return nil
+	}
+	var results []Result
+	for _, hook := range r.hooks {
+		if hook.Event != event.Type {
+			continue
+		}
+		result := Result{Name: hook.name(), Success: true}
+		if err := hook.run(ctx, event); err != nil {
+			log.Printf("Hook %s for %s failed: %v", result.Name, event.Type, err)
+			result.Success, result.Error = false, err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Watch runs the hooks of every event until the channel is closed. Events are
+// handled in order, so a connected hook runs after the disconnected one.
+func (r *Runner) Watch(events <-chan networkmanager.StatusEvent) {
+	for event := range events {
+		r.Run(context.Background(), event)
+	}
+}
+
+func (h Hook) name() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if h.Unit != "" {
+		return h.Unit
+	}
+	return h.Command
+}
+
+func (h Hook) run(ctx context.Context, event networkmanager.StatusEvent) error {
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if h.Unit != "" {
+		cmd = exec.CommandContext(ctx, "systemctl", "restart", "--", h.Unit)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", h.Command)
+	}
+	cmd.Env = append(os.Environ(), Env(event)...)
+	// Timeouts kill the whole process group, not only the shell
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = waitDelay
+
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		log.Printf("Hook %s: %s", h.name(), scanner.Text())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Hook %s for %s finished in %s", h.name(), event.Type, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// NetworkAdded returns the event for adding or modifying the network ssid, with
+// the current status of nm
+func NetworkAdded(nm networkmanager.NetworkManager, ssid string) networkmanager.StatusEvent {
+	status, _ := nm.GetNetworkStatus()
+	return networkmanager.StatusEvent{
+		Type:       EventNetworkAdded,
+		Time:       time.Now(),
+		Mode:       status.Mode,
+		SSID:       ssid,
+		WifiIP:     status.IPs.WifiIP,
+		EthernetIP: status.IPs.EthernetIP,
+	}
+}
+
+// Env returns the environment variables describing event
+func Env(event networkmanager.StatusEvent) []string {
+	return []string{
+		"PIFI_EVENT=" + event.Type,
+		"PIFI_TIME=" + event.Time.Format(time.RFC3339),
+		"PIFI_MODE=" + event.Mode,
+		"PIFI_SSID=" + event.SSID,
+		"PIFI_WIFI_IP=" + event.WifiIP,
+		"PIFI_ETHERNET_IP=" + event.EthernetIP,
+	}
+}
@@ -0,0 +1,65 @@
+package hooks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HanzalaGun/pifi/networkmanager"
+)
+
+func TestRun(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+	r := New([]Hook{
+		{Event: EventNetworkAdded, Command: `echo "$PIFI_EVENT $PIFI_SSID $PIFI_WIFI_IP" > ` + out},
+		{Name: "fails", Event: EventNetworkAdded, Command: "echo oops; exit 3"},
+		{Name: "other event", Event: networkmanager.EventDisconnected, Command: "exit 1"},
+		{Name: "slow", Event: EventNetworkAdded, Command: "sleep 5", Timeout: 100 * time.Millisecond},
+	})
+	start := time.Now()
+	results := r.Run(context.Background(), networkmanager.StatusEvent{
+		Type:   EventNetworkAdded,
+		Time:   start,
+		SSID:   "Home",
+		WifiIP: "192.168.1.20",
+	})
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("timeout not enforced, took %s", time.Since(start))
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("Run() = %+v, want 3 results", results)
+	}
+	if !results[0].Success || results[0].Name == "" {
+		t.Errorf("first hook = %+v", results[0])
+	}
+	if results[1].Success || !strings.Contains(results[1].Error, "exit status 3") {
+		t.Errorf("failing hook = %+v", results[1])
+	}
+	if results[2].Success || !strings.Contains(results[2].Error, "timed out") {
+		t.Errorf("slow hook = %+v", results[2])
+	}
+	env, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(env)); got != "network-added Home 192.168.1.20" {
+		t.Errorf("hook environment = %q", got)
+	}
+}
+
+func TestRunWithoutHooks(t *testing.T) {
+	var r *Runner
+	if r.Has(EventNetworkAdded) {
+		t.Error("nil Runner has hooks")
+	}
+	if results := r.Run(context.Background(), networkmanager.StatusEvent{Type: EventNetworkAdded}); results != nil {
+		t.Errorf("Run() = %+v, want nil", results)
+	}
+	if results := New(nil).Run(context.Background(), networkmanager.StatusEvent{Type: EventNetworkAdded}); results != nil {
+		t.Errorf("Run() = %+v, want nil", results)
+	}
+}
@@ -2,25 +2,33 @@
 package apihandlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
-	// "os"
-	"os/exec"
+
+	"github.com/HanzalaGun/pifi/hooks"
+	"github.com/HanzalaGun/pifi/html/audit"
+	"github.com/HanzalaGun/pifi/html/auth"
+	"github.com/HanzalaGun/pifi/html/forms"
 	"github.com/HanzalaGun/pifi/networkmanager"
 )
 
 type StatusResponse struct {
-	Status      string                        `json:"status"`
-	Timestamp   time.Time                     `json:"timestamp"`
-	Version     string                        `json:"version"`
+	Status      string                       `json:"status"`
+	Timestamp   time.Time                    `json:"timestamp"`
+	Version     string                       `json:"version"`
 	NetworkInfo networkmanager.NetworkStatus `json:"networkInfo"`
+	// TLSFingerprint is the SHA-256 fingerprint of the HTTPS certificate, for pinning
+	TLSFingerprint string `json:"tlsFingerprint,omitempty"`
 }
 
 type NetworkResponse struct {
-	AvailableNetworks  []string                        `json:"availableNetworks"`
+	AvailableNetworks  []networkmanager.ScanResult     `json:"availableNetworks"`
 	ConfiguredNetworks []networkmanager.ConnectionInfo `json:"configuredNetworks"`
 	Timestamp          time.Time                       `json:"timestamp"`
 }
@@ -31,8 +39,31 @@ func jsonResponse(w http.ResponseWriter, data interface{}, statusCode int) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// Rejects the request with 403 unless its identity grants scope
+func requireScope(w http.ResponseWriter, r *http.Request, scope string) bool {
+	identity, _ := auth.RequestIdentity(r)
+	if !identity.HasScope(scope) {
+		jsonResponse(w, map[string]string{"error": "missing scope " + scope}, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Rejects the request with 403 unless it was made by the admin
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	identity, _ := auth.RequestIdentity(r)
+	if !identity.Admin {
+		jsonResponse(w, map[string]string{"error": "requires the admin password"}, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func SetMode(nm networkmanager.NetworkManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeModeWrite) {
+			return
+		}
 		r.ParseForm()
 		err := nm.SetWifiMode(r.Form.Get("mode"))
 		if err != nil {
@@ -43,12 +74,17 @@ func SetMode(nm networkmanager.NetworkManager) http.HandlerFunc {
 	}
 }
 
-func StatusHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+// StatusHandler reports the network status. tlsFingerprint is empty without HTTPS.
+func StatusHandler(nm networkmanager.NetworkManager, tlsFingerprint string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeStatusRead) {
+			return
+		}
 		status := StatusResponse{
-			Status:    "operational",
-			Timestamp: time.Now(),
-			Version:   "1.0.0",
+			Status:         "operational",
+			Timestamp:      time.Now(),
+			Version:        "1.0.0",
+			TLSFingerprint: tlsFingerprint,
 		}
 		netStatus, err := nm.GetNetworkStatus()
 		if err != nil {
@@ -61,6 +97,9 @@ func StatusHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 
 func NetworksHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeNetworksRead) {
+			return
+		}
 		availableNetworks, err := nm.FindAvailableNetworks()
 		if err != nil {
 			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
@@ -71,6 +110,12 @@ func NetworksHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
 			return
 		}
+		// Stored passwords are only shown to the admin, not to read-only tokens
+		if identity, _ := auth.RequestIdentity(r); !identity.Admin {
+			for i := range configuredNetworks {
+				configuredNetworks[i].Password = ""
+			}
+		}
 		response := NetworkResponse{
 			AvailableNetworks:  availableNetworks,
 			ConfiguredNetworks: configuredNetworks,
@@ -80,66 +125,93 @@ func NetworksHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 	}
 }
 
-// func ModifyNetworkHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
-// 	return func(w http.ResponseWriter, r *http.Request) {
-// 		r.ParseForm()
-// 		err := nm.ModifyNetworkConnection(r.Form.Get("ssid"), r.Form.Get("password"), false)
-// 		if err != nil {
-// 			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
-// 			return
-// 		}
-// 		// cmd := exec.Command("/home/optistok/.nvm/versions/node/v20.9.0/bin/node","/home/optistok/.nvm/versions/node/v20.9.0/bin/pm2", "restart", "optistokscrapping")
-// 		// if err := cmd.Run(); err != nil {
-// 		// 	jsonResponse(w, map[string]string{"error": "Failed to restart PM2: " + err.Error()}, http.StatusInternalServerError)
-// 		// 	return
-// 		// }
-// 		// cmd := exec.Command("bash", "-c", "source /home/optistok/.nvm/nvm.sh && nvm use 20 && pm2 restart optistokscrapping")
-// 		cmd := exec.Command("bash", "-c", "source /home/optistok/.nvm/nvm.sh && nvm use 20 && export PM2_HOME=/home/optistok/.pm2 && pm2 restart optistokscrapping")
-// 		cmd.Stdout = os.Stdout
-// 		cmd.Stderr = os.Stderr		
-// 		output, err := cmd.CombinedOutput()
-// 		if err != nil {
-// 			fmt.Println("PM2 Hatası:", err)
-// 			fmt.Println("PM2 Çıktısı:", string(output)) // Çıktıyı yazdırarak kullanılmış hale getiriyoruz
-// 			jsonResponse(w, map[string]string{"error": "Failed to restart PM2: " + err.Error()}, http.StatusInternalServerError)
-// 			return
-// 		}
-// 		fmt.Println("PM2 Çıktısı:", string(output))
-
-// 		jsonResponse(w, map[string]string{"message": "Network modified successfully"}, http.StatusOK)
-// 	}
-// }
-func ModifyNetworkHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+// ModifyNetworkResponse reports the network-added hooks separately, a failed hook
+// doesn't fail the request since the network was saved
+type ModifyNetworkResponse struct {
+	Message string         `json:"message"`
+	Hooks   []hooks.Result `json:"hooks,omitempty"`
+}
+
+func ModifyNetworkHandler(nm networkmanager.NetworkManager, hookRunner *hooks.Runner) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-		err := nm.ModifyNetworkConnection(r.Form.Get("ssid"), r.Form.Get("password"), true)
+		if !requireScope(w, r, auth.ScopeNetworksWrite) {
+			return
+		}
+		conn, err := forms.ParseConnection(r, true)
+		if err != nil {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+			return
+		}
+		err = nm.ModifyNetworkConnection(conn)
+		if errors.Is(err, networkmanager.ErrSecurityMismatch) {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
 			return
 		}
 
-		// Komutun çalıştırılması
-		
-		cmd := exec.Command("bash", "-c", "source /home/optistok/.nvm/nvm.sh && nvm use 20 && export PM2_HOME=/home/optistok/.pm2 && pm2 restart optistokscrapping")
-		log.Println("Komut Çalıştırılıyor:", cmd.String())
-		// cmd.Stdout = os.Stdout  // Standart çıktıyı yazdır
-		// cmd.Stderr = os.Stderr  // Hata çıktısını yazdır
+		response := ModifyNetworkResponse{Message: "Network modified successfully"}
+		if hookRunner.Has(hooks.EventNetworkAdded) {
+			event := hooks.NetworkAdded(nm, conn.SSID)
+			// Hooks are limited by their own timeouts, which may exceed the server's.
+			// Without a way to extend it they run in the background, like in the web
+			// interface, so the client still learns that the network was saved.
+			if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+				log.Printf("Running network-added hooks in the background: %v", err)
+				go hookRunner.Run(context.Background(), event)
+			} else {
+				// Hooks run to completion even if the client goes away
+				response.Hooks = hookRunner.Run(context.Background(), event)
+			}
+		}
+		jsonResponse(w, response, http.StatusOK)
+	}
+}
 
-		output, err := cmd.CombinedOutput()
+func IPv4Handler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeNetworksWrite) {
+			return
+		}
+		ssid, config, err := forms.ParseIPv4(r)
 		if err != nil {
-			log.Println("PM2 Hatası:", err)
-			log.Println("PM2 Çıktısı:", string(output)) // Çıktıyı yazdır
-			jsonResponse(w, map[string]string{"error": "Failed to restart PM2: " + err.Error()}, http.StatusInternalServerError)
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
 			return
 		}
-		log.Println("PM2 Çıktısı:", string(output))
-
-		// Başarı durumu
-		jsonResponse(w, map[string]string{"message": "Network modified successfully"}, http.StatusOK)
+		err = nm.SetIPv4Config(ssid, config)
+		if err != nil {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, map[string]string{"message": "IPv4 configuration updated"}, http.StatusOK)
 	}
 }
+func IPv6Handler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeNetworksWrite) {
+			return
+		}
+		ssid, config, err := forms.ParseIPv6(r)
+		if err != nil {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+			return
+		}
+		err = nm.SetIPv6Config(ssid, config)
+		if err != nil {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, map[string]string{"message": "IPv6 configuration updated"}, http.StatusOK)
+	}
+}
+
 func RemoveNetworkConnectionHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeNetworksWrite) {
+			return
+		}
 		r.ParseForm()
 		err := nm.RemoveNetworkConnection(r.Form.Get("network"))
 		if err != nil {
@@ -151,6 +223,9 @@ func RemoveNetworkConnectionHandler(nm networkmanager.NetworkManager) http.Handl
 }
 func RemoveAllNetworkConnectionHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
+        if !requireScope(w, r, auth.ScopeNetworksWrite) {
+            return
+        }
         err := nm.SetupAPConnection()
         if err != nil {
             log.Fatalf("Error setting up AP connection: %v", err)
@@ -163,6 +238,9 @@ func RemoveAllNetworkConnectionHandler(nm networkmanager.NetworkManager) http.Ha
 
 func AutoConnectNetworkHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeNetworksWrite) {
+			return
+		}
 		r.ParseForm()
 		err := nm.SetAutoConnectConnection(r.Form.Get("network"), true)
 		if err != nil {
@@ -175,6 +253,9 @@ func AutoConnectNetworkHandler(nm networkmanager.NetworkManager) http.HandlerFun
 
 func ConnectNetworkHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeNetworksWrite) {
+			return
+		}
 		r.ParseForm()
 		err := nm.ConnectNetwork(r.Form.Get("network"))
 		if err != nil {
@@ -184,3 +265,194 @@ func ConnectNetworkHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 		jsonResponse(w, map[string]string{"message": "Connected successfully"}, http.StatusOK)
 	}
 }
+
+func APClientsHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeStatusRead) {
+			return
+		}
+		clients, err := nm.GetAPClients()
+		if err != nil {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, clients, http.StatusOK)
+	}
+}
+
+func DisconnectAPClientHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeModeWrite) {
+			return
+		}
+		r.ParseForm()
+		err := nm.DisconnectAPClient(r.Form.Get("mac"))
+		if err != nil {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, map[string]string{"message": "Client disconnected"}, http.StatusOK)
+	}
+}
+
+// LoginHandler returns a session token for the admin password, to be sent as bearer token
+func LoginHandler(a *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if !a.CheckPassword(r.Form.Get("password")) {
+			log.Printf("Failed API login from %s", r.RemoteAddr)
+			jsonResponse(w, map[string]string{"error": "wrong password"}, http.StatusUnauthorized)
+			return
+		}
+		token, err := a.NewSession()
+		if err != nil {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, map[string]string{"token": token}, http.StatusOK)
+	}
+}
+
+func LogoutHandler(a *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		a.EndSession(strings.TrimSpace(token))
+		jsonResponse(w, map[string]string{"message": "Logged out"}, http.StatusOK)
+	}
+}
+
+// TokensHandler lists the API tokens
+func TokensHandler(tokens *auth.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		jsonResponse(w, tokens.List(), http.StatusOK)
+	}
+}
+
+// CreateTokenHandler creates an API token from the name and comma separated scopes
+// fields. The secret is only returned here.
+func CreateTokenHandler(tokens *auth.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		r.ParseForm()
+		var scopes []string
+		for _, scope := range strings.Split(r.Form.Get("scopes"), ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				scopes = append(scopes, scope)
+			}
+		}
+		name := r.Form.Get("name")
+		secret, err := tokens.Create(name, scopes)
+		if err != nil {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+			return
+		}
+		log.Printf("API token %s created", name)
+		jsonResponse(w, map[string]string{"name": name, "token": secret}, http.StatusOK)
+	}
+}
+
+func RevokeTokenHandler(tokens *auth.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		r.ParseForm()
+		name := r.Form.Get("name")
+		err := tokens.Revoke(name)
+		if errors.Is(err, auth.ErrTokenNotFound) {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		log.Printf("API token %s revoked", name)
+		jsonResponse(w, map[string]string{"message": "Token revoked"}, http.StatusOK)
+	}
+}
+
+// AuditHandler returns the audit entries between the optional since and until
+// times, given in RFC 3339 format
+func AuditHandler(l *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		var since, until time.Time
+		for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+			value := r.URL.Query().Get(name)
+			if value == "" {
+				continue
+			}
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				jsonResponse(w, map[string]string{"error": fmt.Sprintf("invalid %s time %q: expected RFC 3339", name, value)}, http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+		entries, err := l.Query(since, until)
+		if err != nil {
+			jsonResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, entries, http.StatusOK)
+	}
+}
+
+// EventsHandler streams status events as Server-Sent Events, named by their type
+func EventsHandler(watcher *networkmanager.Watcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeStatusRead) {
+			return
+		}
+		rc := http.NewResponseController(w)
+		// The server's write timeout would end the stream
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			jsonResponse(w, map[string]string{"error": "streaming not supported"}, http.StatusInternalServerError)
+			return
+		}
+		ch := watcher.Watch(r.Context())
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+		// Comments keep proxies and the browser from closing an idle stream
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			case event, ok := <-ch:
+				if !ok {
+					return
+				}
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// MetricsHandler serves the Prometheus metrics to clients with the status:read scope
+func MetricsHandler(metrics http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireScope(w, r, auth.ScopeStatusRead) {
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,123 @@
+package apihandlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HanzalaGun/pifi/hooks"
+	"github.com/HanzalaGun/pifi/html/auth"
+	"github.com/HanzalaGun/pifi/networkmanager"
+)
+
+type fakeManager struct {
+	networkmanager.NetworkManager
+}
+
+func (fakeManager) FindAvailableNetworks() ([]networkmanager.ScanResult, error) {
+	return []networkmanager.ScanResult{}, nil
+}
+
+func (fakeManager) GetConfiguredConnections() ([]networkmanager.ConnectionInfo, error) {
+	return []networkmanager.ConnectionInfo{{SSID: "Home", Password: "hunter22"}}, nil
+}
+
+func (fakeManager) ModifyNetworkConnection(conn networkmanager.ConnectionConfig) error {
+	return nil
+}
+
+func (fakeManager) GetNetworkStatus() (networkmanager.NetworkStatus, error) {
+	return networkmanager.NetworkStatus{Mode: networkmanager.ModeClient}, nil
+}
+
+func TestModifyNetworkHandlerHooks(t *testing.T) {
+	done := filepath.Join(t.TempDir(), "done")
+	runner := hooks.New([]hooks.Hook{{Name: "slow", Event: hooks.EventNetworkAdded, Command: "sleep 0.2 && touch " + done}})
+	handler := auth.New("", time.Hour, nil, nil).Middleware(ModifyNetworkHandler(fakeManager{}, runner))
+	form := url.Values{"ssid": {"Home"}}.Encode()
+
+	// A server can extend the write deadline, so the response waits for the hooks
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	resp, err := http.Post(srv.URL, "application/x-www-form-urlencoded", strings.NewReader(form))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response ModifyNetworkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Hooks) != 1 || !response.Hooks[0].Success {
+		t.Errorf("hooks = %+v, want the slow hook", response.Hooks)
+	}
+	if err := os.Remove(done); err != nil {
+		t.Fatalf("hook didn't run before the response: %v", err)
+	}
+
+	// Otherwise the hooks run in the background
+	req := httptest.NewRequest("POST", "/api/add-network", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	response = ModifyNetworkResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || response.Hooks != nil {
+		t.Errorf("status %d, hooks %+v", rec.Code, response.Hooks)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if _, err := os.Stat(done); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hook didn't run in the background")
+		}
+	}
+}
+
+func TestNetworksHandlerPasswords(t *testing.T) {
+	tokens, err := auth.LoadTokens(filepath.Join(t.TempDir(), "api-tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := tokens.Create("monitoring", []string{auth.ScopeNetworksRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := auth.HashPassword("admin-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth.New(hash, time.Hour, nil, tokens).Middleware(NetworksHandler(fakeManager{}))
+
+	for name, tc := range map[string]struct {
+		authorize func(r *http.Request)
+		password  string
+	}{
+		"read-only token": {func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+secret) }, ""},
+		"admin":           {func(r *http.Request) { r.SetBasicAuth("admin", "admin-password") }, "hunter22"},
+	} {
+		req := httptest.NewRequest("GET", "/api/network", nil)
+		tc.authorize(req)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", name, rec.Code, rec.Body)
+		}
+		var response NetworkResponse
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.ConfiguredNetworks) != 1 || response.ConfiguredNetworks[0].Password != tc.password {
+			t.Errorf("%s: configured networks = %+v, want password %q", name, response.ConfiguredNetworks, tc.password)
+		}
+	}
+}
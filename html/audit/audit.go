@@ -0,0 +1,269 @@
+// Package audit records configuration changes made through the web interface and API.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HanzalaGun/pifi/html/auth"
+)
+
+// maxBody limits the requests parsed by the middleware, enough for the certificates
+// uploaded with an enterprise network
+const maxBody = 1 << 20
+
+// Results of audit entries
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Entry is one change, stored as a line of JSON
+type Entry struct {
+	Time     time.Time `json:"time"`
+	IP       string    `json:"ip"`
+	Identity string    `json:"identity"`
+	// Action is the route, such as /api/add-network
+	Action string `json:"action"`
+	SSID   string `json:"ssid,omitempty"`
+	Result string `json:"result"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Log is a JSON lines file that is rotated when it grows beyond maxSize. The
+// rotated files are named path.1 (the newest) to path.<backups>.
+type Log struct {
+	path    string
+	maxSize int64
+	backups int
+	now     func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open appends to the audit log at path
+func Open(path string, maxSize int64, backups int) (*Log, error) {
+	l := &Log{path: path, maxSize: maxSize, backups: backups, now: time.Now}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Close closes the file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Record appends an entry, rotating the file first when it would grow too large
+func (l *Log) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = l.now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return nil
+}
+
+// Shifts path.N to path.N+1 and path to path.1, dropping the oldest file
+func (l *Log) rotate() error {
+	l.file.Close()
+	if l.backups == 0 {
+		os.Remove(l.path)
+	} else {
+		os.Remove(l.backup(l.backups))
+		for i := l.backups - 1; i >= 1; i-- {
+			os.Rename(l.backup(i), l.backup(i+1))
+		}
+		if err := os.Rename(l.path, l.backup(1)); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %v", err)
+		}
+	}
+	return l.open()
+}
+
+func (l *Log) backup(i int) string {
+	return l.path + "." + strconv.Itoa(i)
+}
+
+// Query returns the entries from since to until, oldest first. Zero times are
+// not limited.
+func (l *Log) Query(since, until time.Time) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]Entry, 0)
+	for i := l.backups; i >= 0; i-- {
+		path := l.path
+		if i > 0 {
+			path = l.backup(i)
+		}
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %v", err)
+		}
+		entries, err = readEntries(file, entries, since, until)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+	return entries, nil
+}
+
+func readEntries(r io.Reader, entries []Entry, since, until time.Time) ([]Entry, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var e Entry
+		// A line cut short by a crash is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if (!since.IsZero() && e.Time.Before(since)) || (!until.IsZero() && e.Time.After(until)) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Middleware records every request that may change something, that is all but
+// GET, HEAD and OPTIONS. It runs after authentication so the identity is known.
+func (l *Log) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The form is parsed here, since handlers parse it into copies of the request.
+		// Public routes such as /login have no SSID and are left alone, other bodies
+		// are limited and kept in memory.
+		identity, identified := auth.RequestIdentity(r)
+		if identified {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+			r.ParseMultipartForm(maxBody)
+		}
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		e := Entry{
+			IP:     r.RemoteAddr,
+			Action: r.URL.Path,
+			SSID:   r.FormValue("ssid"),
+			Status: rec.status,
+			Result: ResultSuccess,
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			e.IP = host
+		}
+		if identified {
+			e.Identity = identity.Name
+		}
+		// Saved networks are referred to by name
+		if e.SSID == "" {
+			e.SSID = r.FormValue("network")
+		}
+		if rec.status >= http.StatusBadRequest {
+			e.Result = ResultFailure
+			e.Error = rec.errorMessage()
+		}
+		if err := l.Record(e); err != nil {
+			// Losing an entry is better than refusing all changes
+			log.Println(err)
+		}
+	})
+}
+
+// Keeps the status and the start of error responses
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets handlers use http.ResponseController, e.g. to extend the write deadline
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status >= http.StatusBadRequest && len(r.body) < 512 {
+		r.body = append(r.body, b[:min(len(b), 512-len(r.body))]...)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Returns the error of a JSON API response or the text of a web interface error.
+// Pages such as the failed login aren't useful in the log.
+func (r *recorder) errorMessage() string {
+	contentType := r.Header().Get("Content-Type")
+	if strings.HasPrefix(contentType, "application/json") {
+		var response struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(r.body, &response)
+		return response.Error
+	}
+	if strings.HasPrefix(contentType, "text/plain") {
+		return strings.TrimSpace(string(r.body))
+	}
+	return http.StatusText(r.status)
+}
@@ -0,0 +1,176 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HanzalaGun/pifi/html/auth"
+)
+
+func TestRotateAndQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		err := l.Record(Entry{Time: start.Add(time.Duration(i) * time.Minute), Action: "/api/connect", SSID: "Home", Result: ResultSuccess})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + ".2"); err != nil {
+		t.Errorf("no rotated file: %v", err)
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("more backups than configured")
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > 300 {
+		t.Errorf("audit log not rotated: %v, %v", info, err)
+	}
+
+	entries, err := l.Query(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The oldest entries were rotated away, the rest is in order
+	if len(entries) == 0 || len(entries) == 10 || !entries[len(entries)-1].Time.Equal(start.Add(9*time.Minute)) {
+		t.Fatalf("Query returned %d entries: %+v", len(entries), entries)
+	}
+	for i := 1; i < len(entries); i++ {
+		if !entries[i].Time.After(entries[i-1].Time) {
+			t.Errorf("entries out of order: %v before %v", entries[i-1].Time, entries[i].Time)
+		}
+	}
+
+	entries, err = l.Query(start.Add(8*time.Minute), start.Add(8*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !entries[0].Time.Equal(start.Add(8*time.Minute)) {
+		t.Errorf("Query with time filter = %+v", entries)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// Authentication is disabled, so every request is made by the admin
+	authenticator := auth.New("", time.Hour, nil, nil)
+	handler := authenticator.Middleware(l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			return
+		}
+		// Like the handlers, which see a copy of the request made by other middleware
+		r = r.WithContext(r.Context())
+		r.ParseForm()
+		if r.Form.Get("network") == "Cafe" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "connection failed"})
+		}
+	})))
+
+	for _, req := range []struct{ method, path, body string }{
+		{"GET", "/api/status", ""},
+		{"POST", "/add-network", "ssid=Home&password=secret"},
+		{"POST", "/api/connect", "network=Cafe"},
+	} {
+		r := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "192.168.1.20:51234"
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	entries, err := l.Query(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("recorded %d entries, want 2: %+v", len(entries), entries)
+	}
+	if e := entries[0]; e.Action != "/add-network" || e.SSID != "Home" || e.IP != "192.168.1.20" || e.Result != ResultSuccess {
+		t.Errorf("first entry = %+v", e)
+	}
+	if e := entries[1]; e.SSID != "Cafe" || e.Result != ResultFailure || e.Status != 500 || e.Error != "connection failed" {
+		t.Errorf("second entry = %+v", e)
+	}
+	if entries[0].Identity != auth.AdminIdentity {
+		t.Errorf("identity = %q, want %q", entries[0].Identity, auth.AdminIdentity)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "secret") {
+		t.Error("the audit log contains a password")
+	}
+}
+
+func TestMiddlewareLimitsBody(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "audit.jsonl"), 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var form url.Values
+	var readErr error
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+		form = r.Form
+	})
+
+	// Unauthenticated requests to public routes are passed on unparsed
+	r := httptest.NewRequest("POST", "/login", strings.NewReader("password=secret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	l.Middleware(next).ServeHTTP(httptest.NewRecorder(), r)
+	if form != nil || readErr != nil {
+		t.Errorf("public request parsed: form %v, %v", form, readErr)
+	}
+
+	// Other bodies are cut off at maxBody
+	handler := auth.New("", time.Hour, nil, nil).Middleware(l.Middleware(next))
+	r = httptest.NewRequest("POST", "/add-network", strings.NewReader("ssid="+strings.Repeat("x", 2*maxBody)))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if form.Get("ssid") != "" {
+		t.Errorf("oversized form parsed: ssid of %d bytes", len(form.Get("ssid")))
+	}
+}
+
+func TestMiddlewareResponseController(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "audit.jsonl"), 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	authenticator := auth.New("", time.Hour, nil, nil)
+	srv := httptest.NewServer(authenticator.Middleware(l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))))
+	defer srv.Close()
+
+	resp, err := http.PostForm(srv.URL+"/api/add-network", url.Values{"ssid": {"Home"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Errorf("SetWriteDeadline behind the middleware: %s", body)
+	}
+}
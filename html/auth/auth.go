@@ -0,0 +1,240 @@
+// Package auth protects the web interface and JSON API with the admin password.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SessionCookie holds the session token of a logged in browser
+const SessionCookie = "pifi_session"
+
+// AdminIdentity is the name of requests authenticated with the admin password or a session
+const AdminIdentity = "admin"
+
+// Identity is who made a request
+type Identity struct {
+	// Name is AdminIdentity or the name of an API token
+	Name   string
+	Scopes []string
+	// Admin is set for the admin password and sessions, which may also manage API tokens
+	Admin bool
+}
+
+// HasScope reports whether the identity grants scope
+func (i Identity) HasScope(scope string) bool {
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type identityKey struct{}
+
+// RequestIdentity returns the identity the middleware attached to the request
+func RequestIdentity(r *http.Request) (Identity, bool) {
+	identity, ok := r.Context().Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// Authenticator checks the admin password and API tokens and keeps the sessions created
+// by logging in. Sessions are kept in memory, so restarting PiFi logs everyone out.
+type Authenticator struct {
+	hash   []byte
+	ttl    time.Duration
+	public map[string]bool
+	tokens *TokenStore
+	now    func() time.Time
+
+	mu       sync.Mutex
+	sessions map[string]time.Time
+}
+
+// New returns an Authenticator for the bcrypt hash of the admin password. Without a hash
+// authentication is disabled. Requests for the public paths never require a login.
+// tokens may be nil when API tokens are not used.
+func New(passwordHash string, ttl time.Duration, public []string, tokens *TokenStore) *Authenticator {
+	a := &Authenticator{
+		hash:     []byte(passwordHash),
+		ttl:      ttl,
+		public:   make(map[string]bool),
+		tokens:   tokens,
+		now:      time.Now,
+		sessions: make(map[string]time.Time),
+	}
+	for _, path := range public {
+		a.public[path] = true
+	}
+	return a
+}
+
+// HashPassword returns the bcrypt hash to store in the config
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Enabled reports whether an admin password is configured
+func (a *Authenticator) Enabled() bool {
+	return len(a.hash) > 0
+}
+
+// CheckPassword reports whether password is the admin password
+func (a *Authenticator) CheckPassword(password string) bool {
+	return a.Enabled() && bcrypt.CompareHashAndPassword(a.hash, []byte(password)) == nil
+}
+
+// NewSession returns the token of a new session
+func (a *Authenticator) NewSession() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	// Expired sessions are dropped whenever a new one is created
+	for t, expiry := range a.sessions {
+		if now.After(expiry) {
+			delete(a.sessions, t)
+		}
+	}
+	a.sessions[token] = now.Add(a.ttl)
+	return token, nil
+}
+
+// ValidSession reports whether token belongs to a session that hasn't expired
+func (a *Authenticator) ValidSession(token string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for t, expiry := range a.sessions {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return a.now().Before(expiry)
+		}
+	}
+	return false
+}
+
+// EndSession logs a session out
+func (a *Authenticator) EndSession(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sessions, token)
+}
+
+// SessionToken returns the token of the session cookie, or an empty string
+func SessionToken(r *http.Request) string {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// Identify returns who made the request: the admin for a valid session cookie, the admin
+// password as HTTP Basic auth (with any user name) or a session token as bearer token,
+// or an API token sent as bearer token. Everyone is the admin when authentication is
+// disabled, but API tokens still only get their own scopes.
+func (a *Authenticator) Identify(r *http.Request) (Identity, bool) {
+	admin := Identity{Name: AdminIdentity, Scopes: Scopes, Admin: true}
+	bearer, hasBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	bearer = strings.TrimSpace(bearer)
+	if hasBearer && a.tokens != nil {
+		if token, ok := a.tokens.Lookup(bearer); ok {
+			return Identity{Name: token.Name, Scopes: token.Scopes}, true
+		}
+	}
+	if !a.Enabled() {
+		return admin, true
+	}
+	if token := SessionToken(r); token != "" && a.ValidSession(token) {
+		return admin, true
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return admin, a.CheckPassword(password)
+	}
+	if hasBearer {
+		return admin, a.ValidSession(bearer)
+	}
+	return Identity{}, false
+}
+
+// Authenticated reports whether the request was made by the admin
+func (a *Authenticator) Authenticated(r *http.Request) bool {
+	identity, ok := a.Identify(r)
+	return ok && identity.Admin
+}
+
+// IsAPI reports whether path is used by machine clients: the JSON API and the
+// Prometheus metrics
+func IsAPI(path string) bool {
+	return strings.HasPrefix(path, "/api/") || path == "/metrics"
+}
+
+// Middleware rejects requests that are not authenticated and attaches the identity
+// to the others. API clients get a 401 response, browsers are sent to the login page.
+// API tokens are only accepted for the API.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := a.Identify(r)
+		if ok && !identity.Admin && !IsAPI(r.URL.Path) {
+			ok = false
+		}
+		if ok {
+			r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+		}
+		if ok || a.public[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch {
+		case IsAPI(r.URL.Path):
+			w.Header().Set("WWW-Authenticate", `Basic realm="PiFi"`)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "authentication required"})
+		case r.Header.Get("HX-Request") != "":
+			// htmx follows this header with a full page load
+			w.Header().Set("HX-Redirect", "/login")
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		}
+	})
+}
+
+// SetSessionCookie stores the session token in the browser
+func (a *Authenticator) SetSessionCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(a.ttl / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearSessionCookie removes the session cookie from the browser
+func ClearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	handler := CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	// Pages get a token to embed
+	w := httptest.NewRecorder()
+	var token string
+	CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = CSRFToken(r)
+	})).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != CSRFCookie || cookies[0].Value != token || !validCSRFToken(token) {
+		t.Fatalf("cookies = %v, token %q", cookies, token)
+	}
+	cookie := CSRFCookie + "=" + token
+
+	for name, tc := range map[string]struct {
+		path   string
+		header map[string]string
+		form   string
+		want   int
+	}{
+		"no token":             {"/setmode", map[string]string{"Cookie": cookie}, "", http.StatusForbidden},
+		"no cookie":            {"/setmode", map[string]string{CSRFHeader: token}, "", http.StatusForbidden},
+		"wrong token":          {"/setmode", map[string]string{"Cookie": cookie, CSRFHeader: token[1:] + "0"}, "", http.StatusForbidden},
+		"header":               {"/setmode", map[string]string{"Cookie": cookie, CSRFHeader: token}, "", http.StatusTeapot},
+		"form field":           {"/logout", map[string]string{"Cookie": cookie}, CSRFField + "=" + token, http.StatusTeapot},
+		"api login":            {"/api/login", nil, "password=s3cret", http.StatusTeapot},
+		"api without cookie":   {"/api/setmode", nil, "mode=ap", http.StatusTeapot},
+		"api session":          {"/api/setmode", map[string]string{"Cookie": SessionCookie + "=abc"}, "mode=ap", http.StatusForbidden},
+		"api login cross-site": {"/api/login", map[string]string{"Sec-Fetch-Site": "cross-site"}, "password=s3cret", http.StatusForbidden},
+		"api bearer":           {"/api/setmode", map[string]string{"Authorization": "Bearer pifi_x"}, "mode=ap", http.StatusTeapot},
+		"api cross-site":       {"/api/setmode", map[string]string{"Authorization": "Basic eDp5", "Sec-Fetch-Site": "cross-site"}, "", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("POST", tc.path, strings.NewReader(tc.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range tc.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", name, w.Code, tc.want)
+		}
+	}
+
+	// Safe methods never need the token
+	r := httptest.NewRequest("GET", "/status", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusTeapot {
+		t.Errorf("GET: status = %d", w.Code)
+	}
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes limit what an API token may do
+const (
+	ScopeStatusRead    = "status:read"
+	ScopeNetworksRead  = "networks:read"
+	ScopeNetworksWrite = "networks:write"
+	ScopeModeWrite     = "mode:write"
+)
+
+// Scopes lists every scope, which is what the admin password grants
+var Scopes = []string{ScopeStatusRead, ScopeNetworksRead, ScopeNetworksWrite, ScopeModeWrite}
+
+// Prefix of API token secrets, so they are easy to recognise in scripts
+const tokenPrefix = "pifi_"
+
+// ErrTokenNotFound is returned when revoking a token that doesn't exist
+var ErrTokenNotFound = errors.New("no such API token")
+
+// APIToken is a named token for machine clients of the JSON API.
+// Only the SHA-256 hash of the secret is stored.
+type APIToken struct {
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// TokenStore keeps the API tokens in a JSON file
+type TokenStore struct {
+	path string
+	now  func() time.Time
+
+	mu     sync.Mutex
+	tokens []APIToken
+}
+
+// LoadTokens reads the tokens stored at path. A missing file holds no tokens.
+func LoadTokens(path string) (*TokenStore, error) {
+	s := &TokenStore{path: path, now: time.Now}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API tokens: %v", err)
+	}
+	if err := json.Unmarshal(data, &s.tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// List returns the tokens without their hashes
+func (s *TokenStore) List() []APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := make([]APIToken, len(s.tokens))
+	for i, token := range s.tokens {
+		token.Hash = ""
+		tokens[i] = token
+	}
+	return tokens
+}
+
+// Create adds a token and returns its secret, which can't be retrieved later
+func (s *TokenStore) Create(name string, scopes []string) (string, error) {
+	if err := validTokenName(name); err != nil {
+		return "", err
+	}
+	if len(scopes) == 0 {
+		return "", fmt.Errorf("a token needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !knownScope(scope) {
+			return "", fmt.Errorf("unknown scope %q: expected one of %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	secret := tokenPrefix + hex.EncodeToString(buf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.tokens {
+		if token.Name == name {
+			return "", fmt.Errorf("a token named %q already exists", name)
+		}
+	}
+	scopes = append([]string(nil), scopes...)
+	sort.Strings(scopes)
+	tokens := append(s.tokens, APIToken{
+		Name:    name,
+		Scopes:  scopes,
+		Created: s.now().UTC().Truncate(time.Second),
+		Hash:    hashToken(secret),
+	})
+	if err := s.save(tokens); err != nil {
+		return "", err
+	}
+	s.tokens = tokens
+	return secret, nil
+}
+
+// Revoke deletes the token called name
+func (s *TokenStore) Revoke(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, token := range s.tokens {
+		if token.Name != name {
+			continue
+		}
+		tokens := append(append([]APIToken(nil), s.tokens[:i]...), s.tokens[i+1:]...)
+		if err := s.save(tokens); err != nil {
+			return err
+		}
+		s.tokens = tokens
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrTokenNotFound, name)
+}
+
+// Lookup returns the token with the given secret
+func (s *TokenStore) Lookup(secret string) (APIToken, bool) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return APIToken{}, false
+	}
+	hash := []byte(hashToken(secret))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token.Hash), hash) == 1 {
+			return token, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// Writes the tokens to a temporary file first, so a crash never leaves a truncated file
+func (s *TokenStore) save(tokens []APIToken) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("failed to save API tokens: %v", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save API tokens: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to save API tokens: %v", err)
+	}
+	return nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func knownScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Token names are shown in logs, so they are limited to a simple character set
+func validTokenName(name string) error {
+	if name == "" || len(name) > 64 {
+		return fmt.Errorf("invalid token name %q: must be 1 to 64 characters", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.", c)) {
+			return fmt.Errorf("invalid token name %q: only letters, digits, '-', '_' and '.' are allowed", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store, err := LoadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := store.Create("fleet", []string{ScopeStatusRead, ScopeNetworksRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, scopes := range map[string][]string{
+		"fleet":     {ScopeStatusRead},
+		"bad name!": {ScopeStatusRead},
+		"unscoped":  nil,
+		"unknown":   {"admin"},
+	} {
+		if _, err := store.Create(name, scopes); err == nil {
+			t.Errorf("Create(%q, %v) succeeded", name, scopes)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Error("the token secret is stored in plain text")
+	}
+
+	// Tokens survive a restart
+	store, err = LoadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, ok := store.Lookup(secret)
+	if !ok || token.Name != "fleet" || !reflect.DeepEqual(token.Scopes, []string{ScopeNetworksRead, ScopeStatusRead}) {
+		t.Errorf("Lookup = %+v, %v", token, ok)
+	}
+	if _, ok := store.Lookup(secret + "0"); ok {
+		t.Error("Lookup accepted a wrong secret")
+	}
+	if list := store.List(); len(list) != 1 || list[0].Hash != "" {
+		t.Errorf("List = %+v, want one token without hash", list)
+	}
+
+	if err := store.Revoke("fleet"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Lookup(secret); ok {
+		t.Error("revoked token is still valid")
+	}
+	if err := store.Revoke("fleet"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Revoke of a missing token = %v, want ErrTokenNotFound", err)
+	}
+}
+
+func TestMiddlewareTokens(t *testing.T) {
+	store, err := LoadTokens(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := store.Create("monitoring", []string{ScopeStatusRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAuthenticator(t)
+	a.tokens = store
+
+	var identity Identity
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = RequestIdentity(r)
+	}))
+
+	r := httptest.NewRequest("GET", "/api/status", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || identity.Name != "monitoring" || identity.Admin {
+		t.Errorf("API request: status %d, identity %+v", w.Code, identity)
+	}
+	if !identity.HasScope(ScopeStatusRead) || identity.HasScope(ScopeNetworksWrite) {
+		t.Errorf("identity scopes = %v", identity.Scopes)
+	}
+
+	// Tokens are only for the JSON API
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("web interface request: status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+}
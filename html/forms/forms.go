@@ -0,0 +1,169 @@
+// Package forms parses the network forms shared by the web interface and the API.
+package forms
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/HanzalaGun/pifi/networkmanager"
+)
+
+// maxUpload limits the size of uploaded certificates and keys
+const maxUpload = 64 << 10
+
+// ParseConnection reads a client profile from a urlencoded or multipart form.
+// Enterprise settings are only read when an EAP method is given.
+func ParseConnection(r *http.Request, autoConnect bool) (networkmanager.ConnectionConfig, error) {
+	conn := networkmanager.ConnectionConfig{AutoConnect: autoConnect}
+	if err := r.ParseMultipartForm(4 * maxUpload); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return conn, fmt.Errorf("failed to parse form: %v", err)
+	}
+	conn.SSID = r.FormValue("ssid")
+	if conn.SSID == "" {
+		return conn, fmt.Errorf("ssid is required")
+	}
+	conn.Password = r.FormValue("password")
+	conn.Security = r.FormValue("security")
+	conn.Hidden = checked(r.FormValue("hidden"))
+	if r.FormValue("ipv4_method") != "" {
+		ipv4 := parseIPv4(r)
+		if err := ipv4.Validate(); err != nil {
+			return conn, err
+		}
+		conn.IPv4 = &ipv4
+	}
+	if r.FormValue("ipv6_method") != "" {
+		ipv6 := parseIPv6(r)
+		if err := ipv6.Validate(); err != nil {
+			return conn, err
+		}
+		conn.IPv6 = &ipv6
+	}
+
+	eap := r.FormValue("eap")
+	if eap == "" {
+		return conn, nil
+	}
+	e := &networkmanager.EnterpriseConfig{
+		EAP:                eap,
+		Identity:           r.FormValue("identity"),
+		AnonymousIdentity:  r.FormValue("anonymous_identity"),
+		Password:           r.FormValue("eap_password"),
+		Phase2:             r.FormValue("phase2"),
+		PrivateKeyPassword: r.FormValue("private_key_password"),
+	}
+	for field, data := range map[string]*[]byte{
+		"ca_cert":     &e.CACert,
+		"client_cert": &e.ClientCert,
+		"private_key": &e.PrivateKey,
+	} {
+		upload, err := readUpload(r, field)
+		if err != nil {
+			return conn, err
+		}
+		*data = upload
+	}
+	if err := e.Validate(); err != nil {
+		return conn, err
+	}
+	conn.Enterprise = e
+	return conn, nil
+}
+
+// ParseIPv4 reads the IPv4 configuration of a connection. The SSID is empty
+// when the ethernet field is set, which selects the Ethernet connection.
+func ParseIPv4(r *http.Request) (ssid string, config networkmanager.IPv4Config, err error) {
+	if ssid, err = parseTarget(r); err != nil {
+		return "", config, err
+	}
+	config = parseIPv4(r)
+	if err := config.Validate(); err != nil {
+		return "", config, err
+	}
+	return ssid, config, nil
+}
+
+// ParseIPv6 reads the IPv6 configuration of a connection like ParseIPv4
+func ParseIPv6(r *http.Request) (ssid string, config networkmanager.IPv6Config, err error) {
+	if ssid, err = parseTarget(r); err != nil {
+		return "", config, err
+	}
+	config = parseIPv6(r)
+	if err := config.Validate(); err != nil {
+		return "", config, err
+	}
+	return ssid, config, nil
+}
+
+// Returns the SSID of the connection to configure, empty for Ethernet
+func parseTarget(r *http.Request) (string, error) {
+	if err := r.ParseMultipartForm(maxUpload); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return "", fmt.Errorf("failed to parse form: %v", err)
+	}
+	if checked(r.FormValue("ethernet")) {
+		return "", nil
+	}
+	ssid := r.FormValue("ssid")
+	if ssid == "" {
+		return "", fmt.Errorf("ssid or ethernet is required")
+	}
+	return ssid, nil
+}
+
+func parseIPv4(r *http.Request) networkmanager.IPv4Config {
+	return networkmanager.IPv4Config{
+		Method:  r.FormValue("ipv4_method"),
+		Address: strings.TrimSpace(r.FormValue("ipv4_address")),
+		Gateway: strings.TrimSpace(r.FormValue("ipv4_gateway")),
+		DNS:     splitList(r.FormValue("ipv4_dns")),
+		Search:  splitList(r.FormValue("ipv4_search")),
+	}
+}
+
+func parseIPv6(r *http.Request) networkmanager.IPv6Config {
+	return networkmanager.IPv6Config{
+		Method:  r.FormValue("ipv6_method"),
+		Address: strings.TrimSpace(r.FormValue("ipv6_address")),
+		Gateway: strings.TrimSpace(r.FormValue("ipv6_gateway")),
+		DNS:     splitList(r.FormValue("ipv6_dns")),
+	}
+}
+
+// Splits a comma or space separated list
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// Reports whether a checkbox or boolean field is set
+func checked(value string) bool {
+	switch strings.ToLower(value) {
+	case "on", "yes", "true", "1":
+		return true
+	}
+	return false
+}
+
+// Returns the content of an uploaded file, nil when the field is empty
+func readUpload(r *http.Request, field string) ([]byte, error) {
+	file, _, err := r.FormFile(field)
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", field, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxUpload+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", field, err)
+	}
+	if len(data) > maxUpload {
+		return nil, fmt.Errorf("%s is larger than %d bytes", field, maxUpload)
+	}
+	return data, nil
+}
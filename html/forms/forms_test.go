@@ -0,0 +1,128 @@
+package forms
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/HanzalaGun/pifi/networkmanager"
+)
+
+const testCert = "-----BEGIN CERTIFICATE-----\nMIIBszCCAVmgAwIBAgIU\n-----END CERTIFICATE-----\n"
+
+func TestParseConnectionPSK(t *testing.T) {
+	form := url.Values{"ssid": {"HomeWifi"}, "password": {"secret123"}, "security": {"wpa3-sae"}, "hidden": {"on"}}
+	r := httptest.NewRequest("POST", "/add-network", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	conn, err := ParseConnection(r, true)
+	if err != nil {
+		t.Fatalf("ParseConnection: %v", err)
+	}
+	want := networkmanager.ConnectionConfig{SSID: "HomeWifi", Password: "secret123", AutoConnect: true, Security: networkmanager.SecurityWPA3SAE}
+	if conn.SSID != want.SSID || conn.Password != want.Password || conn.Security != want.Security || !conn.Hidden || !conn.AutoConnect || conn.Enterprise != nil {
+		t.Errorf("ParseConnection() = %+v, want %+v", conn, want)
+	}
+}
+
+func TestParseConnectionEnterprise(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for field, value := range map[string]string{
+		"ssid":         "Corp",
+		"eap":          "peap",
+		"identity":     "alice",
+		"eap_password": "s3cret",
+	} {
+		mw.WriteField(field, value)
+	}
+	fw, _ := mw.CreateFormFile("ca_cert", "ca.pem")
+	fw.Write([]byte(testCert))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/add-network", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	conn, err := ParseConnection(r, false)
+	if err != nil {
+		t.Fatalf("ParseConnection: %v", err)
+	}
+	e := conn.Enterprise
+	if e == nil || e.Identity != "alice" || e.Password != "s3cret" || string(e.CACert) != testCert || e.ClientCert != nil {
+		t.Errorf("Enterprise = %+v", e)
+	}
+	if e != nil && e.Phase2 != networkmanager.Phase2MSCHAPv2 {
+		t.Errorf("Phase2 = %q, want the MSCHAPv2 default", e.Phase2)
+	}
+}
+
+func TestParseConnectionErrors(t *testing.T) {
+	for name, form := range map[string]url.Values{
+		"missing ssid":     {"password": {"secret123"}},
+		"missing identity": {"ssid": {"Corp"}, "eap": {"peap"}},
+		"unsupported eap":  {"ssid": {"Corp"}, "eap": {"leap"}, "identity": {"alice"}},
+	} {
+		r := httptest.NewRequest("POST", "/add-network", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if _, err := ParseConnection(r, false); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseIPv4(t *testing.T) {
+	form := url.Values{
+		"ssid":         {"HomeWifi"},
+		"ipv4_method":  {"manual"},
+		"ipv4_address": {"192.168.1.50/24"},
+		"ipv4_gateway": {"192.168.1.1"},
+		"ipv4_dns":     {"1.1.1.1, 9.9.9.9"},
+		"ipv4_search":  {"lan example.com"},
+	}
+	r := httptest.NewRequest("POST", "/ipv4", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	ssid, config, err := ParseIPv4(r)
+	if err != nil {
+		t.Fatalf("ParseIPv4: %v", err)
+	}
+	if ssid != "HomeWifi" || len(config.DNS) != 2 || config.DNS[1] != "9.9.9.9" || len(config.Search) != 2 {
+		t.Errorf("ParseIPv4() = %q, %+v", ssid, config)
+	}
+
+	form = url.Values{"ethernet": {"on"}, "ssid": {"ignored"}, "ipv4_method": {"auto"}}
+	r = httptest.NewRequest("POST", "/ipv4", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if ssid, config, err := ParseIPv4(r); err != nil || ssid != "" || config.Method != networkmanager.IPMethodAuto {
+		t.Errorf("ParseIPv4() = %q, %+v, %v; want the Ethernet connection with DHCP", ssid, config, err)
+	}
+}
+
+func TestParseIPv6(t *testing.T) {
+	form := url.Values{
+		"ssid":         {"HomeWifi"},
+		"ipv6_method":  {"manual"},
+		"ipv6_address": {"2001:db8::50/64"},
+		"ipv6_gateway": {"fe80::1"},
+		"ipv6_dns":     {"2001:db8::53"},
+	}
+	r := httptest.NewRequest("POST", "/ipv6", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	ssid, config, err := ParseIPv6(r)
+	if err != nil {
+		t.Fatalf("ParseIPv6: %v", err)
+	}
+	if ssid != "HomeWifi" || config.Address != "2001:db8::50/64" || len(config.DNS) != 1 {
+		t.Errorf("ParseIPv6() = %q, %+v", ssid, config)
+	}
+
+	form = url.Values{"ethernet": {"on"}, "ipv6_method": {"dhcpv6"}}
+	r = httptest.NewRequest("POST", "/ipv6", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, _, err := ParseIPv6(r); err == nil {
+		t.Error("expected an error for an unsupported method")
+	}
+}
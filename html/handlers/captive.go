@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/HanzalaGun/pifi/networkmanager"
+)
+
+// Responses operating systems expect from their connectivity checks when online.
+// Anything else, such as a redirect, makes them show the sign in page.
+var probeResponses = map[string]struct {
+	status      int
+	contentType string
+	body        string
+}{
+	// Android and ChromeOS
+	"/generate_204": {http.StatusNoContent, "", ""},
+	"/gen_204":      {http.StatusNoContent, "", ""},
+	// iOS and macOS
+	"/hotspot-detect.html":       {http.StatusOK, "text/html", appleSuccess},
+	"/library/test/success.html": {http.StatusOK, "text/html", appleSuccess},
+	// Windows
+	"/ncsi.txt":        {http.StatusOK, "text/plain", "Microsoft NCSI"},
+	"/connecttest.txt": {http.StatusOK, "text/plain", "Microsoft Connect Test"},
+	// Firefox
+	"/success.txt":    {http.StatusOK, "text/plain", "success\n"},
+	"/canonical.html": {http.StatusOK, "text/html", `<meta http-equiv="refresh" content="0;url=https://support.mozilla.org/kb/captive-portal"/>`},
+}
+
+const appleSuccess = "<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>"
+
+// ProbePaths returns the connectivity check paths served by ProbeHandler
+func ProbePaths() []string {
+	paths := make([]string, 0, len(probeResponses))
+	for path := range probeResponses {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// ProbeHandler answers connectivity checks. In AP mode clients are redirected to
+// the web interface, which makes them open it as a captive portal.
+func ProbeHandler(nm networkmanager.NetworkManager, uiPort string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if nm.GetWifiMode() == networkmanager.ModeAP {
+			redirectToPortal(w, r, uiPort)
+			return
+		}
+		probe := probeResponses[r.URL.Path]
+		if probe.contentType != "" {
+			w.Header().Set("Content-Type", probe.contentType)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(probe.status)
+		w.Write([]byte(probe.body))
+	}
+}
+
+// CaptivePortal redirects requests for other hosts to the web interface while in
+// AP mode. The captive DNS responder sends every host name to PiFi, so these are
+// pages opened by AP clients. Requests by IP address or for the device's own
+// host name are passed to next.
+func CaptivePortal(nm networkmanager.NetworkManager, uiPort string, next http.Handler) http.Handler {
+	hostname, _ := os.Hostname()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isOwnHost(r.Host, hostname) || nm.GetWifiMode() != networkmanager.ModeAP {
+			next.ServeHTTP(w, r)
+			return
+		}
+		redirectToPortal(w, r, uiPort)
+	})
+}
+
+// Reports whether host addresses PiFi directly rather than a site on the internet
+func isOwnHost(host, hostname string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return true
+	}
+	hostname = strings.ToLower(hostname)
+	return host == "localhost" || host == hostname || host == hostname+".local"
+}
+
+// Redirects to the web interface on the address the request was received on
+func redirectToPortal(w http.ResponseWriter, r *http.Request, uiPort string) {
+	host := "10.42.0.1"
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if h, _, err := net.SplitHostPort(local.String()); err == nil {
+			host = h
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, "http://"+net.JoinHostPort(host, uiPort)+"/", http.StatusFound)
+}
@@ -1,12 +1,17 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"time"
 
+	"github.com/HanzalaGun/pifi/hooks"
 	"github.com/HanzalaGun/pifi/html"
+	"github.com/HanzalaGun/pifi/html/auth"
+	"github.com/HanzalaGun/pifi/html/forms"
 	"github.com/HanzalaGun/pifi/networkmanager"
 )
 
@@ -15,10 +20,12 @@ type StatusResponse struct {
 	Timestamp   time.Time `json:"timestamp"`
 	Version     string    `json:"version"`
 	NetworkInfo networkmanager.NetworkStatus
+	// APClients are only listed in AP mode
+	APClients []networkmanager.APClient
 }
 
 type NetworkResponse struct {
-	AvailableNetworks  []string                        `json:"availableNetworks"`
+	AvailableNetworks  []networkmanager.ScanResult     `json:"availableNetworks"`
 	ConfiguredNetworks []networkmanager.ConnectionInfo `json:"configuredNetworks"`
 	Timestamp          time.Time                       `json:"timestamp"`
 }
@@ -41,7 +48,11 @@ func PiFiHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		err = tmpl.Execute(w, nil)
+		// The logout button is shown to browsers with a session
+		err = tmpl.Execute(w, map[string]interface{}{
+			"LoggedIn":  auth.SessionToken(r) != "",
+			"CSRFToken": auth.CSRFToken(r),
+		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -61,6 +72,9 @@ func StatusHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 			status.Status = fmt.Sprintf("error: %v", err)
 		}
 		status.NetworkInfo = netStatus
+		if netStatus.Mode == networkmanager.ModeAP {
+			status.APClients, _ = nm.GetAPClients()
+		}
 
 		tmpl, err := template.ParseFS(html.Templates, "templates/status.gohtml")
 		if err != nil {
@@ -106,10 +120,53 @@ func NetworksHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 	}
 }
 
-func ModifyNetworkHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+// ModifyNetworkHandler saves a network, then runs the network-added hooks in the
+// background. The web interface doesn't show their results, they are logged.
+func ModifyNetworkHandler(nm networkmanager.NetworkManager, hookRunner *hooks.Runner) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-		err := nm.ModifyNetworkConnection(r.Form.Get("ssid"), r.Form.Get("password"), false)
+		conn, err := forms.ParseConnection(r, false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = nm.ModifyNetworkConnection(conn)
+		if errors.Is(err, networkmanager.ErrSecurityMismatch) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if hookRunner.Has(hooks.EventNetworkAdded) {
+			go hookRunner.Run(context.Background(), hooks.NetworkAdded(nm, conn.SSID))
+		}
+	}
+}
+
+func IPv4Handler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ssid, config, err := forms.ParseIPv4(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = nm.SetIPv4Config(ssid, config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func IPv6Handler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ssid, config, err := forms.ParseIPv6(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = nm.SetIPv6Config(ssid, config)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -149,3 +206,14 @@ func ConnectNetworkHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
 		}
 	}
 }
+
+func DisconnectAPClientHandler(nm networkmanager.NetworkManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		err := nm.DisconnectAPClient(r.Form.Get("mac"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
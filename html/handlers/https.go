@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+)
+
+// RedirectHTTPS sends requests to the HTTPS listener on tlsPort. Connectivity
+// checks are passed to next, since clients expect them over plain HTTP.
+func RedirectHTTPS(tlsPort string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := probeResponses[r.URL.Path]; ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		target := "https://" + net.JoinHostPort(host, tlsPort) + r.URL.RequestURI()
+		// Temporary, so browsers don't remember it when TLS is disabled again
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+	})
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/HanzalaGun/pifi/html"
+	"github.com/HanzalaGun/pifi/html/auth"
+)
+
+type loginPage struct {
+	Error     string
+	CSRFToken string
+}
+
+func renderLogin(w http.ResponseWriter, page loginPage, statusCode int) {
+	tmpl, err := template.ParseFS(html.Templates, "templates/login.gohtml")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(statusCode)
+	tmpl.Execute(w, page)
+}
+
+func LoginPageHandler(a *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() || a.Authenticated(r) {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		renderLogin(w, loginPage{CSRFToken: auth.CSRFToken(r)}, http.StatusOK)
+	}
+}
+
+func LoginHandler(a *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if !a.CheckPassword(r.Form.Get("password")) {
+			log.Printf("Failed login from %s", r.RemoteAddr)
+			renderLogin(w, loginPage{Error: "Wrong password", CSRFToken: auth.CSRFToken(r)}, http.StatusUnauthorized)
+			return
+		}
+		token, err := a.NewSession()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.SetSessionCookie(w, r, token)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+func LogoutHandler(a *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.EndSession(auth.SessionToken(r))
+		auth.ClearSessionCookie(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,61 @@
+package tlscert
+
+import (
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	cert, err := LoadOrCreate(dir, "PiFi", []net.IP{net.ParseIP("10.42.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("pifi.local"); err != nil {
+		t.Error(err)
+	}
+	if err := leaf.VerifyHostname("10.42.0.1"); err != nil {
+		t.Error(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "key.pem")); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("key.pem: %v, %v", info, err)
+	}
+
+	// The certificate is kept across restarts, so its fingerprint stays pinned
+	again, err := LoadOrCreate(dir, "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(again) != Fingerprint(cert) {
+		t.Errorf("fingerprint changed from %s to %s", Fingerprint(cert), Fingerprint(again))
+	}
+
+	supplied, err := Load(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(supplied) != Fingerprint(cert) {
+		t.Error("Load returned a different certificate")
+	}
+	if _, err := Load(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("Load succeeded without a key")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cert, err := LoadOrCreate(t.TempDir(), "pifi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp := Fingerprint(cert); !regexp.MustCompile(`^([0-9A-F]{2}:){31}[0-9A-F]{2}$`).MatchString(fp) {
+		t.Errorf("Fingerprint = %q", fp)
+	}
+}
@@ -1,61 +1,234 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/gorilla/mux"
-	"github.com/HanzalaGun/pifi/html/handlers"
+	"github.com/HanzalaGun/pifi/config"
+	"github.com/HanzalaGun/pifi/hooks"
 	"github.com/HanzalaGun/pifi/html/apihandlers"
+	"github.com/HanzalaGun/pifi/html/audit"
+	"github.com/HanzalaGun/pifi/html/auth"
+	"github.com/HanzalaGun/pifi/html/handlers"
+	"github.com/HanzalaGun/pifi/html/tlscert"
+	"github.com/HanzalaGun/pifi/metrics"
 	"github.com/HanzalaGun/pifi/networkmanager"
+	"github.com/HanzalaGun/pifi/webhooks"
+	"github.com/godbus/dbus/v5"
+	"github.com/gorilla/mux"
 )
 
 func main() {
-	nm := networkmanager.New()
-	err := nm.SetupAPConnection()
+	defaults := config.Default()
+	configFlag := flag.String("config", config.DefaultPath, "Path to the YAML configuration file")
+	listenFlag := flag.String("listen", defaults.Listen, "Address to serve the web interface on")
+	backendFlag := flag.String("backend", defaults.Backend, "Network backend to use: auto, nmcli, dbus, wpa or iwd")
+	autoAPFlag := flag.Bool("auto", defaults.AP.Auto, "Enable automatic AP mode with no internet connection")
+	apTimeoutFlag := flag.Int("timeout", int(defaults.AP.Timeout/time.Second), "Offline time in seconds before re-enabling AP mode")
+	hashPasswordFlag := flag.Bool("hash-password", false, "Read a password from stdin and print its hash for auth.password_hash")
+	flag.Parse()
+
+	if *hashPasswordFlag {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			log.Fatalf("Error reading password: %v", err)
+		}
+		hash, err := auth.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatalf("Error hashing password: %v", err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	// Flags given on the command line override the config file
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	cfg, err := loadConfig(*configFlag, setFlags["config"])
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if setFlags["listen"] {
+		cfg.Listen = *listenFlag
+	}
+	if setFlags["backend"] {
+		cfg.Backend = *backendFlag
+	}
+	if setFlags["auto"] {
+		cfg.AP.Auto = *autoAPFlag
+	}
+	if setFlags["timeout"] {
+		cfg.AP.Timeout = time.Duration(*apTimeoutFlag) * time.Second
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	settings := cfg.NetworkSettings()
+	log.Printf("Access point SSID is %s", settings.APSSID)
+
+	stats := metrics.New()
+	runner := stats.Runner(networkmanager.ExecRunner{})
+	nm, err := newNetworkManager(cfg.Backend, settings, runner)
+	if err != nil {
+		log.Fatalf("Error creating network manager: %v", err)
+	}
+	err = nm.SetupAPConnection()
 	if err != nil {
 		log.Fatalf("Error setting up AP connection: %v", err)
 	}
 
-	autoAPFlag := flag.Bool("auto", true, "Enable automatic AP mode with no internet connection")
-	apTimeoutFlag := flag.Int("timeout", 30, "Offline time in seconds before re-enabling AP mode")
-	flag.Parse()
+	// Handlers and the AP fallback read the status kept up to date by the watcher
+	watcher := networkmanager.NewWatcher(nm, runner, settings)
+	go watcher.Run(context.Background())
+	go stats.Track(watcher.Watch(context.Background()))
+	nm = stats.Instrument(watcher)
+	hookRunner := hooks.New(cfg.HookSettings())
+	if len(cfg.Hooks) > 0 {
+		log.Printf("%d hooks configured", len(cfg.Hooks))
+		go hookRunner.Watch(watcher.Watch(context.Background()))
+	}
+	if len(cfg.Webhooks) > 0 {
+		hostname, _ := os.Hostname()
+		dispatcher, err := webhooks.Open(filepath.Join(cfg.StateDir, "webhooks.json"), cfg.WebhookSettings(), hostname)
+		if err != nil {
+			log.Fatalf("Error opening webhook queue: %v", err)
+		}
+		go dispatcher.Run(context.Background())
+		go dispatcher.Watch(watcher.Watch(context.Background()))
+	}
+
+	var certificate tls.Certificate
+	var fingerprint string
+	if cfg.TLS.Enabled {
+		certificate, err = loadCertificate(cfg)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificate: %v", err)
+		}
+		fingerprint = tlscert.Fingerprint(certificate)
+		log.Printf("TLS certificate fingerprint (SHA-256) %s", fingerprint)
+	}
+
+	// Connectivity checks of phones and laptops, which open the web interface as a captive portal in AP mode
+	_, uiPort, _ := net.SplitHostPort(cfg.Listen)
+	public := append(handlers.ProbePaths(), "/login", "/api/login")
+	tokens, err := auth.LoadTokens(filepath.Join(cfg.StateDir, "api-tokens.json"))
+	if err != nil {
+		log.Fatalf("Error loading API tokens: %v", err)
+	}
+	authenticator := auth.New(cfg.Auth.PasswordHash, cfg.Auth.SessionTTL, public, tokens)
+	if !authenticator.Enabled() {
+		log.Println("No auth.password_hash configured, the web interface is open to everyone on the network")
+	}
 
 	r := mux.NewRouter()
+	r.Use(authenticator.Middleware)
+	if cfg.Audit.Enabled {
+		auditLog, err := audit.Open(filepath.Join(cfg.StateDir, "audit.jsonl"), cfg.Audit.MaxSize, cfg.Audit.Backups)
+		if err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		defer auditLog.Close()
+		// Requests rejected for a missing CSRF token are recorded too
+		r.Use(auditLog.Middleware)
+		r.HandleFunc("/api/audit", apihandlers.AuditHandler(auditLog)).Methods("GET")
+	}
+	r.Use(auth.CSRF)
+	for _, path := range handlers.ProbePaths() {
+		r.HandleFunc(path, handlers.ProbeHandler(nm, uiPort)).Methods("GET", "HEAD")
+	}
+	r.HandleFunc("/login", handlers.LoginPageHandler(authenticator)).Methods("GET")
+	r.HandleFunc("/login", handlers.LoginHandler(authenticator)).Methods("POST")
+	r.HandleFunc("/logout", handlers.LogoutHandler(authenticator)).Methods("POST")
+	r.HandleFunc("/api/login", apihandlers.LoginHandler(authenticator)).Methods("POST")
+	r.HandleFunc("/api/logout", apihandlers.LogoutHandler(authenticator)).Methods("POST")
+	r.HandleFunc("/api/tokens", apihandlers.TokensHandler(tokens)).Methods("GET")
+	r.HandleFunc("/api/tokens", apihandlers.CreateTokenHandler(tokens)).Methods("POST")
+	r.HandleFunc("/api/tokens/revoke", apihandlers.RevokeTokenHandler(tokens)).Methods("POST")
+
 	r.HandleFunc("/", handlers.PiFiHandler(nm)).Methods("GET")
 	r.HandleFunc("/status", handlers.StatusHandler(nm)).Methods("GET")
 	r.HandleFunc("/network", handlers.NetworksHandler(nm)).Methods("GET")
 	r.HandleFunc("/setmode", handlers.SetMode(nm)).Methods("POST")
 
-	r.HandleFunc("/add-network", handlers.ModifyNetworkHandler(nm)).Methods("POST")
+	r.HandleFunc("/add-network", handlers.ModifyNetworkHandler(nm, hookRunner)).Methods("POST")
 	r.HandleFunc("/remove-network", handlers.RemoveNetworkConnectionHandler(nm)).Methods("POST")
 	r.HandleFunc("/autoconnect-network", handlers.AutoConnectNetworkHandler(nm)).Methods("POST")
 	r.HandleFunc("/connect", handlers.ConnectNetworkHandler(nm)).Methods("POST")
+	r.HandleFunc("/ipv4", handlers.IPv4Handler(nm)).Methods("POST")
+	r.HandleFunc("/ipv6", handlers.IPv6Handler(nm)).Methods("POST")
+	r.HandleFunc("/ap/disconnect", handlers.DisconnectAPClientHandler(nm)).Methods("POST")
 
-	r.HandleFunc("/api/status", apihandlers.StatusHandler(nm)).Methods("GET")
+	r.HandleFunc("/api/status", apihandlers.StatusHandler(nm, fingerprint)).Methods("GET")
+	r.HandleFunc("/api/events", apihandlers.EventsHandler(watcher)).Methods("GET")
+	r.HandleFunc("/metrics", apihandlers.MetricsHandler(stats.Handler())).Methods("GET")
 	r.HandleFunc("/api/network", apihandlers.NetworksHandler(nm)).Methods("GET")
 	r.HandleFunc("/api/setmode", apihandlers.SetMode(nm)).Methods("POST")
-	r.HandleFunc("/api/add-network", apihandlers.ModifyNetworkHandler(nm)).Methods("POST")
+	r.HandleFunc("/api/add-network", apihandlers.ModifyNetworkHandler(nm, hookRunner)).Methods("POST")
 	r.HandleFunc("/api/remove-network", apihandlers.RemoveNetworkConnectionHandler(nm)).Methods("POST")
 	r.HandleFunc("/api/remove-all-network", apihandlers.RemoveAllNetworkConnectionHandler(nm)).Methods("POST")
 	r.HandleFunc("/api/autoconnect-network", apihandlers.AutoConnectNetworkHandler(nm)).Methods("POST")
 	r.HandleFunc("/api/connect", apihandlers.ConnectNetworkHandler(nm)).Methods("POST")
+	r.HandleFunc("/api/ipv4", apihandlers.IPv4Handler(nm)).Methods("POST")
+	r.HandleFunc("/api/ipv6", apihandlers.IPv6Handler(nm)).Methods("POST")
+	r.HandleFunc("/api/ap/clients", apihandlers.APClientsHandler(nm)).Methods("GET")
+	r.HandleFunc("/api/ap/clients/disconnect", apihandlers.DisconnectAPClientHandler(nm)).Methods("POST")
+
+	handler := handlers.CaptivePortal(nm, uiPort, r)
 
 	srv := &http.Server{
-		Handler:      r,
-		Addr:         "0.0.0.0:8088",
+		Handler:      handler,
+		Addr:         cfg.Listen,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
+	// Captive portal redirects keep using plain HTTP, which then redirects to HTTPS
+	var tlsSrv *http.Server
+	if cfg.TLS.Enabled {
+		tlsSrv = &http.Server{
+			Handler:      handler,
+			Addr:         cfg.TLS.Listen,
+			TLSConfig:    &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12},
+			WriteTimeout: 15 * time.Second,
+			ReadTimeout:  15 * time.Second,
+		}
+		if cfg.TLS.Redirect {
+			_, tlsPort, _ := net.SplitHostPort(cfg.TLS.Listen)
+			srv.Handler = handlers.CaptivePortal(nm, uiPort, handlers.RedirectHTTPS(tlsPort, r))
+		}
+	}
+	// Clients open captive portals on port 80, which is served separately unless the web interface uses it.
+	// It is plain HTTP as well, so it redirects to HTTPS like listen.
+	var portal *http.Server
+	if _, portalPort, _ := net.SplitHostPort(cfg.AP.PortalListen); portalPort != "" && portalPort != uiPort {
+		portal = &http.Server{
+			Handler:      srv.Handler,
+			Addr:         cfg.AP.PortalListen,
+			WriteTimeout: 15 * time.Second,
+			ReadTimeout:  15 * time.Second,
+		}
+	}
 
-	if *autoAPFlag {
+	if cfg.AP.Auto {
 		go func() {
-			nm.ManageOfflineAP(time.Duration(*apTimeoutFlag) * time.Second)
+			nm.ManageOfflineAP(cfg.AP.Timeout)
+		}()
+	}
+	if settings.CaptiveDNS {
+		go func() {
+			nm.ManageCaptiveDNS()
 		}()
 	}
 
@@ -65,6 +238,22 @@ func main() {
 			log.Fatal(err)
 		}
 	}()
+	if tlsSrv != nil {
+		go func() {
+			log.Printf("Server starting on https://%s", tlsSrv.Addr)
+			if err := tlsSrv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if portal != nil {
+		go func() {
+			log.Printf("Captive portal starting on http://%s", portal.Addr)
+			if err := portal.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Captive portal stopped: %v", err)
+			}
+		}()
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -73,5 +262,62 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 	srv.Shutdown(ctx)
+	if tlsSrv != nil {
+		tlsSrv.Shutdown(ctx)
+	}
+	if portal != nil {
+		portal.Shutdown(ctx)
+	}
 	log.Println("PiFi Server Stopped")
 }
+
+// Reads the config file, falling back to the defaults when the default file doesn't exist
+func loadConfig(path string, explicit bool) (config.Config, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) && !explicit {
+		log.Printf("No config file at %s, using defaults", path)
+		return config.Default(), nil
+	}
+	return config.Load(path)
+}
+
+// Loads the configured certificate, or the self-signed one in the state directory
+func loadCertificate(cfg config.Config) (tls.Certificate, error) {
+	if cfg.TLS.CertFile != "" {
+		return tlscert.Load(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	}
+	hostname, _ := os.Hostname()
+	// Clients reach PiFi on the AP address while in AP mode
+	return tlscert.LoadOrCreate(filepath.Join(cfg.StateDir, "tls"), hostname, []net.IP{net.IPv4(10, 42, 0, 1)})
+}
+
+func newNetworkManager(backend string, settings networkmanager.Settings, runner networkmanager.CommandRunner) (networkmanager.NetworkManager, error) {
+	wpaCtrlPath := filepath.Join(networkmanager.WPACtrlDir, settings.WifiInterface)
+	if backend == networkmanager.BackendAuto {
+		detected, err := networkmanager.DetectBackend(runner, wpaCtrlPath)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Detected %s network backend", detected)
+		backend = detected
+	}
+
+	switch backend {
+	case networkmanager.BackendNMCLI:
+		return networkmanager.New(settings, runner), nil
+	case networkmanager.BackendDBus:
+		conn, err := dbus.ConnectSystemBus()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to system bus: %v", err)
+		}
+		return networkmanager.NewDBus(conn, settings, runner), nil
+	case networkmanager.BackendWPA:
+		return networkmanager.NewWPA(wpaCtrlPath, settings, runner), nil
+	case networkmanager.BackendIWD:
+		conn, err := dbus.ConnectSystemBus()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to system bus: %v", err)
+		}
+		return networkmanager.NewIWD(conn, networkmanager.DefaultIWDStateDir, settings, runner), nil
+	}
+	return nil, fmt.Errorf("unsupported backend: %s", backend)
+}
@@ -0,0 +1,227 @@
+// Package metrics exports the state of the device to Prometheus.
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HanzalaGun/pifi/networkmanager"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Connectivity states reported by NetworkManager
+var connectivityStates = []string{"full", "limited", "portal", "none", "unknown"}
+
+var (
+	signalDesc = prometheus.NewDesc("pifi_wifi_signal_percent",
+		"Signal quality of the wifi network in client mode.", nil, nil)
+	connectivityDesc = prometheus.NewDesc("pifi_connectivity",
+		"Connectivity state, 1 for the current state.", []string{"state"}, nil)
+	modeDesc = prometheus.NewDesc("pifi_mode",
+		"Wifi mode, 1 for the current mode.", []string{"mode"}, nil)
+	apClientsDesc = prometheus.NewDesc("pifi_ap_clients",
+		"Number of clients associated with the access point.", nil, nil)
+	apSecondsDesc = prometheus.NewDesc("pifi_ap_mode_seconds_total",
+		"Time spent in AP mode since PiFi started.", nil, nil)
+)
+
+// Metrics collects the PiFi metrics
+type Metrics struct {
+	registry        *prometheus.Registry
+	commandDuration *prometheus.HistogramVec
+	connectAttempts *prometheus.CounterVec
+	failovers       prometheus.Counter
+	now             func() time.Time
+
+	mu sync.Mutex
+	nm networkmanager.NetworkManager
+	// Time in AP mode before the current AP period, which started at apSince
+	apTime  time.Duration
+	apSince time.Time
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pifi_command_duration_seconds",
+			Help:    "Duration of the commands run by the network backend, such as nmcli.",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"command"}),
+		connectAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pifi_connect_attempts_total",
+			Help: "Attempts to connect to or add a network.",
+		}, []string{"result"}),
+		failovers: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pifi_ap_failovers_total",
+			Help: "Times the AP was enabled after losing the connection.",
+		}),
+		now: time.Now,
+	}
+	m.connectAttempts.WithLabelValues("success")
+	m.connectAttempts.WithLabelValues("failure")
+	m.registry.MustRegister(
+		m.commandDuration,
+		m.connectAttempts,
+		m.failovers,
+		(*statusCollector)(m),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Runner returns a CommandRunner that records the duration of the commands run by next
+func (m *Metrics) Runner(next networkmanager.CommandRunner) networkmanager.CommandRunner {
+	return &runner{next: next, duration: m.commandDuration}
+}
+
+type runner struct {
+	next     networkmanager.CommandRunner
+	duration *prometheus.HistogramVec
+}
+
+func (r *runner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	defer r.observe(name, time.Now())
+	return r.next.Output(ctx, name, args...)
+}
+
+func (r *runner) CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	defer r.observe(name, time.Now())
+	return r.next.CombinedOutput(ctx, name, args...)
+}
+
+// Streams run until they are stopped, so their duration isn't recorded
+func (r *runner) Stream(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	return r.next.Stream(ctx, name, args...)
+}
+
+func (r *runner) observe(name string, start time.Time) {
+	r.duration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+}
+
+// Instrument returns nm counting its connection attempts. The status metrics are
+// read from nm, which should be a Watcher so scrapes don't run any commands.
+func (m *Metrics) Instrument(nm networkmanager.NetworkManager) networkmanager.NetworkManager {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nm = nm
+	if nm.GetWifiMode() == networkmanager.ModeAP {
+		m.apSince = m.now()
+	}
+	return &instrumented{NetworkManager: nm, metrics: m}
+}
+
+type instrumented struct {
+	networkmanager.NetworkManager
+	metrics *Metrics
+}
+
+func (n *instrumented) ConnectNetwork(ssid string) error {
+	err := n.NetworkManager.ConnectNetwork(ssid)
+	n.metrics.countConnect(err)
+	return err
+}
+
+func (n *instrumented) ModifyNetworkConnection(conn networkmanager.ConnectionConfig) error {
+	err := n.NetworkManager.ModifyNetworkConnection(conn)
+	n.metrics.countConnect(err)
+	return err
+}
+
+func (m *Metrics) countConnect(err error) {
+	if err != nil {
+		m.connectAttempts.WithLabelValues("failure").Inc()
+	} else {
+		m.connectAttempts.WithLabelValues("success").Inc()
+	}
+}
+
+// Track counts failovers and the time spent in AP mode from the status events
+func (m *Metrics) Track(events <-chan networkmanager.StatusEvent) {
+	for event := range events {
+		switch event.Type {
+		case networkmanager.EventAPFallback:
+			m.failovers.Inc()
+		case networkmanager.EventModeChanged:
+			m.mu.Lock()
+			if event.Mode == networkmanager.ModeAP && m.apSince.IsZero() {
+				m.apSince = event.Time
+			} else if event.Mode != networkmanager.ModeAP && !m.apSince.IsZero() {
+				m.apTime += event.Time.Sub(m.apSince)
+				m.apSince = time.Time{}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// statusCollector reports the network status at scrape time
+type statusCollector Metrics
+
+func (c *statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- signalDesc
+	ch <- connectivityDesc
+	ch <- modeDesc
+	ch <- apClientsDesc
+	ch <- apSecondsDesc
+}
+
+func (c *statusCollector) Collect(ch chan<- prometheus.Metric) {
+	m := (*Metrics)(c)
+	m.mu.Lock()
+	nm := m.nm
+	apTime := m.apTime
+	if !m.apSince.IsZero() {
+		apTime += m.now().Sub(m.apSince)
+	}
+	m.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(apSecondsDesc, prometheus.CounterValue, apTime.Seconds())
+	if nm == nil {
+		return
+	}
+
+	status, err := nm.GetNetworkStatus()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(modeDesc, err)
+		return
+	}
+	for _, mode := range []string{networkmanager.ModeClient, networkmanager.ModeAP} {
+		ch <- prometheus.MustNewConstMetric(modeDesc, prometheus.GaugeValue, boolValue(status.Mode == mode), mode)
+	}
+	connectivity := strings.ToLower(status.Connectivity)
+	for _, state := range connectivityStates {
+		ch <- prometheus.MustNewConstMetric(connectivityDesc, prometheus.GaugeValue, boolValue(connectivity == state), state)
+	}
+	if status.Mode == networkmanager.ModeClient && status.SignalStr >= 0 {
+		ch <- prometheus.MustNewConstMetric(signalDesc, prometheus.GaugeValue, float64(status.SignalStr))
+	}
+	if status.Mode == networkmanager.ModeAP {
+		clients, err := nm.GetAPClients()
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(apClientsDesc, err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(apClientsDesc, prometheus.GaugeValue, float64(len(clients)))
+	} else {
+		ch <- prometheus.MustNewConstMetric(apClientsDesc, prometheus.GaugeValue, 0)
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HanzalaGun/pifi/networkmanager"
+)
+
+type fakeManager struct {
+	networkmanager.NetworkManager
+	status     networkmanager.NetworkStatus
+	connectErr error
+}
+
+func (f *fakeManager) GetNetworkStatus() (networkmanager.NetworkStatus, error) {
+	return f.status, nil
+}
+
+func (f *fakeManager) GetWifiMode() string {
+	return f.status.Mode
+}
+
+func (f *fakeManager) GetAPClients() ([]networkmanager.APClient, error) {
+	return []networkmanager.APClient{{}, {}}, nil
+}
+
+func (f *fakeManager) ConnectNetwork(ssid string) error {
+	return f.connectErr
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestRunner(t *testing.T) {
+	m := New()
+	runner := m.Runner(networkmanager.NewFakeRunner().On("nmcli general status", "connected", nil))
+	if _, err := runner.Output(context.Background(), "nmcli", "general", "status"); err != nil {
+		t.Fatal(err)
+	}
+	if body := scrape(t, m); !strings.Contains(body, `pifi_command_duration_seconds_count{command="nmcli"} 1`) {
+		t.Errorf("command duration not recorded:\n%s", body)
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	m := New()
+	fake := &fakeManager{status: networkmanager.NetworkStatus{
+		Mode:         networkmanager.ModeClient,
+		Connectivity: "full",
+		SignalStr:    72,
+	}}
+	nm := m.Instrument(fake)
+	nm.ConnectNetwork("Home")
+	fake.connectErr = errors.New("secrets were required")
+	nm.ConnectNetwork("Home")
+	nm.ConnectNetwork("Home")
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`pifi_connect_attempts_total{result="success"} 1`,
+		`pifi_connect_attempts_total{result="failure"} 2`,
+		`pifi_wifi_signal_percent 72`,
+		`pifi_connectivity{state="full"} 1`,
+		`pifi_connectivity{state="none"} 0`,
+		`pifi_mode{mode="client"} 1`,
+		`pifi_ap_clients 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestTrack(t *testing.T) {
+	m := New()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return start.Add(time.Hour) }
+	m.Instrument(&fakeManager{status: networkmanager.NetworkStatus{Mode: networkmanager.ModeAP, SignalStr: -1}})
+
+	events := make(chan networkmanager.StatusEvent, 4)
+	// 60s in AP mode, then the current AP period of 30 minutes
+	events <- networkmanager.StatusEvent{Type: networkmanager.EventModeChanged, Time: start, Mode: networkmanager.ModeClient}
+	events <- networkmanager.StatusEvent{Type: networkmanager.EventModeChanged, Time: start.Add(30 * time.Minute), Mode: networkmanager.ModeAP}
+	events <- networkmanager.StatusEvent{Type: networkmanager.EventAPFallback, Time: start.Add(30 * time.Minute), Mode: networkmanager.ModeAP}
+	close(events)
+	m.apSince = start.Add(-time.Minute)
+	m.Track(events)
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`pifi_ap_failovers_total 1`,
+		`pifi_ap_mode_seconds_total 1860`,
+		`pifi_mode{mode="ap"} 1`,
+		`pifi_ap_clients 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "pifi_wifi_signal_percent ") {
+		t.Error("signal reported in AP mode")
+	}
+}
@@ -0,0 +1,144 @@
+package networkmanager
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NMLeaseDir holds the leases of the dnsmasq instances NetworkManager starts for shared connections
+const NMLeaseDir = "/var/lib/NetworkManager"
+
+// APClient is a station associated with the PiFi access point
+type APClient struct {
+	MAC      string `json:"mac"`
+	IP       string `json:"ip,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	// Signal is the signal strength in dBm
+	Signal int32 `json:"signal"`
+	// ConnectedTime is the time since the client associated, in seconds
+	ConnectedTime int64 `json:"connectedTime"`
+}
+
+// Returns the dnsmasq lease file of a shared NetworkManager connection on iface
+func nmLeaseFile(iface string) string {
+	return filepath.Join(NMLeaseDir, "dnsmasq-"+iface+".leases")
+}
+
+// Lists the stations of the AP on iface. Addresses and host names are taken from
+// the dnsmasq leases, or from the neighbour table for clients without a lease.
+func apClients(runner CommandRunner, iface, leaseFile string) ([]APClient, error) {
+	output, err := runner.Output(context.Background(), "iw", "dev", iface, "station", "dump")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list AP clients: %v", err)
+	}
+	clients := parseStationDump(string(output))
+	leases := readLeases(leaseFile)
+	neighbours := neighbourIPs(runner, iface)
+	for i := range clients {
+		if lease, ok := leases[clients[i].MAC]; ok {
+			clients[i].IP, clients[i].Hostname = lease.IP, lease.Hostname
+		} else {
+			clients[i].IP = neighbours[clients[i].MAC]
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].MAC < clients[j].MAC })
+	return clients, nil
+}
+
+// Deauthenticates a station from the AP on iface. The client may reconnect.
+func disconnectAPClient(runner CommandRunner, iface, mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return fmt.Errorf("invalid MAC address %q", mac)
+	}
+	output, err := runner.CombinedOutput(context.Background(), "iw", "dev", iface, "station", "del", hw.String())
+	if err != nil {
+		return fmt.Errorf("failed to disconnect %s: %v\nOutput: %s", hw, err, output)
+	}
+	return nil
+}
+
+// Parses the output of iw station dump
+func parseStationDump(output string) []APClient {
+	clients := make([]APClient, 0)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "Station" {
+			clients = append(clients, APClient{MAC: strings.ToLower(fields[1])})
+			continue
+		}
+		if len(clients) == 0 {
+			continue
+		}
+		client := &clients[len(clients)-1]
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		values := strings.Fields(value)
+		if len(values) == 0 {
+			continue
+		}
+		switch key {
+		case "signal":
+			signal, _ := strconv.ParseInt(values[0], 10, 32)
+			client.Signal = int32(signal)
+		case "connected time":
+			client.ConnectedTime, _ = strconv.ParseInt(values[0], 10, 64)
+		}
+	}
+	return clients
+}
+
+type dhcpLease struct {
+	IP       string
+	Hostname string
+}
+
+// Reads a dnsmasq lease file: expiry, MAC, IP, host name and client ID per line
+func readLeases(path string) map[string]dhcpLease {
+	leases := make(map[string]dhcpLease)
+	file, err := os.Open(path)
+	if err != nil {
+		return leases
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		lease := dhcpLease{IP: fields[2]}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		leases[strings.ToLower(fields[1])] = lease
+	}
+	return leases
+}
+
+// Returns the IPv4 addresses of neighbours on iface by MAC address
+func neighbourIPs(runner CommandRunner, iface string) map[string]string {
+	ips := make(map[string]string)
+	output, err := runner.Output(context.Background(), "ip", "-4", "neigh", "show", "dev", iface)
+	if err != nil {
+		return ips
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "lladdr" && i+1 < len(fields) {
+				ips[strings.ToLower(fields[i+1])] = fields[0]
+			}
+		}
+	}
+	return ips
+}
@@ -0,0 +1,56 @@
+package networkmanager
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAPClients(t *testing.T) {
+	leases := filepath.Join(t.TempDir(), "dnsmasq-wlan0.leases")
+	err := os.WriteFile(leases, []byte("1767225600 3c:22:fb:12:34:56 10.42.0.57 pixel-7 01:3c:22:fb:12:34:56\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := NewFakeRunner().
+		On("iw dev wlan0 station dump", recorded(t, "iw_station_dump.txt"), nil).
+		On("ip -4 neigh show dev wlan0", "10.42.0.88 lladdr a4:83:e7:ab:cd:ef REACHABLE\n", nil)
+
+	clients, err := apClients(runner, "wlan0", leases)
+	if err != nil {
+		t.Fatalf("apClients: %v", err)
+	}
+	want := []APClient{
+		{MAC: "3c:22:fb:12:34:56", IP: "10.42.0.57", Hostname: "pixel-7", Signal: -48, ConnectedTime: 342},
+		{MAC: "a4:83:e7:ab:cd:ef", IP: "10.42.0.88", Signal: -71, ConnectedTime: 15},
+	}
+	if !reflect.DeepEqual(clients, want) {
+		t.Errorf("apClients() = %+v, want %+v", clients, want)
+	}
+}
+
+func TestDisconnectAPClient(t *testing.T) {
+	runner := NewFakeRunner().On("iw dev wlan0 station del 3c:22:fb:12:34:56", "", nil)
+
+	if err := disconnectAPClient(runner, "wlan0", "3C:22:FB:12:34:56"); err != nil {
+		t.Fatalf("disconnectAPClient: %v", err)
+	}
+	if err := disconnectAPClient(runner, "wlan0", "3c:22:fb:12:34:56; reboot"); err == nil {
+		t.Error("expected an error for an invalid MAC address")
+	}
+}
+
+func TestGetAPClientsClientMode(t *testing.T) {
+	runner := NewFakeRunner()
+	recordStatus(t, runner, "nmcli_general_connected.txt")
+	nm := newTestManager(runner)
+
+	clients, err := nm.GetAPClients()
+	if err != nil || len(clients) != 0 {
+		t.Errorf("GetAPClients() = %v, %v; want no clients outside AP mode", clients, err)
+	}
+	if runner.Called("iw dev wlan0 station dump") {
+		t.Error("the station dump must not be read in client mode")
+	}
+}
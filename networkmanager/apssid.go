@@ -0,0 +1,133 @@
+package networkmanager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// AP security modes, only used when the AP has a passphrase
+const (
+	APSecurityWPA2 = "wpa2"
+	APSecurityWPA3 = "wpa3"
+)
+
+// legacyAPPrefix names the AP profiles of older versions, which generated a random SSID on every start
+const legacyAPPrefix = "Optistok-AP-"
+
+// Sources of the {serial} and {mac} placeholders, overridden in tests
+var (
+	cpuInfoPath = "/proc/cpuinfo"
+	sysNetDir   = "/sys/class/net"
+)
+
+var apSSIDPlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+// CheckAPSSIDTemplate verifies that an AP SSID template only uses known placeholders
+// and always expands to a valid SSID length.
+func CheckAPSSIDTemplate(template string) error {
+	var unknown string
+	expanded := apSSIDPlaceholder.ReplaceAllStringFunc(template, func(p string) string {
+		switch p {
+		case "{serial}", "{mac}", "{random}":
+		default:
+			unknown = p
+		}
+		return "XXXX"
+	})
+	if unknown != "" {
+		return fmt.Errorf("unknown placeholder %s, expected {serial}, {mac} or {random}", unknown)
+	}
+	if expanded == "" || len(expanded) > 32 {
+		return fmt.Errorf("SSID must be 1 to 32 bytes long after expansion")
+	}
+	return nil
+}
+
+// ExpandAPSSID fills in an AP SSID template. {serial} and {mac} are replaced with the
+// last 4 characters of the board serial number and the wifi interface MAC address.
+// {random} is replaced with 4 random characters that are generated once and kept in
+// stateDir, so the SSID is the same after a restart. Placeholders that can't be read,
+// such as {mac} of a missing interface, fall back to {random} with a warning.
+func ExpandAPSSID(template, iface, stateDir string) string {
+	return apSSIDPlaceholder.ReplaceAllStringFunc(template, func(p string) string {
+		var value string
+		var err error
+		switch p {
+		case "{serial}":
+			value, err = boardSerial()
+		case "{mac}":
+			value, err = macAddress(iface)
+		case "{random}":
+			value, err = persistentRandom(stateDir)
+		default:
+			return p
+		}
+		if err != nil && p != "{random}" {
+			log.Printf("Using a random AP SSID suffix for %s: %v", p, err)
+			value, err = persistentRandom(stateDir)
+		}
+		if err != nil {
+			// Like older versions, the SSID then changes on every start
+			log.Printf("Failed to keep the random AP SSID suffix: %v", err)
+			value = randSeq(4)
+		}
+		return lastChars(strings.ToUpper(value), 4)
+	})
+}
+
+func lastChars(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[len(s)-n:]
+}
+
+// Reads the serial number the Raspberry Pi firmware reports in /proc/cpuinfo
+func boardSerial() (string, error) {
+	data, err := os.ReadFile(cpuInfoPath)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && strings.TrimSpace(key) == "Serial" {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	return "", fmt.Errorf("no serial number in %s", cpuInfoPath)
+}
+
+// Reads the MAC address of the interface without separators
+func macAddress(iface string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(sysNetDir, iface, "address"))
+	if err != nil {
+		return "", err
+	}
+	mac := strings.ReplaceAll(strings.TrimSpace(string(data)), ":", "")
+	if mac == "" {
+		return "", fmt.Errorf("%s has no MAC address", iface)
+	}
+	return mac, nil
+}
+
+// Returns the random SSID suffix stored in stateDir, generating it on first use
+func persistentRandom(stateDir string) (string, error) {
+	path := filepath.Join(stateDir, "ap-ssid-suffix")
+	if data, err := os.ReadFile(path); err == nil {
+		if suffix := strings.TrimSpace(string(data)); suffix != "" {
+			return suffix, nil
+		}
+	}
+	suffix := randSeq(4)
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(suffix+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	return suffix, nil
+}
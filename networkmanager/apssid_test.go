@@ -0,0 +1,73 @@
+package networkmanager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func fakeDeviceInfo(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	cpuinfo := filepath.Join(dir, "cpuinfo")
+	if err := os.WriteFile(cpuinfo, []byte("Hardware\t: BCM2835\nRevision\t: a02082\nSerial\t\t: 00000000a1b2c3d4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "net", "wlan0"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "net", "wlan0", "address"), []byte("b8:27:eb:12:9f:0e\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldCPUInfo, oldNet := cpuInfoPath, sysNetDir
+	cpuInfoPath, sysNetDir = cpuinfo, filepath.Join(dir, "net")
+	t.Cleanup(func() { cpuInfoPath, sysNetDir = oldCPUInfo, oldNet })
+}
+
+func TestExpandAPSSID(t *testing.T) {
+	fakeDeviceInfo(t)
+	stateDir := t.TempDir()
+
+	for template, want := range map[string]string{
+		"PiFi":                  "PiFi",
+		"Optistok-AP-{mac}":     "Optistok-AP-9F0E",
+		"Optistok-AP-{serial}":  "Optistok-AP-C3D4",
+		"{serial}-{mac}-Device": "C3D4-9F0E-Device",
+	} {
+		if got := ExpandAPSSID(template, "wlan0", stateDir); got != want {
+			t.Errorf("ExpandAPSSID(%q) = %q, want %q", template, got, want)
+		}
+	}
+
+	// An interface without a MAC address falls back to the stored random suffix
+	fallback := ExpandAPSSID("PiFi-{mac}", "wlan9", stateDir)
+	if random := ExpandAPSSID("PiFi-{random}", "wlan0", stateDir); fallback != random || len(fallback) != len("PiFi-")+4 {
+		t.Errorf("ExpandAPSSID() = %q, want the random SSID %q", fallback, random)
+	}
+}
+
+func TestExpandAPSSIDRandomPersists(t *testing.T) {
+	stateDir := t.TempDir()
+	first := ExpandAPSSID("PiFi-{random}", "wlan0", stateDir)
+	if len(first) != len("PiFi-")+4 {
+		t.Errorf("ExpandAPSSID() = %q, want 4 random characters", first)
+	}
+	if second := ExpandAPSSID("PiFi-{random}", "wlan0", stateDir); second != first {
+		t.Errorf("second ExpandAPSSID() = %q, want %q", second, first)
+	}
+}
+
+func TestCheckAPSSIDTemplate(t *testing.T) {
+	for template, valid := range map[string]bool{
+		"Optistok-AP-{mac}":                   true,
+		"{serial}{mac}{random}":               true,
+		"":                                    false,
+		"PiFi-{hostname}":                     false,
+		"A-very-long-access-point-name-{mac}": false,
+	} {
+		if err := CheckAPSSIDTemplate(template); (err == nil) != valid {
+			t.Errorf("CheckAPSSIDTemplate(%q) = %v, want valid=%v", template, err, valid)
+		}
+	}
+}
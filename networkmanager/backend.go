@@ -0,0 +1,37 @@
+package networkmanager
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Supported network backends
+const (
+	BackendAuto  = "auto"
+	BackendNMCLI = "nmcli"
+	BackendDBus  = "dbus"
+	BackendWPA   = "wpa"
+	BackendIWD   = "iwd"
+)
+
+// DetectBackend reports which network stack is managing the device: NetworkManager
+// on Bookworm images, iwd on lightweight images, or dhcpcd with wpa_supplicant on older images.
+func DetectBackend(runner CommandRunner, wpaCtrlPath string) (string, error) {
+	ctx := context.Background()
+	if _, err := runner.Output(ctx, "systemctl", "is-active", "NetworkManager"); err == nil {
+		return BackendNMCLI, nil
+	}
+	if _, err := runner.Output(ctx, "systemctl", "is-active", "iwd"); err == nil {
+		return BackendIWD, nil
+	}
+	if _, err := os.Stat(wpaCtrlPath); err == nil {
+		return BackendWPA, nil
+	}
+	for _, unit := range []string{"dhcpcd", "wpa_supplicant"} {
+		if _, err := runner.Output(ctx, "systemctl", "is-active", unit); err == nil {
+			return BackendWPA, nil
+		}
+	}
+	return "", fmt.Errorf("no supported network stack detected, expected NetworkManager, iwd or dhcpcd with wpa_supplicant")
+}
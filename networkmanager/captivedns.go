@@ -0,0 +1,233 @@
+package networkmanager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// CaptiveDNSPort is where the captive DNS responder listens on the AP address
+const CaptiveDNSPort = 53
+
+// Delay between checks whether the AP is up
+const captiveDNSInterval = 5 * time.Second
+
+// Leaves DNS to the captive DNS responder, dnsmasq only serves DHCP
+const dnsmasqCaptiveConf = `port=0
+dhcp-option=option:dns-server,10.42.0.1
+`
+
+// Name of the drop-in in Settings.DnsmasqSharedDir
+const dnsmasqSharedConf = "pifi-captive-dns.conf"
+
+// DNS message constants, see RFC 1035
+const (
+	dnsHeaderLen   = 12
+	dnsTypeA       = 1
+	dnsTypeANY     = 255
+	dnsClassIN     = 1
+	dnsFlagQR      = 1 << 15
+	dnsFlagAA      = 1 << 10
+	dnsFlagRD      = 1 << 8
+	dnsOpcodeMask  = 0xf << 11
+	dnsRcodeFormat = 1
+	dnsRcodeNotImp = 4
+)
+
+// captiveBackend is the part of a backend needed to run the captive DNS responder.
+type captiveBackend interface {
+	currentMode() string
+}
+
+// captiveDNS answers every query on the AP address with that address, so any
+// host name opened by an AP client resolves to PiFi.
+type captiveDNS struct {
+	port    int
+	mu      sync.Mutex
+	conn    net.PacketConn
+	address netip.Addr
+	// Another DNS server holds the port on busy, such as the dnsmasq NetworkManager
+	// starts for shared connections. It isn't tried again until the AP goes down.
+	busy netip.Addr
+	// A failure was reported since the AP came up, later ones aren't
+	failed bool
+}
+
+// Starts the responder on address, restarting it when the address changed. Only the
+// first failure while the AP is up is returned.
+func (d *captiveDNS) start(address netip.Addr) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil {
+		if d.address == address {
+			return nil
+		}
+		d.conn.Close()
+		d.conn = nil
+	}
+	if d.busy == address {
+		return nil
+	}
+	conn, err := net.ListenPacket("udp4", net.JoinHostPort(address.String(), strconv.Itoa(d.port)))
+	if errors.Is(err, syscall.EADDRINUSE) {
+		d.busy = address
+		return fmt.Errorf("captive DNS disabled: another DNS server, such as NetworkManager's dnsmasq, "+
+			"listens on %s port %d, see the Captive DNS section of the README", address, d.port)
+	}
+	if err != nil {
+		if d.failed {
+			return nil
+		}
+		d.failed = true
+		return fmt.Errorf("failed to start captive DNS: %v", err)
+	}
+	d.conn, d.address = conn, address
+	go serveCaptiveDNS(conn, address)
+	log.Printf("Captive DNS listening on %s", conn.LocalAddr())
+	return nil
+}
+
+// Stops the responder if it is running
+func (d *captiveDNS) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.busy, d.failed = netip.Addr{}, false
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+		log.Println("Captive DNS stopped")
+	}
+}
+
+// Configures the dnsmasq NetworkManager starts for shared connections, which would
+// hold port 53 on the AP, to leave DNS to the captive DNS responder. The drop-in is
+// removed when captive DNS is disabled. dnsmasq reads it when the AP is started.
+func configureSharedDnsmasq(settings Settings) error {
+	if settings.DnsmasqSharedDir == "" {
+		return nil
+	}
+	path := filepath.Join(settings.DnsmasqSharedDir, dnsmasqSharedConf)
+	if !settings.CaptiveDNS {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+		return nil
+	}
+	if current, err := os.ReadFile(path); err == nil && string(current) == dnsmasqCaptiveConf {
+		return nil
+	}
+	if err := os.MkdirAll(settings.DnsmasqSharedDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", settings.DnsmasqSharedDir, err)
+	}
+	if err := os.WriteFile(path, []byte(dnsmasqCaptiveConf), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	log.Printf("Wrote %s, NetworkManager's dnsmasq leaves DNS to PiFi once the AP restarts", path)
+	return nil
+}
+
+// Runs a single iteration of the captive DNS check. The responder runs while the
+// device is in AP mode, answering with the address of the wifi interface.
+func checkCaptiveDNS(b captiveBackend, runner CommandRunner, settings Settings, dns *captiveDNS) {
+	if b.currentMode() != ModeAP {
+		dns.stop()
+		return
+	}
+	address, err := netip.ParseAddr(interfaceIP(runner, settings.WifiInterface))
+	if err != nil {
+		// The AP address is not assigned yet
+		return
+	}
+	if err := dns.start(address); err != nil {
+		log.Println(err)
+	}
+}
+
+func manageCaptiveDNS(b captiveBackend, runner CommandRunner, settings Settings, sleep func(time.Duration)) error {
+	dns := &captiveDNS{port: CaptiveDNSPort}
+	for {
+		checkCaptiveDNS(b, runner, settings, dns)
+		sleep(captiveDNSInterval)
+	}
+}
+
+// Answers queries until the connection is closed
+func serveCaptiveDNS(conn net.PacketConn, address netip.Addr) {
+	buf := make([]byte, 512)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Captive DNS stopped: %v", err)
+			}
+			return
+		}
+		reply, err := captiveDNSReply(buf[:n], address)
+		if err != nil {
+			continue
+		}
+		conn.WriteTo(reply, client)
+	}
+}
+
+// Builds the reply to a DNS query. A and ANY questions are answered with address,
+// other types get an empty answer so clients fall back to IPv4. Queries that are
+// too short to echo their ID are dropped with an error.
+func captiveDNSReply(query []byte, address netip.Addr) ([]byte, error) {
+	if len(query) < dnsHeaderLen {
+		return nil, fmt.Errorf("short DNS query")
+	}
+	flags := binary.BigEndian.Uint16(query[2:])
+	if flags&dnsFlagQR != 0 {
+		return nil, fmt.Errorf("not a DNS query")
+	}
+	header := func(rcode, qdcount, ancount uint16) []byte {
+		reply := make([]byte, dnsHeaderLen, 512)
+		copy(reply, query[:2])
+		binary.BigEndian.PutUint16(reply[2:], dnsFlagQR|dnsFlagAA|flags&(dnsOpcodeMask|dnsFlagRD)|rcode)
+		binary.BigEndian.PutUint16(reply[4:], qdcount)
+		binary.BigEndian.PutUint16(reply[6:], ancount)
+		return reply
+	}
+	if flags&dnsOpcodeMask != 0 {
+		return header(dnsRcodeNotImp, 0, 0), nil
+	}
+	if binary.BigEndian.Uint16(query[4:]) != 1 {
+		return header(dnsRcodeFormat, 0, 0), nil
+	}
+
+	// The question name is a sequence of labels ending with an empty label
+	end := dnsHeaderLen
+	for end < len(query) && query[end] != 0 {
+		if query[end]&0xc0 != 0 {
+			return header(dnsRcodeFormat, 0, 0), nil
+		}
+		end += int(query[end]) + 1
+	}
+	end += 5
+	if end > len(query) {
+		return header(dnsRcodeFormat, 0, 0), nil
+	}
+	question := query[dnsHeaderLen:end]
+	qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+	qclass := binary.BigEndian.Uint16(question[len(question)-2:])
+
+	if (qtype != dnsTypeA && qtype != dnsTypeANY) || qclass != dnsClassIN || !address.Is4() {
+		return append(header(0, 1, 0), question...), nil
+	}
+	reply := append(header(0, 1, 1), question...)
+	// The answer points to the question name. A zero TTL keeps clients from
+	// caching the address after the AP goes down.
+	reply = append(reply, 0xc0, dnsHeaderLen, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, 0, 0, 4)
+	ip := address.As4()
+	return append(reply, ip[:]...), nil
+}
@@ -0,0 +1,148 @@
+package networkmanager
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A query for example.com with the given type and recursion desired
+func dnsQuery(qtype byte) []byte {
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	query = append(query, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0)
+	return append(query, 0, qtype, 0, dnsClassIN)
+}
+
+func TestCaptiveDNSReply(t *testing.T) {
+	address := netip.MustParseAddr("10.42.0.1")
+
+	reply, err := captiveDNSReply(dnsQuery(dnsTypeA), address)
+	if err != nil {
+		t.Fatalf("captiveDNSReply: %v", err)
+	}
+	header := []byte{0x12, 0x34, 0x85, 0x00, 0, 1, 0, 1, 0, 0, 0, 0}
+	if !bytes.HasPrefix(reply, header) {
+		t.Errorf("header = %x, want %x", reply[:dnsHeaderLen], header)
+	}
+	if !bytes.HasSuffix(reply, []byte{0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4, 10, 42, 0, 1}) {
+		t.Errorf("reply = %x, want an A record for 10.42.0.1", reply)
+	}
+
+	// AAAA queries get an empty answer
+	reply, err = captiveDNSReply(dnsQuery(28), address)
+	if err != nil || reply[7] != 0 || len(reply) != len(dnsQuery(28)) {
+		t.Errorf("captiveDNSReply(AAAA) = %x, %v; want no answers", reply, err)
+	}
+
+	truncated := dnsQuery(dnsTypeA)[:20]
+	if reply, err := captiveDNSReply(truncated, address); err != nil || reply[3]&0xf != dnsRcodeFormat {
+		t.Errorf("captiveDNSReply(truncated) = %x, %v; want a format error", reply, err)
+	}
+	if _, err := captiveDNSReply([]byte{0x12, 0x34}, address); err == nil {
+		t.Error("expected an error for a short query")
+	}
+}
+
+type fakeCaptiveBackend struct {
+	mode string
+}
+
+func (b *fakeCaptiveBackend) currentMode() string { return b.mode }
+
+func TestCheckCaptiveDNS(t *testing.T) {
+	runner := NewFakeRunner().
+		On("ip -4 -o addr show dev wlan0", "3: wlan0    inet 127.0.0.1/8 scope host lo\n", nil)
+	backend := &fakeCaptiveBackend{mode: ModeClient}
+	dns := &captiveDNS{}
+	defer dns.stop()
+
+	checkCaptiveDNS(backend, runner, DefaultSettings(), dns)
+	if dns.conn != nil {
+		t.Fatal("captive DNS started in client mode")
+	}
+	backend.mode = ModeAP
+	checkCaptiveDNS(backend, runner, DefaultSettings(), dns)
+	if dns.conn == nil {
+		t.Fatal("captive DNS not started in AP mode")
+	}
+
+	client, err := net.Dial("udp4", dns.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write(dnsQuery(dnsTypeA)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("no reply: %v", err)
+	}
+	if !bytes.HasSuffix(buf[:n], []byte{127, 0, 0, 1}) {
+		t.Errorf("reply = %x, want an A record for 127.0.0.1", buf[:n])
+	}
+
+	backend.mode = ModeClient
+	checkCaptiveDNS(backend, runner, DefaultSettings(), dns)
+	if dns.conn != nil {
+		t.Error("captive DNS still running after the AP went down")
+	}
+}
+
+func TestCaptiveDNSPortInUse(t *testing.T) {
+	address := netip.MustParseAddr("127.0.0.1")
+	other, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	dns := &captiveDNS{port: other.LocalAddr().(*net.UDPAddr).Port}
+	defer dns.stop()
+
+	if err := dns.start(address); err == nil {
+		t.Fatal("expected an error when the port is in use")
+	}
+	// The failure is reported once, and the port isn't tried again while the AP is up
+	other.Close()
+	if err := dns.start(address); err != nil || dns.conn != nil {
+		t.Errorf("start() = %v, conn = %v; want nothing while the AP is up", err, dns.conn)
+	}
+	dns.stop()
+	if err := dns.start(address); err != nil || dns.conn == nil {
+		t.Errorf("start() = %v after the AP went down, want the responder started", err)
+	}
+}
+
+func TestConfigureSharedDnsmasq(t *testing.T) {
+	settings := DefaultSettings()
+	settings.DnsmasqSharedDir = filepath.Join(t.TempDir(), "dnsmasq-shared.d")
+	path := filepath.Join(settings.DnsmasqSharedDir, dnsmasqSharedConf)
+
+	if err := configureSharedDnsmasq(settings); err != nil {
+		t.Fatalf("configureSharedDnsmasq: %v", err)
+	}
+	conf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading drop-in: %v", err)
+	}
+	if !bytes.HasPrefix(conf, []byte("port=0\n")) {
+		t.Errorf("drop-in = %q, want DNS disabled", conf)
+	}
+
+	settings.CaptiveDNS = false
+	if err := configureSharedDnsmasq(settings); err != nil {
+		t.Fatalf("configureSharedDnsmasq: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("drop-in kept without captive DNS: %v", err)
+	}
+	if err := configureSharedDnsmasq(settings); err != nil {
+		t.Errorf("configureSharedDnsmasq without a drop-in: %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package networkmanager
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EAP methods for enterprise networks
+const (
+	EAPPEAP = "peap"
+	EAPTTLS = "ttls"
+	EAPTLS  = "tls"
+)
+
+// Phase 2 authentication methods for PEAP and TTLS
+const (
+	Phase2MSCHAPv2 = "mschapv2"
+	Phase2GTC      = "gtc"
+	Phase2PAP      = "pap"
+)
+
+// ErrSecurityMismatch is returned when the requested security type is not
+// supported by the access point broadcasting the SSID.
+var ErrSecurityMismatch = errors.New("security type does not match the access point")
+
+// NetworkManager key-mgmt values of the pre-shared key security types
+var keyMgmt = map[string]string{
+	SecurityWPA2PSK: "wpa-psk",
+	SecurityWPA3SAE: "sae",
+}
+
+// ConnectionConfig describes a client network profile to create or modify.
+type ConnectionConfig struct {
+	SSID string
+	// Password is the pre-shared key, empty for open networks
+	Password    string
+	AutoConnect bool
+	// Security is one of SecurityOpen, SecurityWPA2PSK, SecurityWPA3SAE, SecurityOWE or
+	// SecurityEnterprise. When empty it is taken from the scan results.
+	Security string
+	// Hidden networks are probed for by SSID since they don't show up in scans
+	Hidden bool
+	// IPv4 overrides the default DHCP configuration when set
+	IPv4 *IPv4Config
+	// IPv6 overrides the default automatic configuration when set
+	IPv6 *IPv6Config
+	// Enterprise configures 802.1X authentication instead of a pre-shared key
+	Enterprise *EnterpriseConfig
+}
+
+// EnterpriseConfig holds the 802.1X settings of a profile. Certificates and keys
+// are the uploaded file contents and are written to the certificate directory.
+type EnterpriseConfig struct {
+	EAP               string
+	Identity          string
+	AnonymousIdentity string
+	Password          string
+	// Phase2 is only used with PEAP and TTLS, defaults to MSCHAPv2
+	Phase2             string
+	CACert             []byte
+	ClientCert         []byte
+	PrivateKey         []byte
+	PrivateKeyPassword string
+}
+
+// Validate checks that the settings required by the EAP method are present
+func (e *EnterpriseConfig) Validate() error {
+	if e.Identity == "" {
+		return fmt.Errorf("identity is required for enterprise networks")
+	}
+	for _, value := range []string{e.Identity, e.AnonymousIdentity, e.Password, e.PrivateKeyPassword} {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("enterprise settings must not contain line breaks")
+		}
+	}
+	switch e.EAP {
+	case EAPPEAP, EAPTTLS:
+		if e.Phase2 == "" {
+			e.Phase2 = Phase2MSCHAPv2
+		}
+		if e.Phase2 != Phase2MSCHAPv2 && !(e.EAP == EAPPEAP && e.Phase2 == Phase2GTC) && !(e.EAP == EAPTTLS && e.Phase2 == Phase2PAP) {
+			return fmt.Errorf("unsupported phase 2 authentication %s for %s", e.Phase2, e.EAP)
+		}
+	case EAPTLS:
+		if len(e.ClientCert) == 0 || len(e.PrivateKey) == 0 {
+			return fmt.Errorf("client certificate and private key are required for EAP-TLS")
+		}
+	default:
+		return fmt.Errorf("unsupported EAP method: %s", e.EAP)
+	}
+	for name, cert := range map[string][]byte{"CA certificate": e.CACert, "client certificate": e.ClientCert} {
+		if len(cert) > 0 && !validCertificate(cert) {
+			return fmt.Errorf("%s is not a PEM or DER encoded certificate", name)
+		}
+	}
+	return nil
+}
+
+// Reports whether an existing profile keeps its security settings, which is the
+// case when neither a password nor a security type is given
+func (c ConnectionConfig) keepsSecurity() bool {
+	return c.Security == "" && c.Password == "" && c.Enterprise == nil
+}
+
+// Picks the security type of a profile from the scan results when it isn't set, and checks
+// that an explicit type is supported by the access point. Networks missing from the scan,
+// such as hidden networks, fall back to WPA2-PSK when a password is set and open otherwise.
+func resolveSecurity(conn *ConnectionConfig, scan func() ([]ScanResult, error)) error {
+	if conn.Enterprise != nil {
+		if conn.Security != "" && conn.Security != SecurityEnterprise {
+			return fmt.Errorf("enterprise settings can't be used with %s security", conn.Security)
+		}
+		conn.Security = SecurityEnterprise
+	}
+	switch conn.Security {
+	case "", SecurityOpen, SecurityOWE, SecurityWPA2PSK, SecurityWPA3SAE, SecurityEnterprise:
+	default:
+		return fmt.Errorf("unsupported security type: %s", conn.Security)
+	}
+
+	var advertised string
+	var compatible bool
+	if networks, err := scan(); err == nil {
+		for _, network := range networks {
+			if network.SSID != conn.SSID {
+				continue
+			}
+			// Access points of the same SSID may differ, any one of them will do
+			advertised = network.Security
+			compatible = securityCompatible(conn.Security, network.Security)
+			for _, bss := range network.BSSIDs {
+				compatible = compatible || securityCompatible(conn.Security, bss.Security)
+			}
+			break
+		}
+	}
+
+	switch {
+	case conn.Security == "" && advertised != "":
+		conn.Security = profileSecurity(advertised)
+		if conn.Security == "" {
+			return fmt.Errorf("%s uses unsupported %s security", conn.SSID, advertised)
+		}
+	case conn.Security == "" && conn.Password != "":
+		conn.Security = SecurityWPA2PSK
+	case conn.Security == "":
+		conn.Security = SecurityOpen
+	case advertised != "" && !compatible:
+		return fmt.Errorf("%w: %s advertises %s, not %s", ErrSecurityMismatch, conn.SSID, advertised, conn.Security)
+	}
+
+	switch conn.Security {
+	case SecurityWPA2PSK, SecurityWPA3SAE:
+		if !validPSK(conn.Password) {
+			return fmt.Errorf("password for %s must be 8 to 63 printable characters or a 64 digit hex key", conn.SSID)
+		}
+	case SecurityEnterprise:
+		if conn.Enterprise == nil {
+			return fmt.Errorf("enterprise settings are required for %s", conn.SSID)
+		}
+	}
+	return nil
+}
+
+// Pre-shared keys are passphrases or 64 digit hex keys
+func validPSK(psk string) bool {
+	return hexPSK(psk) || ValidPassphrase(psk)
+}
+
+// ValidPassphrase reports whether passphrase is a WPA passphrase, 8 to 63 printable ASCII characters
+func ValidPassphrase(passphrase string) bool {
+	if len(passphrase) < 8 || len(passphrase) > 63 {
+		return false
+	}
+	for _, c := range passphrase {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether psk is a raw 256-bit key rather than a passphrase
+func hexPSK(psk string) bool {
+	if len(psk) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(psk)
+	return err == nil
+}
+
+// Returns the profile security used for an advertised security type, empty when unsupported.
+// Transition mode networks use WPA2-PSK, which works with every driver.
+func profileSecurity(advertised string) string {
+	switch advertised {
+	case SecurityOpen, SecurityOWE, SecurityWPA3SAE, SecurityEnterprise:
+		return advertised
+	case SecurityWPAPSK, SecurityWPA2PSK, SecurityWPA2WPA3:
+		return SecurityWPA2PSK
+	}
+	return ""
+}
+
+// Reports whether a profile with the given security can connect to an access point
+func securityCompatible(security, advertised string) bool {
+	switch security {
+	case SecurityWPA2PSK:
+		return advertised == SecurityWPAPSK || advertised == SecurityWPA2PSK || advertised == SecurityWPA2WPA3
+	case SecurityWPA3SAE:
+		return advertised == SecurityWPA3SAE || advertised == SecurityWPA2WPA3
+	}
+	return security == advertised
+}
+
+func validCertificate(data []byte) bool {
+	if block, _ := pem.Decode(data); block != nil {
+		return true
+	}
+	_, err := x509.ParseCertificate(data)
+	return err == nil
+}
+
+// certFiles are the paths of the certificates written for a profile, empty when not uploaded
+type certFiles struct {
+	caCert     string
+	clientCert string
+	privateKey string
+}
+
+// Writes the uploaded certificates of an enterprise profile to dir. The SSID is hex
+// encoded in the file names so any SSID maps to a safe path.
+func writeCertificates(dir, ssid string, e *EnterpriseConfig) (certFiles, error) {
+	var files certFiles
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return files, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	for _, cert := range []struct {
+		data []byte
+		name string
+		path *string
+	}{
+		{e.CACert, "ca.pem", &files.caCert},
+		{e.ClientCert, "client.pem", &files.clientCert},
+		{e.PrivateKey, "key.pem", &files.privateKey},
+	} {
+		if len(cert.data) == 0 {
+			continue
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%x-%s", ssid, cert.name))
+		if err := os.WriteFile(path, cert.data, 0o600); err != nil {
+			return files, fmt.Errorf("failed to write %s: %v", cert.name, err)
+		}
+		*cert.path = path
+	}
+	return files, nil
+}
@@ -0,0 +1,111 @@
+package networkmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCert = "-----BEGIN CERTIFICATE-----\nMIIBszCCAVmgAwIBAgIU\n-----END CERTIFICATE-----\n"
+
+func TestEnterpriseConfigValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config EnterpriseConfig
+		valid  bool
+	}{
+		"peap":              {EnterpriseConfig{EAP: EAPPEAP, Identity: "alice", Password: "pw"}, true},
+		"peap gtc":          {EnterpriseConfig{EAP: EAPPEAP, Identity: "alice", Phase2: Phase2GTC}, true},
+		"ttls pap":          {EnterpriseConfig{EAP: EAPTTLS, Identity: "alice", Phase2: Phase2PAP}, true},
+		"peap pap":          {EnterpriseConfig{EAP: EAPPEAP, Identity: "alice", Phase2: Phase2PAP}, false},
+		"tls":               {EnterpriseConfig{EAP: EAPTLS, Identity: "alice", ClientCert: []byte(testCert), PrivateKey: []byte("key")}, true},
+		"tls without key":   {EnterpriseConfig{EAP: EAPTLS, Identity: "alice", ClientCert: []byte(testCert)}, false},
+		"missing identity":  {EnterpriseConfig{EAP: EAPPEAP}, false},
+		"unsupported eap":   {EnterpriseConfig{EAP: "leap", Identity: "alice"}, false},
+		"invalid ca cert":   {EnterpriseConfig{EAP: EAPPEAP, Identity: "alice", CACert: []byte("not a cert")}, false},
+		"newline in secret": {EnterpriseConfig{EAP: EAPPEAP, Identity: "alice", Password: "pw\nEAP-Method=TLS"}, false},
+	} {
+		if err := tc.config.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: Validate() = %v, want valid=%v", name, err, tc.valid)
+		}
+	}
+
+	e := EnterpriseConfig{EAP: EAPPEAP, Identity: "alice"}
+	if err := e.Validate(); err != nil || e.Phase2 != Phase2MSCHAPv2 {
+		t.Errorf("Validate() = %v, phase 2 = %q; want MSCHAPv2 default", err, e.Phase2)
+	}
+}
+
+func TestWriteCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certs, err := writeCertificates(dir, "../Office", &EnterpriseConfig{CACert: []byte(testCert)})
+	if err != nil {
+		t.Fatalf("writeCertificates: %v", err)
+	}
+	if certs.clientCert != "" || certs.privateKey != "" {
+		t.Errorf("certs = %+v, want only the CA certificate", certs)
+	}
+	if filepath.Dir(certs.caCert) != dir || strings.Contains(filepath.Base(certs.caCert), "..") {
+		t.Errorf("CA certificate written to %s, want a file in %s", certs.caCert, dir)
+	}
+	if data, err := os.ReadFile(certs.caCert); err != nil || string(data) != testCert {
+		t.Errorf("CA certificate = %q, %v", data, err)
+	}
+}
+
+func TestResolveSecurity(t *testing.T) {
+	scan := func() ([]ScanResult, error) {
+		return []ScanResult{
+			{SSID: "Home", Security: SecurityWPA2PSK, BSSIDs: []BSS{{Security: SecurityWPA2PSK}, {Security: SecurityWPA2WPA3}}},
+			{SSID: "Modern", Security: SecurityWPA3SAE},
+			{SSID: "Cafe", Security: SecurityOpen},
+			{SSID: "Airport", Security: SecurityOWE},
+			{SSID: "Legacy", Security: SecurityWEP},
+		}, nil
+	}
+	for name, tc := range map[string]struct {
+		conn ConnectionConfig
+		want string
+	}{
+		"from scan":            {ConnectionConfig{SSID: "Modern", Password: "hunter22"}, SecurityWPA3SAE},
+		"longest passphrase":   {ConnectionConfig{SSID: "Home", Password: strings.Repeat("x", 63)}, SecurityWPA2PSK},
+		"hex key":              {ConnectionConfig{SSID: "Home", Password: strings.Repeat("0f", 32)}, SecurityWPA2PSK},
+		"open from scan":       {ConnectionConfig{SSID: "Cafe"}, SecurityOpen},
+		"owe from scan":        {ConnectionConfig{SSID: "Airport"}, SecurityOWE},
+		"transition bss":       {ConnectionConfig{SSID: "Home", Password: "hunter22", Security: SecurityWPA3SAE}, SecurityWPA3SAE},
+		"not scanned psk":      {ConnectionConfig{SSID: "Hidden", Password: "hunter22"}, SecurityWPA2PSK},
+		"not scanned open":     {ConnectionConfig{SSID: "Hidden"}, SecurityOpen},
+		"not scanned explicit": {ConnectionConfig{SSID: "Hidden", Security: SecurityOWE}, SecurityOWE},
+		"enterprise":           {ConnectionConfig{SSID: "Hidden", Enterprise: &EnterpriseConfig{}}, SecurityEnterprise},
+	} {
+		conn := tc.conn
+		if err := resolveSecurity(&conn, scan); err != nil || conn.Security != tc.want {
+			t.Errorf("%s: resolveSecurity() = %q, %v; want %q", name, conn.Security, err, tc.want)
+		}
+	}
+
+	for name, conn := range map[string]ConnectionConfig{
+		"sae on wpa2":       {SSID: "Modern", Password: "hunter22", Security: SecurityWPA2PSK},
+		"owe on open":       {SSID: "Cafe", Security: SecurityOWE},
+		"psk on open":       {SSID: "Cafe", Password: "hunter22", Security: SecurityWPA2PSK},
+		"wep":               {SSID: "Legacy", Password: "hunter22"},
+		"short password":    {SSID: "Modern", Password: "short"},
+		"64 characters":     {SSID: "Home", Password: strings.Repeat("x", 64)},
+		"65 hex digits":     {SSID: "Home", Password: strings.Repeat("0", 65)},
+		"newline":           {SSID: "Home", Password: "hunter22\nkey_mgmt=NONE"},
+		"control character": {SSID: "Home", Password: "hunter22\x00"},
+		"non-ascii":         {SSID: "Home", Password: "hunter22é"},
+		"unknown type":      {SSID: "Cafe", Security: "wpa4"},
+		"enterprise as psk": {SSID: "Hidden", Security: SecurityWPA2PSK, Enterprise: &EnterpriseConfig{}},
+	} {
+		if err := resolveSecurity(&conn, scan); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	conn := ConnectionConfig{SSID: "Modern", Password: "hunter22", Security: SecurityWPA2PSK}
+	if err := resolveSecurity(&conn, scan); !errors.Is(err, ErrSecurityMismatch) {
+		t.Errorf("resolveSecurity() = %v, want ErrSecurityMismatch", err)
+	}
+}
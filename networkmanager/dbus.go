@@ -0,0 +1,1022 @@
+package networkmanager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	nmBusName        = "org.freedesktop.NetworkManager"
+	nmPath           = dbus.ObjectPath("/org/freedesktop/NetworkManager")
+	nmSettingsPath   = dbus.ObjectPath("/org/freedesktop/NetworkManager/Settings")
+	nmIface          = "org.freedesktop.NetworkManager"
+	nmSettingsIface  = nmIface + ".Settings"
+	nmConnIface      = nmIface + ".Settings.Connection"
+	nmDeviceIface    = nmIface + ".Device"
+	nmWirelessIface  = nmIface + ".Device.Wireless"
+	nmAPIface        = nmIface + ".AccessPoint"
+	nmActiveIface    = nmIface + ".Connection.Active"
+	nmIP4ConfigIface = nmIface + ".IP4Config"
+
+	wirelessType = "802-11-wireless"
+	ethernetType = "802-3-ethernet"
+)
+
+// Access point flags from NM80211ApFlags and NM80211ApSecurityFlags
+const (
+	apFlagPrivacy         = 0x1
+	apSecKeyMgmtPSK       = 0x100
+	apSecKeyMgmt8021X     = 0x200
+	apSecKeyMgmtSAE       = 0x400
+	apSecKeyMgmtOWE       = 0x800
+	apSecKeyMgmtOWETM     = 0x1000
+	apSecKeyMgmtEAPSuiteB = 0x2000
+)
+
+// Returns the security type advertised by an access point
+func apSecurity(flags, wpaFlags, rsnFlags uint32) string {
+	switch {
+	case rsnFlags&(apSecKeyMgmt8021X|apSecKeyMgmtEAPSuiteB) != 0 || wpaFlags&apSecKeyMgmt8021X != 0:
+		return SecurityEnterprise
+	case rsnFlags&apSecKeyMgmtSAE != 0 && rsnFlags&apSecKeyMgmtPSK != 0:
+		return SecurityWPA2WPA3
+	case rsnFlags&apSecKeyMgmtSAE != 0:
+		return SecurityWPA3SAE
+	case rsnFlags&apSecKeyMgmtPSK != 0:
+		return SecurityWPA2PSK
+	case wpaFlags&apSecKeyMgmtPSK != 0:
+		return SecurityWPAPSK
+	case rsnFlags&(apSecKeyMgmtOWE|apSecKeyMgmtOWETM) != 0:
+		return SecurityOWE
+	case flags&apFlagPrivacy != 0:
+		return SecurityWEP
+	}
+	return SecurityOpen
+}
+
+// NMState mirrors the NMState enum reported by NetworkManager.
+type NMState uint32
+
+const (
+	NMStateUnknown         NMState = 0
+	NMStateAsleep          NMState = 10
+	NMStateDisconnected    NMState = 20
+	NMStateDisconnecting   NMState = 30
+	NMStateConnecting      NMState = 40
+	NMStateConnectedLocal  NMState = 50
+	NMStateConnectedSite   NMState = 60
+	NMStateConnectedGlobal NMState = 70
+)
+
+// String returns the state in the same format nmcli reports it.
+func (s NMState) String() string {
+	switch s {
+	case NMStateAsleep:
+		return "Asleep"
+	case NMStateDisconnected:
+		return "Disconnected"
+	case NMStateDisconnecting:
+		return "Disconnecting"
+	case NMStateConnecting:
+		return "Connecting"
+	case NMStateConnectedLocal:
+		return "Connected (Local Only)"
+	case NMStateConnectedSite:
+		return "Connected (Site Only)"
+	case NMStateConnectedGlobal:
+		return "Connected"
+	}
+	return "Unknown"
+}
+
+// NMConnectivity mirrors the NMConnectivityState enum reported by NetworkManager.
+type NMConnectivity uint32
+
+const (
+	NMConnectivityUnknown NMConnectivity = 0
+	NMConnectivityNone    NMConnectivity = 1
+	NMConnectivityPortal  NMConnectivity = 2
+	NMConnectivityLimited NMConnectivity = 3
+	NMConnectivityFull    NMConnectivity = 4
+)
+
+func (c NMConnectivity) String() string {
+	switch c {
+	case NMConnectivityNone:
+		return "None"
+	case NMConnectivityPortal:
+		return "Portal"
+	case NMConnectivityLimited:
+		return "Limited"
+	case NMConnectivityFull:
+		return "Full"
+	}
+	return "Unknown"
+}
+
+// DeviceState mirrors the NMDeviceState enum reported by NetworkManager.
+type DeviceState uint32
+
+const (
+	DeviceStateUnknown      DeviceState = 0
+	DeviceStateUnmanaged    DeviceState = 10
+	DeviceStateUnavailable  DeviceState = 20
+	DeviceStateDisconnected DeviceState = 30
+	DeviceStatePrepare      DeviceState = 40
+	DeviceStateConfig       DeviceState = 50
+	DeviceStateNeedAuth     DeviceState = 60
+	DeviceStateIPConfig     DeviceState = 70
+	DeviceStateIPCheck      DeviceState = 80
+	DeviceStateSecondaries  DeviceState = 90
+	DeviceStateActivated    DeviceState = 100
+	DeviceStateDeactivating DeviceState = 110
+	DeviceStateFailed       DeviceState = 120
+)
+
+func (s DeviceState) String() string {
+	switch s {
+	case DeviceStateUnmanaged:
+		return "unmanaged"
+	case DeviceStateUnavailable:
+		return "unavailable"
+	case DeviceStateDisconnected:
+		return "disconnected"
+	case DeviceStatePrepare, DeviceStateConfig, DeviceStateNeedAuth,
+		DeviceStateIPConfig, DeviceStateIPCheck, DeviceStateSecondaries:
+		return "connecting"
+	case DeviceStateActivated:
+		return "connected"
+	case DeviceStateDeactivating:
+		return "deactivating"
+	case DeviceStateFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// ConnectionSettings is the a{sa{sv}} settings dictionary NetworkManager uses for connection profiles.
+type ConnectionSettings map[string]map[string]dbus.Variant
+
+// ID returns the connection.id of the profile.
+func (s ConnectionSettings) ID() string {
+	return s.stringValue("connection", "id")
+}
+
+// Type returns the connection.type of the profile.
+func (s ConnectionSettings) Type() string {
+	return s.stringValue("connection", "type")
+}
+
+func (s ConnectionSettings) stringValue(setting, key string) string {
+	var value string
+	if v, ok := s[setting][key]; ok {
+		v.Store(&value)
+	}
+	return value
+}
+
+func (s ConnectionSettings) set(setting, key string, value interface{}) {
+	if s[setting] == nil {
+		s[setting] = make(map[string]dbus.Variant)
+	}
+	s[setting][key] = dbus.MakeVariant(value)
+}
+
+type dbusManager struct {
+	conn     *dbus.Conn
+	status   NetworkStatus
+	settings Settings
+	runner   CommandRunner
+	sleep    func(time.Duration)
+}
+
+// NewDBus returns a NetworkManager that talks to org.freedesktop.NetworkManager over the given bus.
+// The runner is only used for connectivity checks (ping); a nil runner executes commands on the host.
+func NewDBus(conn *dbus.Conn, settings Settings, runner CommandRunner) NetworkManager {
+	if runner == nil {
+		runner = ExecRunner{}
+	}
+	nm := &dbusManager{
+		conn: conn,
+		status: NetworkStatus{
+			APSSID: settings.apSSID(),
+		},
+		settings: settings,
+		runner:   runner,
+		sleep:    time.Sleep,
+	}
+	nm.GetNetworkStatus()
+	return nm
+}
+
+func (nm *dbusManager) object(path dbus.ObjectPath) dbus.BusObject {
+	return nm.conn.Object(nmBusName, path)
+}
+
+func (nm *dbusManager) property(path dbus.ObjectPath, name string, dest interface{}) error {
+	v, err := nm.object(path).GetProperty(name)
+	if err != nil {
+		return err
+	}
+	return v.Store(dest)
+}
+
+func (nm *dbusManager) GetNetworkStatus() (NetworkStatus, error) {
+	var state, connectivity uint32
+	var wifiHW, wifi bool
+	if err := nm.property(nmPath, nmIface+".State", &state); err != nil {
+		return nm.status, fmt.Errorf("failed to read NetworkManager state: %v", err)
+	}
+	if err := nm.property(nmPath, nmIface+".Connectivity", &connectivity); err != nil {
+		return nm.status, fmt.Errorf("failed to read connectivity: %v", err)
+	}
+	if err := nm.property(nmPath, nmIface+".WirelessHardwareEnabled", &wifiHW); err != nil {
+		return nm.status, fmt.Errorf("failed to read wireless hardware state: %v", err)
+	}
+	if err := nm.property(nmPath, nmIface+".WirelessEnabled", &wifi); err != nil {
+		return nm.status, fmt.Errorf("failed to read wireless state: %v", err)
+	}
+
+	networkStatus := NetworkStatus{
+		APSSID:       nm.status.APSSID,
+		State:        NMState(state).String(),
+		Connectivity: NMConnectivity(connectivity).String(),
+		WifiHW:       enabledString(wifiHW),
+		Wifi:         enabledString(wifi),
+		Mode:         nm.currentMode(),
+	}
+	networkStatus.WifiSSID, networkStatus.SignalStr = nm.activeAccessPoint()
+	networkStatus.IPs = nm.getNetworkIps()
+
+	nm.status = networkStatus
+	return networkStatus, nil
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "Enabled"
+	}
+	return "Disabled"
+}
+
+// Returns the SSID and signal strength of the access point the wifi interface is associated with
+func (nm *dbusManager) activeAccessPoint() (string, int32) {
+	device, err := nm.device(nm.settings.WifiInterface)
+	if err != nil {
+		return "", -1
+	}
+	var apPath dbus.ObjectPath
+	if err := nm.property(device, nmWirelessIface+".ActiveAccessPoint", &apPath); err != nil || apPath == "/" {
+		return "", -1
+	}
+	var ssid []byte
+	var strength byte
+	if err := nm.property(apPath, nmAPIface+".Ssid", &ssid); err != nil {
+		return "", -1
+	}
+	if err := nm.property(apPath, nmAPIface+".Strength", &strength); err != nil {
+		return string(ssid), -1
+	}
+	return string(ssid), int32(strength)
+}
+
+func (nm *dbusManager) device(iface string) (dbus.ObjectPath, error) {
+	var path dbus.ObjectPath
+	err := nm.object(nmPath).Call(nmIface+".GetDeviceByIpIface", 0, iface).Store(&path)
+	if err != nil {
+		return "", fmt.Errorf("failed to find device %s: %v", iface, err)
+	}
+	return path, nil
+}
+
+func (nm *dbusManager) deviceState(iface string) DeviceState {
+	device, err := nm.device(iface)
+	if err != nil {
+		return DeviceStateUnknown
+	}
+	var state uint32
+	if err := nm.property(device, nmDeviceIface+".State", &state); err != nil {
+		return DeviceStateUnknown
+	}
+	return DeviceState(state)
+}
+
+// Returns the first IPv4 address of the interface, or an empty string
+func (nm *dbusManager) deviceIP(iface string) string {
+	device, err := nm.device(iface)
+	if err != nil {
+		return ""
+	}
+	var configPath dbus.ObjectPath
+	if err := nm.property(device, nmDeviceIface+".Ip4Config", &configPath); err != nil || configPath == "/" {
+		return ""
+	}
+	var addresses []map[string]dbus.Variant
+	if err := nm.property(configPath, nmIP4ConfigIface+".AddressData", &addresses); err != nil {
+		return ""
+	}
+	for _, address := range addresses {
+		var ip string
+		if v, ok := address["address"]; ok && v.Store(&ip) == nil && ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+func (nm *dbusManager) getNetworkIps() NetworkIPs {
+	status := NetworkIPs{
+		WifiState: "offline",
+		EthState:  "offline",
+	}
+	if ip := nm.deviceIP(nm.settings.WifiInterface); ip != "" {
+		status.WifiIP = ip
+		status.WifiState = "online"
+		status.WifiIPv4Method = nm.activeMethod(wirelessType, "ipv4")
+	}
+	if ip := nm.deviceIP(nm.settings.EthernetInterface); ip != "" {
+		status.EthernetIP = ip
+		status.EthState = "online"
+		status.EthIPv4Method = nm.activeMethod(ethernetType, "ipv4")
+	}
+
+	addIPv6Status(nm.runner, nm.settings, &status)
+	if status.WifiState == "online" || len(status.WifiIPv6) > 0 {
+		status.WifiIPv6Method = nm.activeMethod(wirelessType, "ipv6")
+	}
+	if status.EthState == "online" || len(status.EthIPv6) > 0 {
+		status.EthIPv6Method = nm.activeMethod(ethernetType, "ipv6")
+	}
+	return status
+}
+
+// Returns the method of the ipv4 or ipv6 setting of the first active connection of the given type
+func (nm *dbusManager) activeMethod(typ, setting string) string {
+	active, err := nm.activeConnections()
+	if err != nil {
+		return ""
+	}
+	for _, conn := range active {
+		if conn.typ != typ {
+			continue
+		}
+		if _, settings, err := nm.findConnection(conn.id); err == nil {
+			return ipMethod(settings.stringValue(setting, "method"))
+		}
+	}
+	return ""
+}
+
+type activeConnection struct {
+	path dbus.ObjectPath
+	id   string
+	typ  string
+}
+
+func (nm *dbusManager) activeConnections() ([]activeConnection, error) {
+	var paths []dbus.ObjectPath
+	if err := nm.property(nmPath, nmIface+".ActiveConnections", &paths); err != nil {
+		return nil, fmt.Errorf("failed to get active connections: %v", err)
+	}
+	active := make([]activeConnection, 0, len(paths))
+	for _, path := range paths {
+		conn := activeConnection{path: path}
+		if err := nm.property(path, nmActiveIface+".Id", &conn.id); err != nil {
+			continue
+		}
+		nm.property(path, nmActiveIface+".Type", &conn.typ)
+		active = append(active, conn)
+	}
+	return active, nil
+}
+
+// Reports whether the AP and a wireless client connection are active
+func (nm *dbusManager) activeModes() (hasAP, hasClient bool, err error) {
+	active, err := nm.activeConnections()
+	if err != nil {
+		return false, false, err
+	}
+	for _, conn := range active {
+		if conn.id == nm.status.APSSID {
+			hasAP = true
+		}
+		if conn.typ == wirelessType {
+			hasClient = true
+		}
+	}
+	return hasAP, hasClient, nil
+}
+
+func (nm *dbusManager) currentMode() string {
+	hasAP, hasClient, err := nm.activeModes()
+	if err != nil {
+		return "unknown"
+	}
+	if hasAP {
+		return ModeAP
+	} else if hasClient {
+		return ModeClient
+	}
+	return "inactive"
+}
+
+// Switches between client and AP modes
+func (nm *dbusManager) SetWifiMode(mode string) error {
+	hasAP, hasClient, err := nm.activeModes()
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case ModeAP:
+		if !hasClient {
+			return fmt.Errorf("must have active client connection for ap mode")
+		}
+		if !hasAP {
+			if err := nm.activate(nm.status.APSSID, nm.settings.WifiInterface); err != nil {
+				return fmt.Errorf("failed to create AP connection: %v", err)
+			}
+			nm.sleep(time.Second)
+			if nm.currentMode() != ModeAP {
+				return fmt.Errorf("mode change verification failed")
+			}
+		}
+	case ModeClient:
+		if hasAP {
+			if err := nm.deactivate(nm.status.APSSID); err != nil {
+				return fmt.Errorf("failed to disable AP mode: %v", err)
+			}
+		}
+		if !hasClient {
+			return fmt.Errorf("no active client connection")
+		}
+		nm.sleep(time.Second)
+		newMode := nm.currentMode()
+		if newMode != "inactive" && newMode != ModeClient {
+			return fmt.Errorf("mode change verification failed")
+		}
+	default:
+		return fmt.Errorf("unsupported mode: %s", mode)
+	}
+	return nil
+}
+
+type savedConnection struct {
+	path     dbus.ObjectPath
+	settings ConnectionSettings
+}
+
+func (nm *dbusManager) listConnections() ([]savedConnection, error) {
+	var paths []dbus.ObjectPath
+	if err := nm.object(nmSettingsPath).Call(nmSettingsIface+".ListConnections", 0).Store(&paths); err != nil {
+		return nil, fmt.Errorf("failed to list connections: %v", err)
+	}
+	connections := make([]savedConnection, 0, len(paths))
+	for _, path := range paths {
+		var settings ConnectionSettings
+		if err := nm.object(path).Call(nmConnIface+".GetSettings", 0).Store(&settings); err != nil {
+			continue
+		}
+		connections = append(connections, savedConnection{path: path, settings: settings})
+	}
+	return connections, nil
+}
+
+// Looks up a saved connection profile by its connection.id
+func (nm *dbusManager) findConnection(id string) (dbus.ObjectPath, ConnectionSettings, error) {
+	connections, err := nm.listConnections()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, conn := range connections {
+		if conn.settings.ID() == id {
+			return conn.path, conn.settings, nil
+		}
+	}
+	return "", nil, fmt.Errorf("connection %s not found", id)
+}
+
+// Returns the saved Ethernet profile bound to the Ethernet interface, or to any interface
+func (nm *dbusManager) ethernetConnection() (dbus.ObjectPath, ConnectionSettings, error) {
+	connections, err := nm.listConnections()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, conn := range connections {
+		iface := conn.settings.stringValue("connection", "interface-name")
+		if conn.settings.Type() == ethernetType && (iface == "" || iface == nm.settings.EthernetInterface) {
+			return conn.path, conn.settings, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no connection found for %s", nm.settings.EthernetInterface)
+}
+
+func (nm *dbusManager) addConnection(settings ConnectionSettings) error {
+	var path dbus.ObjectPath
+	if err := nm.object(nmSettingsPath).Call(nmSettingsIface+".AddConnection", 0, settings).Store(&path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Writes settings back to a saved profile. Secrets are not returned by GetSettings,
+// so they are merged in before the update to avoid wiping them.
+func (nm *dbusManager) updateConnection(path dbus.ObjectPath, settings ConnectionSettings) error {
+	// Secrets aren't part of GetSettings, keep the stored ones unless they are replaced
+	for _, setting := range []string{"802-11-wireless-security", "802-1x"} {
+		if _, ok := settings[setting]; !ok {
+			continue
+		}
+		var secrets ConnectionSettings
+		err := nm.object(path).Call(nmConnIface+".GetSecrets", 0, setting).Store(&secrets)
+		if err == nil {
+			for key, value := range secrets[setting] {
+				if _, set := settings[setting][key]; !set {
+					settings[setting][key] = value
+				}
+			}
+		}
+	}
+	// Deprecated address fields conflict with address-data on update
+	for _, setting := range []string{"ipv4", "ipv6"} {
+		delete(settings[setting], "addresses")
+		delete(settings[setting], "routes")
+	}
+	return nm.object(path).Call(nmConnIface+".Update", 0, settings).Err
+}
+
+func (nm *dbusManager) activate(id, iface string) error {
+	path, _, err := nm.findConnection(id)
+	if err != nil {
+		return err
+	}
+	device := dbus.ObjectPath("/")
+	if iface != "" {
+		if device, err = nm.device(iface); err != nil {
+			return err
+		}
+	}
+	var active dbus.ObjectPath
+	return nm.object(nmPath).Call(nmIface+".ActivateConnection", 0, path, device, dbus.ObjectPath("/")).Store(&active)
+}
+
+func (nm *dbusManager) deactivate(id string) error {
+	active, err := nm.activeConnections()
+	if err != nil {
+		return err
+	}
+	for _, conn := range active {
+		if conn.id == id {
+			return nm.object(nmPath).Call(nmIface+".DeactivateConnection", 0, conn.path).Err
+		}
+	}
+	return fmt.Errorf("connection %s is not active", id)
+}
+
+// Creates the AP connection for the wifi interface, or updates it when the SSID or passphrase changed
+func (nm *dbusManager) SetupAPConnection() error {
+	// Remove AP profiles left behind by older versions, Optistok-AP-*
+	connections, err := nm.listConnections()
+	if err == nil {
+		for _, conn := range connections {
+			id := conn.settings.ID()
+			if strings.HasPrefix(id, legacyAPPrefix) && id != nm.status.APSSID {
+				if err := nm.object(conn.path).Call(nmConnIface+".Delete", 0).Err; err != nil {
+					return fmt.Errorf("failed to delete connection %s: %v", id, err)
+				}
+			}
+		}
+	}
+	if err := configureSharedDnsmasq(nm.settings); err != nil {
+		log.Println(err)
+	}
+
+	settings := ConnectionSettings{}
+	settings.set("connection", "id", nm.status.APSSID)
+	settings.set("connection", "type", wirelessType)
+	settings.set("connection", "interface-name", nm.settings.WifiInterface)
+	settings.set("connection", "autoconnect", false)
+	settings.set(wirelessType, "ssid", []byte(nm.status.APSSID))
+	settings.set(wirelessType, "mode", "ap")
+	settings.set(wirelessType, "band", "bg")
+	settings.set("ipv4", "method", "shared")
+	settings.set("ipv6", "method", "disabled")
+	switch {
+	case nm.settings.APPassphrase == "":
+	case nm.settings.APSecurity == APSecurityWPA3:
+		settings.set("802-11-wireless-security", "key-mgmt", "sae")
+		settings.set("802-11-wireless-security", "psk", nm.settings.APPassphrase)
+	default:
+		settings.set("802-11-wireless-security", "key-mgmt", "wpa-psk")
+		settings.set("802-11-wireless-security", "proto", []string{"rsn"})
+		settings.set("802-11-wireless-security", "pairwise", []string{"ccmp"})
+		settings.set("802-11-wireless-security", "group", []string{"ccmp"})
+		settings.set("802-11-wireless-security", "psk", nm.settings.APPassphrase)
+	}
+
+	// Update replaces all settings, so an existing profile keeps its UUID and loses a removed passphrase
+	if path, existing, err := nm.findConnection(nm.status.APSSID); err == nil {
+		if uuid := existing.stringValue("connection", "uuid"); uuid != "" {
+			settings.set("connection", "uuid", uuid)
+		}
+		if err := nm.object(path).Call(nmConnIface+".Update", 0, settings).Err; err != nil {
+			return fmt.Errorf("failed to update AP connection: %v", err)
+		}
+		return nil
+	}
+
+	if err := nm.addConnection(settings); err != nil {
+		return fmt.Errorf("failed to create AP connection: %v", err)
+	}
+
+	if _, _, err := nm.findConnection(nm.status.APSSID); err != nil {
+		return fmt.Errorf("AP connection verification failed: %v", err)
+	}
+	return nil
+}
+
+// Scan for available networks, grouped by SSID
+func (nm *dbusManager) FindAvailableNetworks() ([]ScanResult, error) {
+	device, err := nm.device(nm.settings.WifiInterface)
+	if err != nil {
+		return nil, err
+	}
+	options := map[string]dbus.Variant{}
+	if err := nm.object(device).Call(nmWirelessIface+".RequestScan", 0, options).Err; err != nil {
+		return nil, fmt.Errorf("failed to initiate network scan: %v", err)
+	}
+	nm.sleep(2 * time.Second)
+	return nm.scanResults()
+}
+
+// Returns the networks found by the last scan without rescanning
+func (nm *dbusManager) scanResults() ([]ScanResult, error) {
+	device, err := nm.device(nm.settings.WifiInterface)
+	if err != nil {
+		return nil, err
+	}
+	var accessPoints []dbus.ObjectPath
+	if err := nm.object(device).Call(nmWirelessIface+".GetAllAccessPoints", 0).Store(&accessPoints); err != nil {
+		return nil, fmt.Errorf("failed to list available networks: %v", err)
+	}
+	var active dbus.ObjectPath
+	nm.property(device, nmWirelessIface+".ActiveAccessPoint", &active)
+
+	scanned := make([]scannedBSS, 0, len(accessPoints))
+	for _, ap := range accessPoints {
+		var props map[string]dbus.Variant
+		if err := nm.object(ap).Call("org.freedesktop.DBus.Properties.GetAll", 0, nmAPIface).Store(&props); err != nil {
+			continue
+		}
+		ssid, _ := props["Ssid"].Value().([]byte)
+		bssid, _ := props["HwAddress"].Value().(string)
+		strength, _ := props["Strength"].Value().(byte)
+		freq, _ := props["Frequency"].Value().(uint32)
+		flags, _ := props["Flags"].Value().(uint32)
+		wpaFlags, _ := props["WpaFlags"].Value().(uint32)
+		rsnFlags, _ := props["RsnFlags"].Value().(uint32)
+		scanned = append(scanned, scannedBSS{
+			ssid: strings.TrimSpace(string(ssid)),
+			BSS:  newBSS(bssid, int32(strength), freq, apSecurity(flags, wpaFlags, rsnFlags), ap == active),
+		})
+	}
+	return groupScanResults(scanned), nil
+}
+
+// Get a list of configured connections
+func (nm *dbusManager) GetConfiguredConnections() ([]ConnectionInfo, error) {
+	connections, err := nm.listConnections()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list configured connections: %v", err)
+	}
+
+	infos := make([]ConnectionInfo, 0)
+	for _, conn := range connections {
+		if conn.settings.Type() != wirelessType {
+			continue
+		}
+		var secrets ConnectionSettings
+		nm.object(conn.path).Call(nmConnIface+".GetSecrets", 0, "802-11-wireless-security").Store(&secrets)
+		infos = append(infos, ConnectionInfo{
+			SSID:     conn.settings.ID(),
+			Password: secrets.stringValue("802-11-wireless-security", "psk"),
+		})
+	}
+	return infos, nil
+}
+
+// Modify a connection if it exists, otherwise create a new one
+func (nm *dbusManager) ModifyNetworkConnection(conn ConnectionConfig) error {
+	if conn.IPv4 != nil {
+		if err := conn.IPv4.Validate(); err != nil {
+			return err
+		}
+	}
+	if conn.IPv6 != nil {
+		if err := conn.IPv6.Validate(); err != nil {
+			return err
+		}
+	}
+	path, settings, err := nm.findConnection(conn.SSID)
+	exists := err == nil
+	keep := exists && conn.keepsSecurity()
+	if !keep {
+		if err := resolveSecurity(&conn, nm.scanResults); err != nil {
+			return err
+		}
+	}
+	if exists {
+		if !keep {
+			if err := nm.setSecurity(settings, conn); err != nil {
+				return err
+			}
+		}
+		settings.set("connection", "autoconnect", conn.AutoConnect)
+		settings.set(wirelessType, "hidden", conn.Hidden)
+		if conn.IPv4 != nil {
+			setIPv4(settings, *conn.IPv4)
+		}
+		if conn.IPv6 != nil {
+			setIPv6(settings, *conn.IPv6)
+		}
+		if err := nm.updateConnection(path, settings); err != nil {
+			return fmt.Errorf("failed to modify connection: %v", err)
+		}
+		return nil
+	}
+
+	settings = ConnectionSettings{}
+	settings.set("connection", "id", conn.SSID)
+	settings.set("connection", "type", wirelessType)
+	settings.set("connection", "interface-name", nm.settings.WifiInterface)
+	settings.set("connection", "autoconnect", conn.AutoConnect)
+	settings.set(wirelessType, "ssid", []byte(conn.SSID))
+	settings.set(wirelessType, "hidden", conn.Hidden)
+	if conn.IPv4 != nil {
+		setIPv4(settings, *conn.IPv4)
+	}
+	if conn.IPv6 != nil {
+		setIPv6(settings, *conn.IPv6)
+	}
+	if err := nm.setSecurity(settings, conn); err != nil {
+		return err
+	}
+	if err := nm.addConnection(settings); err != nil {
+		return fmt.Errorf("failed to create connection: %v", err)
+	}
+	return nil
+}
+
+// Set the IPv4 configuration of a saved connection. An active connection
+// is reapplied so the change takes effect immediately.
+func (nm *dbusManager) SetIPv4Config(ssid string, config IPv4Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	return nm.updateIPConfig(ssid, "IPv4", func(settings ConnectionSettings) {
+		setIPv4(settings, config)
+	})
+}
+
+// Set the IPv6 configuration of a saved connection
+func (nm *dbusManager) SetIPv6Config(ssid string, config IPv6Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	return nm.updateIPConfig(ssid, "IPv6", func(settings ConnectionSettings) {
+		setIPv6(settings, config)
+	})
+}
+
+// Updates the IP settings of the connection of an SSID, or of the Ethernet
+// connection, and reapplies them when the connection is active
+func (nm *dbusManager) updateIPConfig(ssid, family string, update func(ConnectionSettings)) error {
+	iface := nm.settings.WifiInterface
+	var path dbus.ObjectPath
+	var settings ConnectionSettings
+	var err error
+	if ssid == "" {
+		iface = nm.settings.EthernetInterface
+		path, settings, err = nm.ethernetConnection()
+	} else {
+		path, settings, err = nm.findConnection(ssid)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set %s configuration: %v", family, err)
+	}
+
+	update(settings)
+	if err := nm.updateConnection(path, settings); err != nil {
+		return fmt.Errorf("failed to set %s configuration: %v", family, err)
+	}
+	active, _ := nm.activeConnections()
+	for _, conn := range active {
+		if conn.id != settings.ID() {
+			continue
+		}
+		device, err := nm.device(iface)
+		if err != nil {
+			return fmt.Errorf("failed to apply %s configuration: %v", family, err)
+		}
+		// Empty settings reapply the saved profile
+		err = nm.object(device).Call(nmDeviceIface+".Reapply", 0, map[string]map[string]dbus.Variant{}, uint64(0), uint32(0)).Err
+		if err != nil {
+			return fmt.Errorf("failed to apply %s configuration: %v", family, err)
+		}
+	}
+	return nil
+}
+
+// Replaces the ipv4 setting of a profile. DNS servers are passed as
+// integers in network byte order.
+func setIPv4(settings ConnectionSettings, config IPv4Config) {
+	for _, key := range []string{"address-data", "addresses", "gateway", "dns", "dns-search"} {
+		delete(settings["ipv4"], key)
+	}
+	settings.set("ipv4", "method", config.Method)
+	if config.Method != IPMethodManual {
+		return
+	}
+	prefix := netip.MustParsePrefix(config.Address)
+	settings.set("ipv4", "address-data", []map[string]dbus.Variant{{
+		"address": dbus.MakeVariant(prefix.Addr().String()),
+		"prefix":  dbus.MakeVariant(uint32(prefix.Bits())),
+	}})
+	if config.Gateway != "" {
+		settings.set("ipv4", "gateway", config.Gateway)
+	}
+	if len(config.DNS) > 0 {
+		dns := make([]uint32, 0, len(config.DNS))
+		for _, server := range config.DNS {
+			addr := netip.MustParseAddr(server).As4()
+			dns = append(dns, binary.NativeEndian.Uint32(addr[:]))
+		}
+		settings.set("ipv4", "dns", dns)
+	}
+	if len(config.Search) > 0 {
+		settings.set("ipv4", "dns-search", config.Search)
+	}
+}
+
+// Replaces the ipv6 setting of a profile. DNS servers are passed as byte arrays.
+func setIPv6(settings ConnectionSettings, config IPv6Config) {
+	for _, key := range []string{"address-data", "addresses", "gateway", "dns"} {
+		delete(settings["ipv6"], key)
+	}
+	settings.set("ipv6", "method", config.Method)
+	if config.Method != IPMethodManual {
+		return
+	}
+	prefix := netip.MustParsePrefix(config.Address)
+	settings.set("ipv6", "address-data", []map[string]dbus.Variant{{
+		"address": dbus.MakeVariant(prefix.Addr().String()),
+		"prefix":  dbus.MakeVariant(uint32(prefix.Bits())),
+	}})
+	if config.Gateway != "" {
+		settings.set("ipv6", "gateway", config.Gateway)
+	}
+	if len(config.DNS) > 0 {
+		dns := make([][]byte, 0, len(config.DNS))
+		for _, server := range config.DNS {
+			addr := netip.MustParseAddr(server).As16()
+			dns = append(dns, addr[:])
+		}
+		settings.set("ipv6", "dns", dns)
+	}
+}
+
+// Applies the pre-shared key or 802.1X settings of a connection
+func (nm *dbusManager) setSecurity(settings ConnectionSettings, conn ConnectionConfig) error {
+	switch conn.Security {
+	case SecurityOpen:
+		delete(settings, "802-11-wireless-security")
+		return nil
+	case SecurityOWE:
+		settings.set("802-11-wireless-security", "key-mgmt", "owe")
+		delete(settings["802-11-wireless-security"], "psk")
+		return nil
+	case SecurityWPA2PSK, SecurityWPA3SAE:
+		settings.set("802-11-wireless-security", "key-mgmt", keyMgmt[conn.Security])
+		settings.set("802-11-wireless-security", "psk", conn.Password)
+		return nil
+	}
+
+	e := conn.Enterprise
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	certs, err := writeCertificates(nm.settings.CertDir, conn.SSID, e)
+	if err != nil {
+		return err
+	}
+	settings.set("802-11-wireless-security", "key-mgmt", "wpa-eap")
+	delete(settings["802-11-wireless-security"], "psk")
+	settings.set("802-1x", "eap", []string{e.EAP})
+	settings.set("802-1x", "identity", e.Identity)
+	settings.set("802-1x", "anonymous-identity", e.AnonymousIdentity)
+	if e.EAP != EAPTLS {
+		settings.set("802-1x", "phase2-auth", e.Phase2)
+	}
+	if e.Password != "" {
+		settings.set("802-1x", "password", e.Password)
+	}
+	// Certificates are referenced with the NUL terminated path scheme
+	for key, path := range map[string]string{
+		"ca-cert":     certs.caCert,
+		"client-cert": certs.clientCert,
+		"private-key": certs.privateKey,
+	} {
+		if path != "" {
+			settings.set("802-1x", key, []byte("file://"+path+"\x00"))
+		}
+	}
+	if certs.privateKey != "" {
+		settings.set("802-1x", "private-key-password", e.PrivateKeyPassword)
+	}
+	return nil
+}
+
+// Remove a saved connection by name
+func (nm *dbusManager) RemoveNetworkConnection(ssid string) error {
+	path, _, err := nm.findConnection(ssid)
+	if err != nil {
+		return fmt.Errorf("failed to delete connection: %v", err)
+	}
+	if err := nm.object(path).Call(nmConnIface+".Delete", 0).Err; err != nil {
+		return fmt.Errorf("failed to delete connection: %v", err)
+	}
+	return nil
+}
+
+// Set autoconnect for a saved connection by name
+func (nm *dbusManager) SetAutoConnectConnection(ssid string, autoConnect bool) error {
+	path, settings, err := nm.findConnection(ssid)
+	if err != nil {
+		return fmt.Errorf("failed to set autoconnect for %s: %v", ssid, err)
+	}
+	settings.set("connection", "autoconnect", autoConnect)
+	if err := nm.updateConnection(path, settings); err != nil {
+		return fmt.Errorf("failed to set autoconnect for %s: %v", ssid, err)
+	}
+	return nil
+}
+
+// Connect to a saved network by name
+func (nm *dbusManager) ConnectNetwork(ssid string) error {
+	iface := ""
+	if ssid == nm.status.APSSID {
+		iface = nm.settings.WifiInterface
+	}
+	if err := nm.activate(ssid, iface); err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", ssid, err)
+	}
+	return nil
+}
+
+// Enable the AP if there's no internet connection for a certain amount of time. This will run in the background.
+func (nm *dbusManager) ManageOfflineAP(connectionLossTimeout time.Duration) error {
+	return manageOfflineAP(nm, nm.sleep, nm.settings.PollInterval, connectionLossTimeout)
+}
+
+// Returns ModeAP, ModeClient or the state of the wifi interface
+func (nm *dbusManager) GetWifiMode() string {
+	return nm.currentMode()
+}
+
+// List the clients of the access point with the leases of NetworkManager's dnsmasq
+func (nm *dbusManager) GetAPClients() ([]APClient, error) {
+	if nm.currentMode() != ModeAP {
+		return []APClient{}, nil
+	}
+	return apClients(nm.runner, nm.settings.WifiInterface, nmLeaseFile(nm.settings.WifiInterface))
+}
+
+// Disconnect a client from the access point
+func (nm *dbusManager) DisconnectAPClient(mac string) error {
+	if nm.currentMode() != ModeAP {
+		return fmt.Errorf("failed to disconnect %s: not in AP mode", mac)
+	}
+	return disconnectAPClient(nm.runner, nm.settings.WifiInterface, mac)
+}
+
+// Answer DNS queries of AP clients with the AP address while AP mode is active. This will run in the background.
+func (nm *dbusManager) ManageCaptiveDNS() error {
+	return manageCaptiveDNS(nm, nm.runner, nm.settings, nm.sleep)
+}
+
+func (nm *dbusManager) wlanOnline() bool {
+	if nm.deviceState(nm.settings.WifiInterface) != DeviceStateActivated {
+		return false
+	}
+	return pingTest(nm.runner, nm.settings)
+}
+
+func (nm *dbusManager) enableAP() error {
+	return nm.ConnectNetwork(nm.status.APSSID)
+}
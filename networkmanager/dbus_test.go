@@ -0,0 +1,702 @@
+package networkmanager
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const testBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-BUS Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startTestBus runs a private dbus-daemon for the duration of the test and
+// returns a connection for the fake service and one for the code under test.
+func startTestBus(t *testing.T) (service, client *dbus.Conn) {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not available")
+	}
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf(testBusConfig, filepath.Join(dir, "bus"))), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("starting dbus-daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading bus address: %v", err)
+	}
+	address = strings.TrimSpace(address)
+
+	if service, err = dbus.Connect(address); err != nil {
+		t.Fatalf("connecting to test bus: %v", err)
+	}
+	t.Cleanup(func() { service.Close() })
+	if client, err = dbus.Connect(address); err != nil {
+		t.Fatalf("connecting to test bus: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return service, client
+}
+
+// fakeNM mimics the subset of the org.freedesktop.NetworkManager object tree used by dbusManager.
+type fakeNM struct {
+	t    *testing.T
+	conn *dbus.Conn
+
+	mu          sync.Mutex
+	root        *prop.Properties
+	connections map[dbus.ObjectPath]ConnectionSettings
+	order       []dbus.ObjectPath
+	active      map[dbus.ObjectPath]dbus.ObjectPath // active connection -> settings connection
+	reapplied   []dbus.ObjectPath
+	nextID      int
+}
+
+type fakeNMRoot struct{ nm *fakeNM }
+type fakeNMSettings struct{ nm *fakeNM }
+type fakeNMConnection struct {
+	nm   *fakeNM
+	path dbus.ObjectPath
+}
+type fakeNMWireless struct{ nm *fakeNM }
+type fakeNMDevice struct {
+	nm   *fakeNM
+	path dbus.ObjectPath
+}
+
+const (
+	fakeWlanPath = dbus.ObjectPath("/org/freedesktop/NetworkManager/Devices/1")
+	fakeEthPath  = dbus.ObjectPath("/org/freedesktop/NetworkManager/Devices/2")
+)
+
+func newFakeNM(t *testing.T, conn *dbus.Conn) *fakeNM {
+	t.Helper()
+	nm := &fakeNM{
+		t:           t,
+		conn:        conn,
+		connections: make(map[dbus.ObjectPath]ConnectionSettings),
+		active:      make(map[dbus.ObjectPath]dbus.ObjectPath),
+	}
+
+	var err error
+	nm.root, err = prop.Export(conn, nmPath, prop.Map{
+		nmIface: {
+			"State":                   {Value: uint32(NMStateConnectedGlobal)},
+			"Connectivity":            {Value: uint32(NMConnectivityFull)},
+			"WirelessHardwareEnabled": {Value: true},
+			"WirelessEnabled":         {Value: true},
+			"ActiveConnections":       {Value: []dbus.ObjectPath{}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm.export(fakeNMRoot{nm}, nmPath, nmIface)
+	nm.export(fakeNMSettings{nm}, nmSettingsPath, nmSettingsIface)
+
+	nm.exportProps(fakeWlanPath, prop.Map{
+		nmDeviceIface: {
+			"State":     {Value: uint32(DeviceStateActivated)},
+			"Ip4Config": {Value: dbus.ObjectPath("/org/freedesktop/NetworkManager/IP4Config/1")},
+		},
+		nmWirelessIface: {
+			"ActiveAccessPoint": {Value: dbus.ObjectPath("/org/freedesktop/NetworkManager/AccessPoint/1")},
+		},
+	})
+	nm.export(fakeNMWireless{nm}, fakeWlanPath, nmWirelessIface)
+	nm.export(fakeNMDevice{nm, fakeWlanPath}, fakeWlanPath, nmDeviceIface)
+	nm.export(fakeNMDevice{nm, fakeEthPath}, fakeEthPath, nmDeviceIface)
+	nm.exportProps(fakeEthPath, prop.Map{
+		nmDeviceIface: {
+			"State":     {Value: uint32(DeviceStateUnavailable)},
+			"Ip4Config": {Value: dbus.ObjectPath("/")},
+		},
+	})
+	nm.exportProps("/org/freedesktop/NetworkManager/IP4Config/1", prop.Map{
+		nmIP4ConfigIface: {
+			"AddressData": {Value: []map[string]dbus.Variant{{
+				"address": dbus.MakeVariant("192.168.1.23"),
+				"prefix":  dbus.MakeVariant(uint32(24)),
+			}}},
+		},
+	})
+	for i, ap := range []struct {
+		ssid     string
+		bssid    string
+		strength byte
+		freq     uint32
+		rsnFlags uint32
+	}{
+		{"HomeWifi", "B8:27:EB:00:00:01", 72, 2437, 0x188},
+		{"Neighbour", "B8:27:EB:00:00:02", 45, 5180, 0},
+		{"HomeWifi", "B8:27:EB:00:00:03", 30, 5745, 0x588},
+	} {
+		nm.exportProps(dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/NetworkManager/AccessPoint/%d", i+1)), prop.Map{
+			nmAPIface: {
+				"Ssid":      {Value: []byte(ap.ssid)},
+				"HwAddress": {Value: ap.bssid},
+				"Strength":  {Value: ap.strength},
+				"Frequency": {Value: ap.freq},
+				"Flags":     {Value: uint32(0)},
+				"WpaFlags":  {Value: uint32(0)},
+				"RsnFlags":  {Value: ap.rsnFlags},
+			},
+		})
+	}
+
+	home := nm.addConnection(wifiSettings("HomeWifi", "secret"))
+	wired := ConnectionSettings{}
+	wired.set("connection", "id", "Wired connection 1")
+	wired.set("connection", "type", "802-3-ethernet")
+	nm.addConnection(wired)
+	nm.activate(home)
+
+	reply, err := conn.RequestName(nmBusName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("requesting %s: %v", nmBusName, err)
+	}
+	return nm
+}
+
+func wifiSettings(id, psk string) ConnectionSettings {
+	settings := ConnectionSettings{}
+	settings.set("connection", "id", id)
+	settings.set("connection", "type", wirelessType)
+	settings.set(wirelessType, "ssid", []byte(id))
+	if psk != "" {
+		settings.set("802-11-wireless-security", "key-mgmt", "wpa-psk")
+		settings.set("802-11-wireless-security", "psk", psk)
+	}
+	return settings
+}
+
+func (nm *fakeNM) export(v interface{}, path dbus.ObjectPath, iface string) {
+	if err := nm.conn.Export(v, path, iface); err != nil {
+		nm.t.Fatal(err)
+	}
+}
+
+func (nm *fakeNM) exportProps(path dbus.ObjectPath, props prop.Map) *prop.Properties {
+	p, err := prop.Export(nm.conn, path, props)
+	if err != nil {
+		nm.t.Fatal(err)
+	}
+	return p
+}
+
+func (nm *fakeNM) addConnection(settings ConnectionSettings) dbus.ObjectPath {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	nm.nextID++
+	path := dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/NetworkManager/Settings/%d", nm.nextID))
+	nm.connections[path] = settings
+	nm.order = append(nm.order, path)
+	nm.export(fakeNMConnection{nm, path}, path, nmConnIface)
+	return path
+}
+
+func (nm *fakeNM) activate(conn dbus.ObjectPath) dbus.ObjectPath {
+	nm.mu.Lock()
+	nm.nextID++
+	path := dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/NetworkManager/ActiveConnection/%d", nm.nextID))
+	settings := nm.connections[conn]
+	nm.active[path] = conn
+	nm.mu.Unlock()
+
+	nm.exportProps(path, prop.Map{
+		nmActiveIface: {
+			"Id":   {Value: settings.ID()},
+			"Type": {Value: settings.Type()},
+		},
+	})
+	nm.syncActive()
+	return path
+}
+
+func (nm *fakeNM) syncActive() {
+	nm.mu.Lock()
+	paths := make([]dbus.ObjectPath, 0, len(nm.active))
+	for path := range nm.active {
+		paths = append(paths, path)
+	}
+	nm.mu.Unlock()
+	nm.root.SetMust(nmIface, "ActiveConnections", paths)
+}
+
+func (nm *fakeNM) settings(id string) (ConnectionSettings, bool) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	for _, path := range nm.order {
+		if nm.connections[path].ID() == id {
+			return nm.connections[path], true
+		}
+	}
+	return nil, false
+}
+
+func (nm *fakeNM) ids() []string {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	ids := make([]string, 0)
+	for _, path := range nm.order {
+		ids = append(ids, nm.connections[path].ID())
+	}
+	return ids
+}
+
+func (nm *fakeNM) activeIDs() []string {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	ids := make([]string, 0)
+	for _, conn := range nm.active {
+		ids = append(ids, nm.connections[conn].ID())
+	}
+	return ids
+}
+
+func (r fakeNMRoot) GetDeviceByIpIface(iface string) (dbus.ObjectPath, *dbus.Error) {
+	switch iface {
+	case "wlan0":
+		return fakeWlanPath, nil
+	case "eth0":
+		return fakeEthPath, nil
+	}
+	return "", dbus.NewError(nmIface+".UnknownDevice", []interface{}{"No device found for the requested iface."})
+}
+
+func (r fakeNMRoot) ActivateConnection(conn, device, specific dbus.ObjectPath) (dbus.ObjectPath, *dbus.Error) {
+	r.nm.mu.Lock()
+	_, ok := r.nm.connections[conn]
+	r.nm.mu.Unlock()
+	if !ok {
+		return "", dbus.NewError(nmIface+".UnknownConnection", []interface{}{"Connection not found"})
+	}
+	return r.nm.activate(conn), nil
+}
+
+func (r fakeNMRoot) DeactivateConnection(active dbus.ObjectPath) *dbus.Error {
+	r.nm.mu.Lock()
+	delete(r.nm.active, active)
+	r.nm.mu.Unlock()
+	r.nm.syncActive()
+	return nil
+}
+
+func (d fakeNMDevice) Reapply(settings map[string]map[string]dbus.Variant, version uint64, flags uint32) *dbus.Error {
+	d.nm.mu.Lock()
+	defer d.nm.mu.Unlock()
+	d.nm.reapplied = append(d.nm.reapplied, d.path)
+	return nil
+}
+
+func (s fakeNMSettings) ListConnections() ([]dbus.ObjectPath, *dbus.Error) {
+	s.nm.mu.Lock()
+	defer s.nm.mu.Unlock()
+	return append([]dbus.ObjectPath(nil), s.nm.order...), nil
+}
+
+func (s fakeNMSettings) AddConnection(settings map[string]map[string]dbus.Variant) (dbus.ObjectPath, *dbus.Error) {
+	return s.nm.addConnection(settings), nil
+}
+
+func (c fakeNMConnection) GetSettings() (map[string]map[string]dbus.Variant, *dbus.Error) {
+	c.nm.mu.Lock()
+	defer c.nm.mu.Unlock()
+	settings := make(map[string]map[string]dbus.Variant)
+	for name, values := range c.nm.connections[c.path] {
+		settings[name] = make(map[string]dbus.Variant)
+		for key, value := range values {
+			if key != "psk" {
+				settings[name][key] = value
+			}
+		}
+	}
+	return settings, nil
+}
+
+func (c fakeNMConnection) GetSecrets(setting string) (map[string]map[string]dbus.Variant, *dbus.Error) {
+	c.nm.mu.Lock()
+	defer c.nm.mu.Unlock()
+	secrets := map[string]map[string]dbus.Variant{setting: {}}
+	if psk, ok := c.nm.connections[c.path][setting]["psk"]; ok {
+		secrets[setting]["psk"] = psk
+	}
+	return secrets, nil
+}
+
+func (c fakeNMConnection) Update(settings map[string]map[string]dbus.Variant) *dbus.Error {
+	c.nm.mu.Lock()
+	defer c.nm.mu.Unlock()
+	c.nm.connections[c.path] = settings
+	return nil
+}
+
+func (c fakeNMConnection) Delete() *dbus.Error {
+	c.nm.mu.Lock()
+	defer c.nm.mu.Unlock()
+	delete(c.nm.connections, c.path)
+	for i, path := range c.nm.order {
+		if path == c.path {
+			c.nm.order = append(c.nm.order[:i], c.nm.order[i+1:]...)
+			break
+		}
+	}
+	c.nm.conn.Export(nil, c.path, nmConnIface)
+	return nil
+}
+
+func (w fakeNMWireless) RequestScan(options map[string]dbus.Variant) *dbus.Error {
+	return nil
+}
+
+func (w fakeNMWireless) GetAllAccessPoints() ([]dbus.ObjectPath, *dbus.Error) {
+	return []dbus.ObjectPath{
+		"/org/freedesktop/NetworkManager/AccessPoint/1",
+		"/org/freedesktop/NetworkManager/AccessPoint/2",
+		"/org/freedesktop/NetworkManager/AccessPoint/3",
+	}, nil
+}
+
+func newTestDBusManager(t *testing.T) (*dbusManager, *fakeNM) {
+	service, client := startTestBus(t)
+	fake := newFakeNM(t, service)
+	settings := DefaultSettings()
+	settings.DnsmasqSharedDir = t.TempDir()
+	return &dbusManager{
+		conn:     client,
+		status:   NetworkStatus{APSSID: testAPSSID},
+		settings: settings,
+		runner:   NewFakeRunner(),
+		sleep:    func(time.Duration) {},
+	}, fake
+}
+
+func TestDBusGetNetworkStatus(t *testing.T) {
+	nm, _ := newTestDBusManager(t)
+
+	status, err := nm.GetNetworkStatus()
+	if err != nil {
+		t.Fatalf("GetNetworkStatus: %v", err)
+	}
+	want := NetworkStatus{
+		State:        "Connected",
+		Connectivity: "Full",
+		WifiHW:       "Enabled",
+		Wifi:         "Enabled",
+		WifiSSID:     "HomeWifi",
+		APSSID:       testAPSSID,
+		SignalStr:    72,
+		Mode:         ModeClient,
+		IPs: NetworkIPs{
+			WifiIP:         "192.168.1.23",
+			WifiState:      "online",
+			WifiIPv4Method: IPMethodAuto,
+			WifiIPv6Method: IPMethodAuto,
+			EthState:       "offline",
+		},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("GetNetworkStatus() = %+v, want %+v", status, want)
+	}
+}
+
+func TestDBusSetupAPConnection(t *testing.T) {
+	nm, fake := newTestDBusManager(t)
+	fake.addConnection(wifiSettings("Optistok-AP-OLD", ""))
+
+	if err := nm.SetupAPConnection(); err != nil {
+		t.Fatalf("SetupAPConnection: %v", err)
+	}
+	if _, ok := fake.settings("Optistok-AP-OLD"); ok {
+		t.Error("stale AP profile was not removed")
+	}
+	ap, ok := fake.settings(testAPSSID)
+	if !ok {
+		t.Fatal("AP profile was not created")
+	}
+	if mode := ap.stringValue(wirelessType, "mode"); mode != "ap" {
+		t.Errorf("AP mode = %q, want ap", mode)
+	}
+	if method := ap.stringValue("ipv4", "method"); method != "shared" {
+		t.Errorf("ipv4.method = %q, want shared", method)
+	}
+	if _, err := os.Stat(filepath.Join(nm.settings.DnsmasqSharedDir, dnsmasqSharedConf)); err != nil {
+		t.Errorf("dnsmasq isn't configured for captive DNS: %v", err)
+	}
+}
+
+func TestDBusSetupAPConnectionUpdatesPassphrase(t *testing.T) {
+	nm, fake := newTestDBusManager(t)
+	if err := nm.SetupAPConnection(); err != nil {
+		t.Fatalf("SetupAPConnection: %v", err)
+	}
+	if ap, _ := fake.settings(testAPSSID); ap["802-11-wireless-security"] != nil {
+		t.Error("AP without passphrase should be open")
+	}
+
+	nm.settings.APPassphrase = "technician"
+	if err := nm.SetupAPConnection(); err != nil {
+		t.Fatalf("SetupAPConnection: %v", err)
+	}
+	if ids := fake.ids(); len(ids) != 3 || !contains(ids, testAPSSID) {
+		t.Fatalf("connections = %v, want the AP profile to be updated in place", ids)
+	}
+	ap, _ := fake.settings(testAPSSID)
+	if mgmt := ap.stringValue("802-11-wireless-security", "key-mgmt"); mgmt != "wpa-psk" {
+		t.Errorf("key-mgmt = %q, want wpa-psk", mgmt)
+	}
+	if psk := ap.stringValue("802-11-wireless-security", "psk"); psk != "technician" {
+		t.Errorf("psk = %q, want technician", psk)
+	}
+}
+
+func TestDBusSetWifiModeAP(t *testing.T) {
+	nm, fake := newTestDBusManager(t)
+	if err := nm.SetupAPConnection(); err != nil {
+		t.Fatalf("SetupAPConnection: %v", err)
+	}
+
+	if err := nm.SetWifiMode(ModeAP); err != nil {
+		t.Fatalf("SetWifiMode(ap): %v", err)
+	}
+	if !contains(fake.activeIDs(), testAPSSID) {
+		t.Errorf("active connections = %v, want AP to be active", fake.activeIDs())
+	}
+
+	if err := nm.SetWifiMode(ModeClient); err != nil {
+		t.Fatalf("SetWifiMode(client): %v", err)
+	}
+	if contains(fake.activeIDs(), testAPSSID) {
+		t.Errorf("active connections = %v, want AP to be inactive", fake.activeIDs())
+	}
+}
+
+func TestDBusFindAvailableNetworks(t *testing.T) {
+	nm, _ := newTestDBusManager(t)
+
+	networks, err := nm.FindAvailableNetworks()
+	if err != nil {
+		t.Fatalf("FindAvailableNetworks: %v", err)
+	}
+	want := []ScanResult{
+		{SSID: "HomeWifi", Signal: 72, Security: SecurityWPA2PSK, InUse: true, BSSIDs: []BSS{
+			{BSSID: "b8:27:eb:00:00:01", Signal: 72, Frequency: 2437, Channel: 6, Band: Band2GHz, Security: SecurityWPA2PSK, InUse: true},
+			{BSSID: "b8:27:eb:00:00:03", Signal: 30, Frequency: 5745, Channel: 149, Band: Band5GHz, Security: SecurityWPA2WPA3},
+		}},
+		{SSID: "Neighbour", Signal: 45, Security: SecurityOpen, BSSIDs: []BSS{
+			{BSSID: "b8:27:eb:00:00:02", Signal: 45, Frequency: 5180, Channel: 36, Band: Band5GHz, Security: SecurityOpen},
+		}},
+	}
+	if !reflect.DeepEqual(networks, want) {
+		t.Errorf("FindAvailableNetworks() = %+v, want %+v", networks, want)
+	}
+}
+
+func TestDBusModifyNetworkConnection(t *testing.T) {
+	nm, fake := newTestDBusManager(t)
+
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Office", Password: "hunter22"}); err != nil {
+		t.Fatalf("ModifyNetworkConnection (create): %v", err)
+	}
+	office, ok := fake.settings("Office")
+	if !ok {
+		t.Fatal("profile was not created")
+	}
+	if psk := office.stringValue("802-11-wireless-security", "psk"); psk != "hunter22" {
+		t.Errorf("psk = %q, want hunter22", psk)
+	}
+
+	// Modifying without a password must keep the stored secret
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Office", AutoConnect: true}); err != nil {
+		t.Fatalf("ModifyNetworkConnection (modify): %v", err)
+	}
+	connections, err := nm.GetConfiguredConnections()
+	if err != nil {
+		t.Fatalf("GetConfiguredConnections: %v", err)
+	}
+	var found bool
+	for _, conn := range connections {
+		if conn.SSID == "Office" {
+			found = true
+			if conn.Password != "hunter22" {
+				t.Errorf("Password = %q, want hunter22", conn.Password)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("GetConfiguredConnections() = %v, want Office", connections)
+	}
+	office, _ = fake.settings("Office")
+	var autoConnect bool
+	office["connection"]["autoconnect"].Store(&autoConnect)
+	if !autoConnect {
+		t.Error("autoconnect was not enabled")
+	}
+}
+
+func TestDBusModifyNetworkConnectionEnterprise(t *testing.T) {
+	nm, fake := newTestDBusManager(t)
+	nm.settings.CertDir = t.TempDir()
+
+	err := nm.ModifyNetworkConnection(ConnectionConfig{
+		SSID: "Corp",
+		Enterprise: &EnterpriseConfig{
+			EAP:      EAPPEAP,
+			Identity: "alice",
+			Password: "s3cret",
+			CACert:   []byte(testCert),
+		},
+	})
+	if err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	corp, ok := fake.settings("Corp")
+	if !ok {
+		t.Fatal("profile was not created")
+	}
+	if mgmt := corp.stringValue("802-11-wireless-security", "key-mgmt"); mgmt != "wpa-eap" {
+		t.Errorf("key-mgmt = %q, want wpa-eap", mgmt)
+	}
+	var eap []string
+	var caCert []byte
+	corp["802-1x"]["eap"].Store(&eap)
+	corp["802-1x"]["ca-cert"].Store(&caCert)
+	if len(eap) != 1 || eap[0] != EAPPEAP || corp.stringValue("802-1x", "phase2-auth") != Phase2MSCHAPv2 {
+		t.Errorf("802-1x = %v, want PEAP with MSCHAPv2", corp["802-1x"])
+	}
+	if want := "file://" + filepath.Join(nm.settings.CertDir, "436f7270-ca.pem") + "\x00"; string(caCert) != want {
+		t.Errorf("ca-cert = %q, want %q", caCert, want)
+	}
+}
+
+func TestDBusSetIPv4Config(t *testing.T) {
+	nm, fake := newTestDBusManager(t)
+
+	err := nm.SetIPv4Config("HomeWifi", IPv4Config{
+		Method:  IPMethodManual,
+		Address: "192.168.1.50/24",
+		Gateway: "192.168.1.1",
+		DNS:     []string{"1.1.1.1"},
+		Search:  []string{"lan"},
+	})
+	if err != nil {
+		t.Fatalf("SetIPv4Config: %v", err)
+	}
+	home, _ := fake.settings("HomeWifi")
+	var addresses []map[string]dbus.Variant
+	var dns []uint32
+	home["ipv4"]["address-data"].Store(&addresses)
+	home["ipv4"]["dns"].Store(&dns)
+	if home.stringValue("ipv4", "method") != IPMethodManual || home.stringValue("ipv4", "gateway") != "192.168.1.1" {
+		t.Errorf("ipv4 = %v, want manual with gateway", home["ipv4"])
+	}
+	if len(addresses) != 1 || addresses[0]["address"].Value() != "192.168.1.50" || addresses[0]["prefix"].Value() != uint32(24) {
+		t.Errorf("address-data = %v, want 192.168.1.50/24", addresses)
+	}
+	if len(dns) != 1 || dns[0] != 0x01010101 {
+		t.Errorf("dns = %v, want 1.1.1.1", dns)
+	}
+	if psk := home.stringValue("802-11-wireless-security", "psk"); psk != "secret" {
+		t.Errorf("psk = %q, the stored secret must be kept", psk)
+	}
+	fake.mu.Lock()
+	reapplied := fake.reapplied
+	fake.mu.Unlock()
+	if len(reapplied) != 1 || reapplied[0] != fakeWlanPath {
+		t.Errorf("reapplied = %v, want the active wifi device", reapplied)
+	}
+
+	// The wired profile is inactive and switches back to DHCP without a reapply
+	if err := nm.SetIPv4Config("", IPv4Config{Method: IPMethodAuto}); err != nil {
+		t.Fatalf("SetIPv4Config (ethernet): %v", err)
+	}
+	wired, _ := fake.settings("Wired connection 1")
+	if wired.stringValue("ipv4", "method") != IPMethodAuto {
+		t.Errorf("ipv4 = %v, want auto", wired["ipv4"])
+	}
+}
+
+func TestDBusSetIPv6Config(t *testing.T) {
+	nm, fake := newTestDBusManager(t)
+
+	err := nm.SetIPv6Config("HomeWifi", IPv6Config{
+		Method:  IPMethodManual,
+		Address: "2001:db8::50/64",
+		Gateway: "fe80::1",
+		DNS:     []string{"2001:db8::53"},
+	})
+	if err != nil {
+		t.Fatalf("SetIPv6Config: %v", err)
+	}
+	home, _ := fake.settings("HomeWifi")
+	var addresses []map[string]dbus.Variant
+	var dns [][]byte
+	home["ipv6"]["address-data"].Store(&addresses)
+	home["ipv6"]["dns"].Store(&dns)
+	if home.stringValue("ipv6", "method") != IPMethodManual || home.stringValue("ipv6", "gateway") != "fe80::1" {
+		t.Errorf("ipv6 = %v, want manual with gateway", home["ipv6"])
+	}
+	if len(addresses) != 1 || addresses[0]["address"].Value() != "2001:db8::50" || addresses[0]["prefix"].Value() != uint32(64) {
+		t.Errorf("address-data = %v, want 2001:db8::50/64", addresses)
+	}
+	if len(dns) != 1 || len(dns[0]) != 16 || dns[0][15] != 0x53 {
+		t.Errorf("dns = %v, want 2001:db8::53", dns)
+	}
+
+	if err := nm.SetIPv6Config("", IPv6Config{Method: IPMethodDisabled}); err != nil {
+		t.Fatalf("SetIPv6Config (ethernet): %v", err)
+	}
+	wired, _ := fake.settings("Wired connection 1")
+	if wired.stringValue("ipv6", "method") != IPMethodDisabled {
+		t.Errorf("ipv6 = %v, want disabled", wired["ipv6"])
+	}
+}
+
+func TestDBusRemoveNetworkConnection(t *testing.T) {
+	nm, fake := newTestDBusManager(t)
+
+	if err := nm.RemoveNetworkConnection("HomeWifi"); err != nil {
+		t.Fatalf("RemoveNetworkConnection: %v", err)
+	}
+	if _, ok := fake.settings("HomeWifi"); ok {
+		t.Error("profile was not deleted")
+	}
+	if err := nm.RemoveNetworkConnection("Missing"); err == nil {
+		t.Error("expected error removing an unknown profile")
+	}
+}
@@ -0,0 +1,142 @@
+package networkmanager
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DefaultDHCPCDConf is the dhcpcd configuration holding static addresses on dhcpcd based images
+const DefaultDHCPCDConf = "/etc/dhcpcd.conf"
+
+// Blocks written by PiFi start with the marker followed by their selector and end with dhcpcdEnd
+const (
+	dhcpcdMarker = "# pifi: "
+	dhcpcdEnd    = dhcpcdMarker + "end"
+)
+
+// Returns the dhcpcd selector of a profile, "ssid <name>" or "interface <name>"
+func dhcpcdSelector(ssid, ethernet string) string {
+	if ssid == "" {
+		return "interface " + ethernet
+	}
+	return "ssid " + ssid
+}
+
+// Replaces the static IPv4 configuration of a selector in the dhcpcd configuration at path
+func writeDHCPCDConfig(path, selector string, config IPv4Config) error {
+	var options []string
+	if config.Method == IPMethodManual {
+		options = append(options, "static ip_address="+config.Address)
+		if config.Gateway != "" {
+			options = append(options, "static routers="+config.Gateway)
+		}
+		if len(config.DNS) > 0 {
+			options = append(options, "static domain_name_servers="+strings.Join(config.DNS, " "))
+		}
+		if len(config.Search) > 0 {
+			options = append(options, "static domain_search="+strings.Join(config.Search, " "))
+		}
+	}
+	return writeDHCPCDBlock(path, selector, selector, options)
+}
+
+// Replaces the IPv6 configuration of a selector. dhcpcd learns the IPv6 gateway
+// and DNS servers from router advertisements, so only the address can be static.
+func writeDHCPCDIPv6Config(path, selector string, config IPv6Config) error {
+	var options []string
+	switch config.Method {
+	case IPMethodDisabled:
+		options = []string{"noipv6"}
+	case IPMethodDHCP:
+		options = []string{"ipv6ra_noautoconf", "ia_na"}
+	case IPMethodManual:
+		if config.Gateway != "" || len(config.DNS) > 0 {
+			return fmt.Errorf("dhcpcd does not support a static IPv6 gateway or DNS servers")
+		}
+		options = []string{"ipv6ra_noautoconf", "static ip6_address=" + config.Address}
+	}
+	return writeDHCPCDBlock(path, "ipv6 "+selector, selector, options)
+}
+
+// Replaces the block with the given key by the options under selector, no options remove it.
+// The block is appended at the end since dhcpcd applies options up to the next selector.
+func writeDHCPCDBlock(path, key, selector string, options []string) error {
+	if strings.ContainsAny(selector, "\r\n") {
+		return fmt.Errorf("invalid dhcpcd selector %q", selector)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	content := removeDHCPCDBlock(string(data), key)
+	if len(options) > 0 {
+		content += fmt.Sprintf("\n%s%s\n%s\n%s\n%s\n", dhcpcdMarker, key, selector, strings.Join(options, "\n"), dhcpcdEnd)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// Removes the block written for a key
+func removeDHCPCDBlock(content, key string) string {
+	var kept []string
+	inside := false
+	for _, line := range strings.Split(content, "\n") {
+		switch {
+		case line == dhcpcdMarker+key:
+			inside = true
+		case inside && line == dhcpcdEnd:
+			inside = false
+		case !inside:
+			kept = append(kept, line)
+		}
+	}
+	return strings.TrimRight(strings.Join(kept, "\n"), "\n") + "\n"
+}
+
+// Returns the options of all sections of a selector
+func dhcpcdOptions(path, selector string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var options []string
+	inside := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "interface ") || strings.HasPrefix(line, "ssid ") {
+			inside = line == selector
+		} else if inside && line != "" && !strings.HasPrefix(line, "#") {
+			options = append(options, line)
+		}
+	}
+	return options
+}
+
+// Returns the IPv4 method dhcpcd uses for a selector, static when it has an ip_address
+func dhcpcdMethod(path, selector string) string {
+	for _, option := range dhcpcdOptions(path, selector) {
+		if strings.HasPrefix(option, "static ip_address=") {
+			return IPMethodManual
+		}
+	}
+	return IPMethodAuto
+}
+
+// Returns the IPv6 method dhcpcd uses for a selector
+func dhcpcdIPv6Method(path, selector string) string {
+	method := IPMethodAuto
+	for _, option := range dhcpcdOptions(path, selector) {
+		switch {
+		case option == "noipv6":
+			return IPMethodDisabled
+		case strings.HasPrefix(option, "static ip6_address="):
+			method = IPMethodManual
+		case strings.HasPrefix(option, "ia_na") && method == IPMethodAuto:
+			method = IPMethodDHCP
+		}
+	}
+	return method
+}
@@ -0,0 +1,70 @@
+package networkmanager
+
+import "time"
+
+// Types of StatusEvent
+const (
+	EventModeChanged   = "mode-changed"
+	EventConnected     = "connected"
+	EventDisconnected  = "disconnected"
+	EventIPChanged     = "ip-changed"
+	EventScanCompleted = "scan-completed"
+	EventAPEnabled     = "ap-enabled"
+	// EventAPFallback is published when the AP is enabled after being offline
+	EventAPFallback = "ap-fallback"
+)
+
+// StatusEvent describes a change of the network status
+type StatusEvent struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Mode string    `json:"mode"`
+	// SSID is the network connected to or disconnected from, or the AP SSID
+	SSID       string `json:"ssid,omitempty"`
+	WifiIP     string `json:"wifiIP,omitempty"`
+	EthernetIP string `json:"ethernetIP,omitempty"`
+	// Networks is the number of networks found by a scan
+	Networks int `json:"networks,omitempty"`
+}
+
+// StatusEvents returns the events for the change from old to new, all at time now
+func StatusEvents(old, new NetworkStatus, now time.Time) []StatusEvent {
+	event := func(typ, ssid string) StatusEvent {
+		return StatusEvent{
+			Type:       typ,
+			Time:       now,
+			Mode:       new.Mode,
+			SSID:       ssid,
+			WifiIP:     new.IPs.WifiIP,
+			EthernetIP: new.IPs.EthernetIP,
+		}
+	}
+	events := make([]StatusEvent, 0)
+	if old.Mode != new.Mode {
+		events = append(events, event(EventModeChanged, ""))
+		if new.Mode == ModeAP {
+			events = append(events, event(EventAPEnabled, new.APSSID))
+		}
+	}
+	// In AP mode the wifi SSID is the one of the AP
+	oldSSID, newSSID := clientSSID(old), clientSSID(new)
+	if oldSSID != newSSID {
+		if oldSSID != "" {
+			events = append(events, event(EventDisconnected, oldSSID))
+		}
+		if newSSID != "" {
+			events = append(events, event(EventConnected, newSSID))
+		}
+	}
+	if old.IPs.WifiIP != new.IPs.WifiIP || old.IPs.EthernetIP != new.IPs.EthernetIP {
+		events = append(events, event(EventIPChanged, newSSID))
+	}
+	return events
+}
+
+func clientSSID(status NetworkStatus) string {
+	if status.Mode == ModeAP {
+		return ""
+	}
+	return status.WifiSSID
+}
@@ -0,0 +1,51 @@
+package networkmanager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatusEvents(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	home := NetworkStatus{Mode: ModeClient, WifiSSID: "Home", APSSID: testAPSSID, IPs: NetworkIPs{WifiIP: "192.168.1.20"}}
+	cafe := NetworkStatus{Mode: ModeClient, WifiSSID: "Cafe", APSSID: testAPSSID, IPs: NetworkIPs{WifiIP: "10.0.0.5"}}
+	ap := NetworkStatus{Mode: ModeAP, WifiSSID: testAPSSID, APSSID: testAPSSID, IPs: NetworkIPs{WifiIP: "10.42.0.1"}}
+	offline := NetworkStatus{Mode: ModeClient, APSSID: testAPSSID}
+	renewed := home
+	renewed.IPs.WifiIP = "192.168.1.21"
+
+	types := func(events []StatusEvent) []string {
+		types := make([]string, 0)
+		for _, e := range events {
+			if !e.Time.Equal(now) {
+				t.Errorf("%s event at %v, want %v", e.Type, e.Time, now)
+			}
+			types = append(types, e.Type)
+		}
+		return types
+	}
+	for name, tc := range map[string]struct {
+		old, new NetworkStatus
+		want     []string
+	}{
+		"unchanged":   {home, home, []string{}},
+		"roamed":      {home, cafe, []string{EventDisconnected, EventConnected, EventIPChanged}},
+		"offline":     {home, offline, []string{EventDisconnected, EventIPChanged}},
+		"ap enabled":  {offline, ap, []string{EventModeChanged, EventAPEnabled, EventIPChanged}},
+		"ap disabled": {ap, home, []string{EventModeChanged, EventConnected, EventIPChanged}},
+		"dhcp renew":  {home, renewed, []string{EventIPChanged}},
+	} {
+		if got := types(StatusEvents(tc.old, tc.new, now)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: events = %v, want %v", name, got, tc.want)
+		}
+	}
+
+	events := StatusEvents(home, cafe, now)
+	if events[0].SSID != "Home" || events[1].SSID != "Cafe" || events[1].WifiIP != "10.0.0.5" {
+		t.Errorf("roaming events = %+v", events)
+	}
+	if events := StatusEvents(offline, ap, now); events[1].SSID != testAPSSID {
+		t.Errorf("ap-enabled SSID = %q, want %q", events[1].SSID, testAPSSID)
+	}
+}
@@ -0,0 +1,137 @@
+package networkmanager
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// IP configuration methods. IPv6 also supports DHCP only and disabled.
+const (
+	IPMethodAuto     = "auto"
+	IPMethodManual   = "manual"
+	IPMethodDHCP     = "dhcp"
+	IPMethodDisabled = "disabled"
+)
+
+// IPv4Config is the IPv4 configuration of a connection. The static settings
+// are only used with IPMethodManual and are cleared when switching back to DHCP.
+type IPv4Config struct {
+	Method string `json:"method"`
+	// Address is the address and prefix length, e.g. 192.168.1.10/24
+	Address string   `json:"address,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+	Search  []string `json:"search,omitempty"`
+}
+
+var domainPattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// Validate checks the static settings, an empty method selects DHCP
+func (c *IPv4Config) Validate() error {
+	switch c.Method {
+	case "", IPMethodAuto:
+		*c = IPv4Config{Method: IPMethodAuto}
+		return nil
+	case IPMethodManual:
+	default:
+		return fmt.Errorf("unsupported IPv4 method: %s", c.Method)
+	}
+
+	prefix, err := netip.ParsePrefix(c.Address)
+	if err != nil || !prefix.Addr().Is4() || prefix.Bits() == 0 {
+		return fmt.Errorf("invalid IPv4 address %q, use address/prefix such as 192.168.1.10/24", c.Address)
+	}
+	if c.Gateway != "" {
+		gateway, err := netip.ParseAddr(c.Gateway)
+		if err != nil || !gateway.Is4() {
+			return fmt.Errorf("invalid IPv4 gateway %q", c.Gateway)
+		}
+		if !prefix.Masked().Contains(gateway) || gateway == prefix.Addr() {
+			return fmt.Errorf("gateway %s is not reachable from %s", c.Gateway, c.Address)
+		}
+	}
+	for _, dns := range c.DNS {
+		if addr, err := netip.ParseAddr(dns); err != nil || !addr.Is4() {
+			return fmt.Errorf("invalid IPv4 DNS server %q", dns)
+		}
+	}
+	for _, domain := range c.Search {
+		if len(domain) > 253 || !domainPattern.MatchString(domain) {
+			return fmt.Errorf("invalid search domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// IPv6Config is the IPv6 configuration of a connection. IPMethodAuto uses router
+// advertisements and DHCPv6, IPMethodDHCP only DHCPv6.
+type IPv6Config struct {
+	Method string `json:"method"`
+	// Address is the address and prefix length, e.g. 2001:db8::10/64
+	Address string   `json:"address,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+}
+
+// Validate checks the static settings, an empty method selects automatic configuration
+func (c *IPv6Config) Validate() error {
+	switch c.Method {
+	case "", IPMethodAuto, IPMethodDHCP, IPMethodDisabled:
+		method := c.Method
+		if method == "" {
+			method = IPMethodAuto
+		}
+		*c = IPv6Config{Method: method}
+		return nil
+	case IPMethodManual:
+	default:
+		return fmt.Errorf("unsupported IPv6 method: %s", c.Method)
+	}
+
+	prefix, err := netip.ParsePrefix(c.Address)
+	if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() || prefix.Bits() == 0 {
+		return fmt.Errorf("invalid IPv6 address %q, use address/prefix such as 2001:db8::10/64", c.Address)
+	}
+	if c.Gateway != "" {
+		gateway, err := netip.ParseAddr(c.Gateway)
+		if err != nil || !gateway.Is6() || gateway.Is4In6() || gateway.Zone() != "" {
+			return fmt.Errorf("invalid IPv6 gateway %q", c.Gateway)
+		}
+		// Routers are usually reached through their link-local address
+		if !gateway.IsLinkLocalUnicast() && !prefix.Masked().Contains(gateway) {
+			return fmt.Errorf("gateway %s is not reachable from %s", c.Gateway, c.Address)
+		}
+	}
+	for _, dns := range c.DNS {
+		if addr, err := netip.ParseAddr(dns); err != nil || !addr.Is6() || addr.Zone() != "" {
+			return fmt.Errorf("invalid IPv6 DNS server %q", dns)
+		}
+	}
+	return nil
+}
+
+// Returns the dotted netmask of the address prefix
+func (c IPv4Config) netmask() string {
+	prefix, err := netip.ParsePrefix(c.Address)
+	if err != nil {
+		return ""
+	}
+	return net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+}
+
+// Returns the address without the prefix length
+func (c IPv4Config) ip() string {
+	address, _, _ := strings.Cut(c.Address, "/")
+	return address
+}
+
+// Normalizes a method reported by a backend, a missing method means DHCP
+func ipMethod(method string) string {
+	if method == "" {
+		return IPMethodAuto
+	}
+	return method
+}
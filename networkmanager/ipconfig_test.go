@@ -0,0 +1,61 @@
+package networkmanager
+
+import "testing"
+
+func TestIPv4ConfigValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config IPv4Config
+		valid  bool
+	}{
+		"dhcp":               {IPv4Config{Method: IPMethodAuto}, true},
+		"default":            {IPv4Config{}, true},
+		"static":             {IPv4Config{Method: IPMethodManual, Address: "192.168.1.10/24", Gateway: "192.168.1.1", DNS: []string{"1.1.1.1"}, Search: []string{"example.com"}}, true},
+		"without gateway":    {IPv4Config{Method: IPMethodManual, Address: "10.0.0.5/8"}, true},
+		"missing prefix":     {IPv4Config{Method: IPMethodManual, Address: "192.168.1.10"}, false},
+		"ipv6 address":       {IPv4Config{Method: IPMethodManual, Address: "fd00::10/64"}, false},
+		"gateway off-link":   {IPv4Config{Method: IPMethodManual, Address: "192.168.1.10/24", Gateway: "192.168.2.1"}, false},
+		"gateway is self":    {IPv4Config{Method: IPMethodManual, Address: "192.168.1.10/24", Gateway: "192.168.1.10"}, false},
+		"invalid dns":        {IPv4Config{Method: IPMethodManual, Address: "192.168.1.10/24", DNS: []string{"dns.example"}}, false},
+		"invalid search":     {IPv4Config{Method: IPMethodManual, Address: "192.168.1.10/24", Search: []string{"bad domain"}}, false},
+		"unsupported method": {IPv4Config{Method: "shared"}, false},
+	} {
+		if err := tc.config.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: Validate() = %v, want valid=%v", name, err, tc.valid)
+		}
+	}
+
+	config := IPv4Config{Method: IPMethodAuto, Address: "192.168.1.10/24", DNS: []string{"1.1.1.1"}}
+	if err := config.Validate(); err != nil || config.Address != "" || config.DNS != nil {
+		t.Errorf("Validate() = %v, %+v; want static settings cleared for DHCP", err, config)
+	}
+	if mask := (IPv4Config{Address: "10.1.2.3/20"}).netmask(); mask != "255.255.240.0" {
+		t.Errorf("netmask() = %q, want 255.255.240.0", mask)
+	}
+}
+
+func TestIPv6ConfigValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config IPv6Config
+		valid  bool
+	}{
+		"auto":               {IPv6Config{}, true},
+		"dhcp":               {IPv6Config{Method: IPMethodDHCP}, true},
+		"disabled":           {IPv6Config{Method: IPMethodDisabled}, true},
+		"static":             {IPv6Config{Method: IPMethodManual, Address: "2001:db8::10/64", Gateway: "2001:db8::1", DNS: []string{"2606:4700:4700::1111"}}, true},
+		"link-local gateway": {IPv6Config{Method: IPMethodManual, Address: "2001:db8::10/64", Gateway: "fe80::1"}, true},
+		"zoned gateway":      {IPv6Config{Method: IPMethodManual, Address: "2001:db8::10/64", Gateway: "fe80::1%wlan0"}, false},
+		"gateway off-link":   {IPv6Config{Method: IPMethodManual, Address: "2001:db8::10/64", Gateway: "2001:db9::1"}, false},
+		"ipv4 address":       {IPv6Config{Method: IPMethodManual, Address: "192.168.1.10/24"}, false},
+		"ipv4 dns":           {IPv6Config{Method: IPMethodManual, Address: "2001:db8::10/64", DNS: []string{"1.1.1.1"}}, false},
+		"unsupported method": {IPv6Config{Method: "shared"}, false},
+	} {
+		if err := tc.config.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: Validate() = %v, want valid=%v", name, err, tc.valid)
+		}
+	}
+
+	config := IPv6Config{Address: "2001:db8::10/64"}
+	if err := config.Validate(); err != nil || config.Method != IPMethodAuto || config.Address != "" {
+		t.Errorf("Validate() = %v, %+v; want auto without static settings", err, config)
+	}
+}
@@ -0,0 +1,94 @@
+package networkmanager
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+)
+
+// Returns the first IPv4 address assigned to the interface, or an empty string
+func interfaceIP(runner CommandRunner, iface string) string {
+	output, err := runner.Output(context.Background(), "ip", "-4", "-o", "addr", "show", "dev", iface)
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(output))
+	for i, field := range fields {
+		if field == "inet" && i+1 < len(fields) {
+			return strings.Split(fields[i+1], "/")[0]
+		}
+	}
+	return ""
+}
+
+// Returns the global IPv6 addresses with prefix length assigned to the interface
+func interfaceIPv6(runner CommandRunner, iface string) []string {
+	output, err := runner.Output(context.Background(), "ip", "-6", "-o", "addr", "show", "dev", iface, "scope", "global")
+	if err != nil {
+		return nil
+	}
+	var addresses []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "inet6" && i+1 < len(fields) {
+				addresses = append(addresses, fields[i+1])
+			}
+		}
+	}
+	return addresses
+}
+
+// Returns the gateway of the first IPv6 default route. Link-local gateways
+// include the interface as zone, e.g. fe80::1%wlan0.
+func ipv6DefaultRoute(runner CommandRunner) string {
+	output, err := runner.Output(context.Background(), "ip", "-6", "route", "show", "default")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		var gateway, device string
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "via":
+				gateway = fields[i+1]
+			case "dev":
+				device = fields[i+1]
+			}
+		}
+		if gateway == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(gateway); err == nil && addr.IsLinkLocalUnicast() && device != "" {
+			return gateway + "%" + device
+		}
+		return gateway
+	}
+	return ""
+}
+
+// Adds the IPv6 addresses and default route, which all backends read with iproute2
+func addIPv6Status(runner CommandRunner, settings Settings, status *NetworkIPs) {
+	status.WifiIPv6 = interfaceIPv6(runner, settings.WifiInterface)
+	status.EthIPv6 = interfaceIPv6(runner, settings.EthernetInterface)
+	status.IPv6Gateway = ipv6DefaultRoute(runner)
+}
+
+// Reads interface addresses with iproute2 for backends that don't track them
+func ipNetworkIps(runner CommandRunner, settings Settings) NetworkIPs {
+	status := NetworkIPs{
+		WifiState: "offline",
+		EthState:  "offline",
+	}
+	if ip := interfaceIP(runner, settings.WifiInterface); ip != "" {
+		status.WifiIP = ip
+		status.WifiState = "online"
+	}
+	if ip := interfaceIP(runner, settings.EthernetInterface); ip != "" {
+		status.EthernetIP = ip
+		status.EthState = "online"
+	}
+	addIPv6Status(runner, settings, &status)
+	return status
+}
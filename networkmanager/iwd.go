@@ -0,0 +1,873 @@
+package networkmanager
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	iwdBusName           = "net.connman.iwd"
+	iwdAdapterIface      = "net.connman.iwd.Adapter"
+	iwdDeviceIface       = "net.connman.iwd.Device"
+	iwdStationIface      = "net.connman.iwd.Station"
+	iwdNetworkIface      = "net.connman.iwd.Network"
+	iwdKnownNetworkIface = "net.connman.iwd.KnownNetwork"
+	iwdAccessPointIface  = "net.connman.iwd.AccessPoint"
+	iwdBSSIface          = "net.connman.iwd.BasicServiceSet"
+
+	// DefaultIWDStateDir is where iwd keeps network provisioning files.
+	DefaultIWDStateDir = "/var/lib/iwd"
+)
+
+// iwdObjects is the result of ObjectManager.GetManagedObjects on the iwd service.
+type iwdObjects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+// Returns the first object implementing iface whose properties satisfy match
+func (o iwdObjects) find(iface string, match func(props map[string]dbus.Variant) bool) (dbus.ObjectPath, map[string]dbus.Variant, bool) {
+	for path, ifaces := range o {
+		if props, ok := ifaces[iface]; ok && match(props) {
+			return path, props, true
+		}
+	}
+	return "", nil, false
+}
+
+func variantString(props map[string]dbus.Variant, key string) string {
+	var value string
+	if v, ok := props[key]; ok {
+		v.Store(&value)
+	}
+	return value
+}
+
+func variantBool(props map[string]dbus.Variant, key string) bool {
+	var value bool
+	if v, ok := props[key]; ok {
+		v.Store(&value)
+	}
+	return value
+}
+
+func variantPath(props map[string]dbus.Variant, key string) dbus.ObjectPath {
+	var value dbus.ObjectPath
+	if v, ok := props[key]; ok {
+		v.Store(&value)
+	}
+	return value
+}
+
+type iwdManager struct {
+	conn     *dbus.Conn
+	status   NetworkStatus
+	settings Settings
+	runner   CommandRunner
+	sleep    func(time.Duration)
+	stateDir string
+}
+
+// NewIWD returns a NetworkManager that drives iwd (net.connman.iwd) over the given bus.
+// Networks are provisioned by writing iwd's profile files to stateDir. The runner is
+// used for address lookups and connectivity checks; a nil runner executes commands on the host.
+func NewIWD(conn *dbus.Conn, stateDir string, settings Settings, runner CommandRunner) NetworkManager {
+	if runner == nil {
+		runner = ExecRunner{}
+	}
+	nm := &iwdManager{
+		conn: conn,
+		status: NetworkStatus{
+			APSSID: settings.apSSID(),
+		},
+		settings: settings,
+		runner:   runner,
+		sleep:    time.Sleep,
+		stateDir: stateDir,
+	}
+	nm.GetNetworkStatus()
+	return nm
+}
+
+func (nm *iwdManager) object(path dbus.ObjectPath) dbus.BusObject {
+	return nm.conn.Object(iwdBusName, path)
+}
+
+func (nm *iwdManager) objects() (iwdObjects, error) {
+	var objects iwdObjects
+	err := nm.object("/").Call("org.freedesktop.DBus.ObjectManager.GetManagedObjects", 0).Store(&objects)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query iwd: %v", err)
+	}
+	return objects, nil
+}
+
+// Returns the wifi device path along with its properties
+func (nm *iwdManager) device(objects iwdObjects) (dbus.ObjectPath, map[string]dbus.Variant, error) {
+	path, props, ok := objects.find(iwdDeviceIface, func(props map[string]dbus.Variant) bool {
+		return variantString(props, "Name") == nm.settings.WifiInterface
+	})
+	if !ok {
+		return "", nil, fmt.Errorf("iwd device %s not found", nm.settings.WifiInterface)
+	}
+	return path, props, nil
+}
+
+type iwdNetwork struct {
+	path   dbus.ObjectPath
+	name   string
+	signal int16
+}
+
+// Returns visible networks sorted by iwd from strongest to weakest
+func (nm *iwdManager) orderedNetworks(station dbus.ObjectPath, objects iwdObjects) ([]iwdNetwork, error) {
+	var ordered []struct {
+		Path   dbus.ObjectPath
+		Signal int16
+	}
+	if err := nm.object(station).Call(iwdStationIface+".GetOrderedNetworks", 0).Store(&ordered); err != nil {
+		return nil, err
+	}
+	networks := make([]iwdNetwork, 0, len(ordered))
+	for _, n := range ordered {
+		networks = append(networks, iwdNetwork{
+			path:   n.Path,
+			name:   variantString(objects[n.Path][iwdNetworkIface], "Name"),
+			signal: n.Signal,
+		})
+	}
+	return networks, nil
+}
+
+func (nm *iwdManager) GetNetworkStatus() (NetworkStatus, error) {
+	objects, err := nm.objects()
+	if err != nil {
+		return nm.status, err
+	}
+	device, deviceProps, err := nm.device(objects)
+	if err != nil {
+		return nm.status, err
+	}
+	adapterProps := objects[variantPath(deviceProps, "Adapter")][iwdAdapterIface]
+
+	networkStatus := NetworkStatus{
+		APSSID:       nm.status.APSSID,
+		State:        "Disconnected",
+		Connectivity: "None",
+		WifiHW:       enabledString(variantBool(adapterProps, "Powered")),
+		Wifi:         enabledString(variantBool(deviceProps, "Powered")),
+		SignalStr:    -1,
+		Mode:         nm.modeFromObjects(objects),
+		IPs:          ipNetworkIps(nm.runner, nm.settings),
+	}
+
+	if station, ok := objects[device][iwdStationIface]; ok && variantString(station, "State") == "connected" {
+		connected := variantPath(station, "ConnectedNetwork")
+		networkStatus.WifiSSID = variantString(objects[connected][iwdNetworkIface], "Name")
+		if networkStatus.IPs.WifiState == "online" {
+			networkStatus.IPs.WifiIPv4Method = nm.profileMethod(networkStatus.WifiSSID)
+		}
+		if networkStatus.IPs.WifiState == "online" || len(networkStatus.IPs.WifiIPv6) > 0 {
+			networkStatus.IPs.WifiIPv6Method = nm.profileIPv6Method(networkStatus.WifiSSID)
+		}
+		if networks, err := nm.orderedNetworks(device, objects); err == nil {
+			for _, network := range networks {
+				if network.path == connected {
+					// iwd reports signal strength in 100 * dBm
+					networkStatus.SignalStr = rssiToQuality(int(network.signal) / 100)
+				}
+			}
+		}
+	}
+	if networkStatus.IPs.WifiState == "online" || networkStatus.IPs.EthState == "online" {
+		networkStatus.State = "Connected"
+		networkStatus.Connectivity = "Limited"
+		if pingTest(nm.runner, nm.settings) {
+			networkStatus.Connectivity = "Full"
+		}
+	}
+
+	nm.status = networkStatus
+	return networkStatus, nil
+}
+
+func (nm *iwdManager) modeFromObjects(objects iwdObjects) string {
+	device, deviceProps, err := nm.device(objects)
+	if err != nil {
+		return "unknown"
+	}
+	if variantString(deviceProps, "Mode") == "ap" {
+		return ModeAP
+	}
+	if variantString(objects[device][iwdStationIface], "State") == "connected" {
+		return ModeClient
+	}
+	return "inactive"
+}
+
+func (nm *iwdManager) currentMode() string {
+	objects, err := nm.objects()
+	if err != nil {
+		return "unknown"
+	}
+	return nm.modeFromObjects(objects)
+}
+
+func (nm *iwdManager) setDeviceMode(device dbus.ObjectPath, mode string) error {
+	return nm.object(device).SetProperty(iwdDeviceIface+".Mode", dbus.MakeVariant(mode))
+}
+
+// Switches between client and AP modes
+func (nm *iwdManager) SetWifiMode(mode string) error {
+	switch mode {
+	case ModeAP:
+		if nm.currentMode() == ModeAP {
+			return nil
+		}
+		if err := nm.startAP(); err != nil {
+			return err
+		}
+		nm.sleep(time.Second)
+		if nm.currentMode() != ModeAP {
+			return fmt.Errorf("mode change verification failed")
+		}
+	case ModeClient:
+		if err := nm.stopAP(); err != nil {
+			return fmt.Errorf("failed to disable AP mode: %v", err)
+		}
+	default:
+		return fmt.Errorf("unsupported mode: %s", mode)
+	}
+	return nil
+}
+
+func (nm *iwdManager) startAP() error {
+	objects, err := nm.objects()
+	if err != nil {
+		return err
+	}
+	device, _, err := nm.device(objects)
+	if err != nil {
+		return err
+	}
+	if err := nm.setDeviceMode(device, "ap"); err != nil {
+		return fmt.Errorf("failed to switch %s to ap mode: %v", nm.settings.WifiInterface, err)
+	}
+	if err := nm.object(device).Call(iwdAccessPointIface+".StartProfile", 0, nm.status.APSSID).Err; err != nil {
+		return fmt.Errorf("failed to start AP: %v", err)
+	}
+	return nil
+}
+
+func (nm *iwdManager) stopAP() error {
+	objects, err := nm.objects()
+	if err != nil {
+		return err
+	}
+	device, deviceProps, err := nm.device(objects)
+	if err != nil {
+		return err
+	}
+	if variantString(deviceProps, "Mode") != "ap" {
+		return nil
+	}
+	if err := nm.object(device).Call(iwdAccessPointIface+".Stop", 0).Err; err != nil {
+		return err
+	}
+	return nm.setDeviceMode(device, "station")
+}
+
+// Writes the iwd AP profile for the PiFi access point
+func (nm *iwdManager) SetupAPConnection() error {
+	dir := filepath.Join(nm.stateDir, "ap")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	// Remove AP profiles left behind by older versions, Optistok-AP-*
+	if stale, err := filepath.Glob(filepath.Join(dir, legacyAPPrefix+"*.ap")); err == nil {
+		for _, path := range stale {
+			if filepath.Base(path) != nm.status.APSSID+".ap" {
+				os.Remove(path)
+			}
+		}
+	}
+	profile := "[IPv4]\nAddress=10.42.0.1\nGateway=10.42.0.1\nNetmask=255.255.255.0\n"
+	if nm.settings.CaptiveDNS {
+		// Clients use the captive DNS responder on the AP address
+		profile += "DNSList=10.42.0.1\n"
+	}
+	if nm.settings.APPassphrase != "" {
+		// iwd access points only support WPA2-PSK
+		if nm.settings.APSecurity == APSecurityWPA3 {
+			return fmt.Errorf("iwd does not support WPA3 access points, use wpa2")
+		}
+		profile += "\n[Security]\nPassphrase=" + nm.settings.APPassphrase + "\n"
+	}
+	if err := os.WriteFile(filepath.Join(dir, nm.status.APSSID+".ap"), []byte(profile), 0o600); err != nil {
+		return fmt.Errorf("failed to create AP connection: %v", err)
+	}
+	return nil
+}
+
+// Scan for available networks, grouped by SSID
+func (nm *iwdManager) FindAvailableNetworks() ([]ScanResult, error) {
+	objects, err := nm.objects()
+	if err != nil {
+		return nil, err
+	}
+	device, _, err := nm.device(objects)
+	if err != nil {
+		return nil, err
+	}
+	if err := nm.object(device).Call(iwdStationIface+".Scan", 0).Err; err != nil {
+		// A scan already in progress is fine, its results are used below
+		if dbusErr, ok := err.(dbus.Error); !ok || dbusErr.Name != "net.connman.iwd.InProgress" {
+			return nil, fmt.Errorf("failed to initiate network scan: %v", err)
+		}
+	}
+	nm.sleep(2 * time.Second)
+	return nm.scanResults()
+}
+
+// Returns the networks found by the last scan without rescanning
+func (nm *iwdManager) scanResults() ([]ScanResult, error) {
+	objects, err := nm.objects()
+	if err != nil {
+		return nil, err
+	}
+	device, _, err := nm.device(objects)
+	if err != nil {
+		return nil, err
+	}
+	ordered, err := nm.orderedNetworks(device, objects)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list available networks: %v", err)
+	}
+	scanned := make([]scannedBSS, 0, len(ordered))
+	for _, network := range ordered {
+		props := objects[network.path][iwdNetworkIface]
+		security := iwdSecurity(variantString(props, "Type"))
+		inUse := variantBool(props, "Connected")
+		// iwd reports signal strength in 100 * dBm and doesn't expose the frequency
+		signal := rssiToQuality(int(network.signal) / 100)
+
+		// Older iwd versions don't list the access points of a network
+		var bssPaths []dbus.ObjectPath
+		if v, ok := props["ExtendedServiceSet"]; ok {
+			v.Store(&bssPaths)
+		}
+		if len(bssPaths) == 0 {
+			scanned = append(scanned, scannedBSS{network.name, newBSS("", signal, 0, security, inUse)})
+		}
+		for _, path := range bssPaths {
+			address := variantString(objects[path][iwdBSSIface], "Address")
+			scanned = append(scanned, scannedBSS{network.name, newBSS(address, signal, 0, security, inUse)})
+		}
+	}
+	return groupScanResults(scanned), nil
+}
+
+// Maps the iwd network type to a security type
+func iwdSecurity(networkType string) string {
+	switch networkType {
+	case "psk":
+		return SecurityWPA2PSK
+	case "8021x":
+		return SecurityEnterprise
+	case "wep":
+		return SecurityWEP
+	}
+	return SecurityOpen
+}
+
+// Returns a scan for resolveSecurity that accepts the requested WPA3-SAE or OWE. iwd
+// only reports psk and open networks, whichever of them the access point uses.
+func (nm *iwdManager) requestedScanResults(requested string) func() ([]ScanResult, error) {
+	advertised := func(reported string) string {
+		if reported == SecurityWPA2PSK && requested == SecurityWPA3SAE ||
+			reported == SecurityOpen && requested == SecurityOWE {
+			return requested
+		}
+		return reported
+	}
+	return func() ([]ScanResult, error) {
+		networks, err := nm.scanResults()
+		for i := range networks {
+			networks[i].Security = advertised(networks[i].Security)
+			for j := range networks[i].BSSIDs {
+				networks[i].BSSIDs[j].Security = advertised(networks[i].BSSIDs[j].Security)
+			}
+		}
+		return networks, err
+	}
+}
+
+// Returns the provisioning file name iwd uses for the SSID and security type
+func iwdProfileName(ssid, security string) string {
+	plain := ssid != ""
+	for _, r := range ssid {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == ' ' || r == '_' || r == '-') {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return ssid + "." + security
+	}
+	return "=" + hex.EncodeToString([]byte(ssid)) + "." + security
+}
+
+// Reads the passphrase from a provisioning file, if there is one
+func (nm *iwdManager) profilePassphrase(ssid string) string {
+	file, err := os.Open(filepath.Join(nm.stateDir, iwdProfileName(ssid, "psk")))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	// iwd adds the PreSharedKey derived from the passphrase, which is only used without one
+	var psk string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if value, ok := strings.CutPrefix(line, "Passphrase="); ok {
+			return value
+		}
+		if value, ok := strings.CutPrefix(line, "PreSharedKey="); ok {
+			psk = value
+		}
+	}
+	return psk
+}
+
+// Returns the path of the provisioning file of a network, or an empty string
+func (nm *iwdManager) profilePath(ssid string) string {
+	for _, security := range []string{"psk", "open", "8021x"} {
+		path := filepath.Join(nm.stateDir, iwdProfileName(ssid, security))
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// Returns the content of the provisioning file of a network, if there is one
+func (nm *iwdManager) readProfile(ssid string) string {
+	path := nm.profilePath(ssid)
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Returns the IPv4 method of a network, static when its profile sets an address
+func (nm *iwdManager) profileMethod(ssid string) string {
+	for _, line := range strings.Split(iniSection(nm.readProfile(ssid), "IPv4"), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "Address=") {
+			return IPMethodManual
+		}
+	}
+	return IPMethodAuto
+}
+
+// Returns the IPv6 method of a network from the [IPv6] section of its profile
+func (nm *iwdManager) profileIPv6Method(ssid string) string {
+	method := IPMethodAuto
+	for _, line := range strings.Split(iniSection(nm.readProfile(ssid), "IPv6"), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "Enabled=false":
+			return IPMethodDisabled
+		case strings.HasPrefix(line, "Address="):
+			method = IPMethodManual
+		}
+	}
+	return method
+}
+
+// Set the IPv4 configuration of a provisioned network. iwd applies it on the next
+// connection and only when its network configuration is enabled.
+func (nm *iwdManager) SetIPv4Config(ssid string, config IPv4Config) error {
+	if ssid == "" {
+		return fmt.Errorf("iwd does not manage %s", nm.settings.EthernetInterface)
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	section, err := iwdIPv4Section(config)
+	if err != nil {
+		return err
+	}
+	return nm.replaceProfileSection(ssid, "IPv4", section)
+}
+
+// Set the IPv6 configuration of a provisioned network. iwd applies it on the next
+// connection and only when IPv6 is enabled in its main configuration.
+func (nm *iwdManager) SetIPv6Config(ssid string, config IPv6Config) error {
+	if ssid == "" {
+		return fmt.Errorf("iwd does not manage %s", nm.settings.EthernetInterface)
+	}
+	section, err := iwdIPv6Section(config)
+	if err != nil {
+		return err
+	}
+	return nm.replaceProfileSection(ssid, "IPv6", section)
+}
+
+// Replaces the IPv4 or IPv6 section of the profile of a network
+func (nm *iwdManager) replaceProfileSection(ssid, name, section string) error {
+	path := nm.profilePath(ssid)
+	if path == "" {
+		return fmt.Errorf("failed to set %s configuration: connection %s not found", name, ssid)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to set %s configuration: %v", name, err)
+	}
+	profile := removeINISection(string(data), name) + section
+	if err := os.WriteFile(path, []byte(profile), 0o600); err != nil {
+		return fmt.Errorf("failed to set %s configuration: %v", name, err)
+	}
+	return nil
+}
+
+// Returns the [IPv4] section of a profile, empty for DHCP. See iwd.network(5).
+func iwdIPv4Section(config IPv4Config) (string, error) {
+	if err := config.Validate(); err != nil {
+		return "", err
+	}
+	if config.Method != IPMethodManual {
+		return "", nil
+	}
+	if len(config.Search) > 1 {
+		return "", fmt.Errorf("iwd supports a single search domain")
+	}
+	var section strings.Builder
+	fmt.Fprintf(&section, "\n[IPv4]\nAddress=%s\nNetmask=%s\n", config.ip(), config.netmask())
+	if config.Gateway != "" {
+		fmt.Fprintf(&section, "Gateway=%s\n", config.Gateway)
+	}
+	if len(config.DNS) > 0 {
+		fmt.Fprintf(&section, "DNS=%s\n", strings.Join(config.DNS, " "))
+	}
+	if len(config.Search) > 0 {
+		fmt.Fprintf(&section, "DomainName=%s\n", config.Search[0])
+	}
+	return section.String(), nil
+}
+
+// Returns the [IPv6] section of a profile, empty for automatic configuration
+func iwdIPv6Section(config IPv6Config) (string, error) {
+	if err := config.Validate(); err != nil {
+		return "", err
+	}
+	switch config.Method {
+	case IPMethodAuto:
+		return "", nil
+	case IPMethodDHCP:
+		return "", fmt.Errorf("iwd does not support DHCPv6 without router advertisements")
+	case IPMethodDisabled:
+		return "\n[IPv6]\nEnabled=false\n", nil
+	}
+	var section strings.Builder
+	fmt.Fprintf(&section, "\n[IPv6]\nAddress=%s\n", config.Address)
+	if config.Gateway != "" {
+		fmt.Fprintf(&section, "Gateway=%s\n", config.Gateway)
+	}
+	if len(config.DNS) > 0 {
+		fmt.Fprintf(&section, "DNS=%s\n", strings.Join(config.DNS, " "))
+	}
+	return section.String(), nil
+}
+
+// Returns a section of an ini style profile including its header, preceded by a blank line
+func iniSection(content, name string) string {
+	var section strings.Builder
+	inside := false
+	for _, line := range strings.Split(content, "\n") {
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "[") {
+			inside = trimmed == "["+name+"]"
+			if inside {
+				section.WriteString("\n")
+			}
+		}
+		if inside && strings.TrimSpace(line) != "" {
+			section.WriteString(line + "\n")
+		}
+	}
+	return section.String()
+}
+
+// Removes a section from an ini style profile
+func removeINISection(content, name string) string {
+	var kept []string
+	inside := false
+	for _, line := range strings.Split(content, "\n") {
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "[") {
+			inside = trimmed == "["+name+"]"
+		}
+		if !inside {
+			kept = append(kept, line)
+		}
+	}
+	return strings.TrimRight(strings.Join(kept, "\n"), "\n") + "\n"
+}
+
+func (nm *iwdManager) knownNetwork(objects iwdObjects, ssid string) (dbus.ObjectPath, map[string]dbus.Variant, bool) {
+	return objects.find(iwdKnownNetworkIface, func(props map[string]dbus.Variant) bool {
+		return variantString(props, "Name") == ssid
+	})
+}
+
+// Get a list of configured connections
+func (nm *iwdManager) GetConfiguredConnections() ([]ConnectionInfo, error) {
+	objects, err := nm.objects()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list configured connections: %v", err)
+	}
+	connections := make([]ConnectionInfo, 0)
+	for _, ifaces := range objects {
+		props, ok := ifaces[iwdKnownNetworkIface]
+		if !ok {
+			continue
+		}
+		name := variantString(props, "Name")
+		connections = append(connections, ConnectionInfo{
+			SSID:     name,
+			Password: nm.profilePassphrase(name),
+		})
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].SSID < connections[j].SSID })
+	return connections, nil
+}
+
+// Modify a connection if it exists, otherwise create a new one. iwd has no D-Bus API
+// for creating known networks, so they are provisioned through profile files.
+func (nm *iwdManager) ModifyNetworkConnection(conn ConnectionConfig) error {
+	ssid := conn.SSID
+	// The IP settings of an existing profile are kept unless they are replaced
+	existing := nm.readProfile(ssid)
+	ipv4, ipv6 := iniSection(existing, "IPv4"), iniSection(existing, "IPv6")
+	var err error
+	if conn.IPv4 != nil {
+		if ipv4, err = iwdIPv4Section(*conn.IPv4); err != nil {
+			return err
+		}
+	}
+	if conn.IPv6 != nil {
+		if ipv6, err = iwdIPv6Section(*conn.IPv6); err != nil {
+			return err
+		}
+	}
+	// Like the other backends, an 802.1X profile keeps its settings unless new ones are given
+	keepEnterprise := conn.Enterprise == nil && (conn.keepsSecurity() || conn.Security == SecurityEnterprise) &&
+		nm.profilePath(ssid) == filepath.Join(nm.stateDir, iwdProfileName(ssid, "8021x"))
+	if keepEnterprise {
+		conn.Security = SecurityEnterprise
+	} else {
+		if conn.Password == "" {
+			conn.Password = nm.profilePassphrase(ssid)
+		}
+		if err := resolveSecurity(&conn, nm.requestedScanResults(conn.Security)); err != nil {
+			return err
+		}
+	}
+
+	// iwd picks SAE for psk profiles and OWE for open profiles when the AP supports it
+	security := "open"
+	var profile strings.Builder
+	fmt.Fprintf(&profile, "[Settings]\nAutoConnect=%t\n", conn.AutoConnect)
+	if conn.Hidden {
+		profile.WriteString("Hidden=true\n")
+	}
+	switch {
+	case keepEnterprise:
+		security = "8021x"
+		profile.WriteString(iniSection(existing, "Security"))
+	case conn.Security == SecurityEnterprise:
+		security = "8021x"
+		if err := nm.writeEnterprise(&profile, ssid, conn.Enterprise); err != nil {
+			return err
+		}
+	case conn.Security == SecurityWPA2PSK, conn.Security == SecurityWPA3SAE:
+		security = "psk"
+		// resolveSecurity rejected line breaks, which would add keys or sections to the profile
+		if hexPSK(conn.Password) {
+			fmt.Fprintf(&profile, "\n[Security]\nPreSharedKey=%s\n", conn.Password)
+		} else {
+			fmt.Fprintf(&profile, "\n[Security]\nPassphrase=%s\n", conn.Password)
+		}
+	}
+	profile.WriteString(ipv4)
+	profile.WriteString(ipv6)
+	if err := os.MkdirAll(nm.stateDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create connection: %v", err)
+	}
+	path := filepath.Join(nm.stateDir, iwdProfileName(ssid, security))
+	if err := os.WriteFile(path, []byte(profile.String()), 0o600); err != nil {
+		return fmt.Errorf("failed to create connection: %v", err)
+	}
+	// Profiles of the previous security type would shadow the new one
+	for _, other := range []string{"open", "psk", "8021x"} {
+		if other != security {
+			os.Remove(filepath.Join(nm.stateDir, iwdProfileName(ssid, other)))
+		}
+	}
+	return nil
+}
+
+// Writes the [Security] section of an 802.1X profile, see iwd.network(5)
+func (nm *iwdManager) writeEnterprise(profile *strings.Builder, ssid string, e *EnterpriseConfig) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	certs, err := writeCertificates(nm.settings.CertDir, ssid, e)
+	if err != nil {
+		return err
+	}
+	method := strings.ToUpper(e.EAP)
+	outerIdentity := e.Identity
+	if e.AnonymousIdentity != "" && e.EAP != EAPTLS {
+		outerIdentity = e.AnonymousIdentity
+	}
+	fmt.Fprintf(profile, "\n[Security]\nEAP-Method=%s\nEAP-Identity=%s\n", method, outerIdentity)
+	if certs.caCert != "" {
+		fmt.Fprintf(profile, "EAP-%s-CACert=%s\n", method, certs.caCert)
+	}
+	switch e.EAP {
+	case EAPTLS:
+		fmt.Fprintf(profile, "EAP-TLS-ClientCert=%s\nEAP-TLS-ClientKey=%s\n", certs.clientCert, certs.privateKey)
+		if e.PrivateKeyPassword != "" {
+			fmt.Fprintf(profile, "EAP-TLS-ClientKeyPassphrase=%s\n", e.PrivateKeyPassword)
+		}
+	default:
+		// TTLS uses the tunneled variants of the inner methods
+		phase2 := map[string]string{Phase2MSCHAPv2: "MSCHAPV2", Phase2GTC: "GTC", Phase2PAP: "PAP"}[e.Phase2]
+		if e.EAP == EAPTTLS {
+			phase2 = map[string]string{Phase2MSCHAPv2: "Tunneled-MSCHAPv2", Phase2PAP: "Tunneled-PAP"}[e.Phase2]
+		}
+		fmt.Fprintf(profile, "EAP-%s-Phase2-Method=%s\nEAP-%s-Phase2-Identity=%s\n", method, phase2, method, e.Identity)
+		if e.Password != "" {
+			fmt.Fprintf(profile, "EAP-%s-Phase2-Password=%s\n", method, e.Password)
+		}
+	}
+	return nil
+}
+
+// Remove a saved connection by name
+func (nm *iwdManager) RemoveNetworkConnection(ssid string) error {
+	objects, err := nm.objects()
+	if err != nil {
+		return fmt.Errorf("failed to delete connection: %v", err)
+	}
+	path, _, ok := nm.knownNetwork(objects, ssid)
+	if !ok {
+		return fmt.Errorf("failed to delete connection: %s is not a known network", ssid)
+	}
+	if err := nm.object(path).Call(iwdKnownNetworkIface+".Forget", 0).Err; err != nil {
+		return fmt.Errorf("failed to delete connection: %v", err)
+	}
+	return nil
+}
+
+// Set autoconnect for a saved connection by name
+func (nm *iwdManager) SetAutoConnectConnection(ssid string, autoConnect bool) error {
+	objects, err := nm.objects()
+	if err != nil {
+		return fmt.Errorf("failed to set autoconnect for %s: %v", ssid, err)
+	}
+	path, _, ok := nm.knownNetwork(objects, ssid)
+	if !ok {
+		return fmt.Errorf("failed to set autoconnect for %s: not a known network", ssid)
+	}
+	if err := nm.object(path).SetProperty(iwdKnownNetworkIface+".AutoConnect", dbus.MakeVariant(autoConnect)); err != nil {
+		return fmt.Errorf("failed to set autoconnect for %s: %v", ssid, err)
+	}
+	return nil
+}
+
+// Connect to a saved network by name. The AP name starts the access point instead.
+func (nm *iwdManager) ConnectNetwork(ssid string) error {
+	if ssid == nm.status.APSSID {
+		if err := nm.startAP(); err != nil {
+			return fmt.Errorf("failed to connect to %s: %v", ssid, err)
+		}
+		return nil
+	}
+	if err := nm.stopAP(); err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", ssid, err)
+	}
+
+	objects, err := nm.objects()
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", ssid, err)
+	}
+	path, _, ok := objects.find(iwdNetworkIface, func(props map[string]dbus.Variant) bool {
+		return variantString(props, "Name") == ssid
+	})
+	if !ok {
+		// Hidden networks only show up once they are probed for
+		device, _, err := nm.device(objects)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %v", ssid, err)
+		}
+		if err := nm.object(device).Call(iwdStationIface+".ConnectHiddenNetwork", 0, ssid).Err; err != nil {
+			return fmt.Errorf("failed to connect to %s: network not in range: %v", ssid, err)
+		}
+		return nil
+	}
+	if err := nm.object(path).Call(iwdNetworkIface+".Connect", 0).Err; err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", ssid, err)
+	}
+	return nil
+}
+
+// Enable the AP if there's no internet connection for a certain amount of time. This will run in the background.
+func (nm *iwdManager) ManageOfflineAP(connectionLossTimeout time.Duration) error {
+	return manageOfflineAP(nm, nm.sleep, nm.settings.PollInterval, connectionLossTimeout)
+}
+
+// Returns ModeAP, ModeClient or the state of the wifi interface
+func (nm *iwdManager) GetWifiMode() string {
+	return nm.currentMode()
+}
+
+// List the clients of the access point. iwd serves DHCP itself, so addresses come from the neighbour table.
+func (nm *iwdManager) GetAPClients() ([]APClient, error) {
+	if nm.currentMode() != ModeAP {
+		return []APClient{}, nil
+	}
+	return apClients(nm.runner, nm.settings.WifiInterface, "")
+}
+
+// Disconnect a client from the access point
+func (nm *iwdManager) DisconnectAPClient(mac string) error {
+	if nm.currentMode() != ModeAP {
+		return fmt.Errorf("failed to disconnect %s: not in AP mode", mac)
+	}
+	return disconnectAPClient(nm.runner, nm.settings.WifiInterface, mac)
+}
+
+// Answer DNS queries of AP clients with the AP address while AP mode is active. This will run in the background.
+func (nm *iwdManager) ManageCaptiveDNS() error {
+	return manageCaptiveDNS(nm, nm.runner, nm.settings, nm.sleep)
+}
+
+func (nm *iwdManager) wlanOnline() bool {
+	if nm.currentMode() != ModeClient {
+		return false
+	}
+	return pingTest(nm.runner, nm.settings)
+}
+
+func (nm *iwdManager) enableAP() error {
+	return nm.ConnectNetwork(nm.status.APSSID)
+}
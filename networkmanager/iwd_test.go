@@ -0,0 +1,573 @@
+package networkmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const (
+	fakeIWDAdapter   = dbus.ObjectPath("/net/connman/iwd/0")
+	fakeIWDDevice    = dbus.ObjectPath("/net/connman/iwd/0/4")
+	fakeIWDHome      = dbus.ObjectPath("/net/connman/iwd/0/4/486f6d6557696669_psk")
+	fakeIWDNeighbour = dbus.ObjectPath("/net/connman/iwd/0/4/4e65696768626f7572_open")
+	fakeIWDKnownHome = dbus.ObjectPath("/net/connman/iwd/486f6d6557696669_psk")
+)
+
+// fakeIWD mimics the subset of the net.connman.iwd object tree used by iwdManager.
+type fakeIWD struct {
+	t    *testing.T
+	conn *dbus.Conn
+
+	mu        sync.Mutex
+	objects   map[dbus.ObjectPath]*prop.Properties
+	ifaces    map[dbus.ObjectPath][]string
+	scanBusy  bool
+	connected []dbus.ObjectPath
+	hidden    []string
+	started   string
+}
+
+type fakeIWDManager struct{ iwd *fakeIWD }
+type fakeIWDStation struct{ iwd *fakeIWD }
+type fakeIWDAccessPoint struct{ iwd *fakeIWD }
+type fakeIWDNetwork struct {
+	iwd  *fakeIWD
+	path dbus.ObjectPath
+}
+type fakeIWDKnownNetwork struct {
+	iwd  *fakeIWD
+	path dbus.ObjectPath
+}
+
+func newFakeIWD(t *testing.T, conn *dbus.Conn) *fakeIWD {
+	t.Helper()
+	iwd := &fakeIWD{
+		t:       t,
+		conn:    conn,
+		objects: make(map[dbus.ObjectPath]*prop.Properties),
+		ifaces:  make(map[dbus.ObjectPath][]string),
+	}
+	iwd.export(fakeIWDManager{iwd}, "/", "org.freedesktop.DBus.ObjectManager")
+
+	iwd.add(fakeIWDAdapter, prop.Map{
+		iwdAdapterIface: {
+			"Name":    {Value: "phy0"},
+			"Powered": {Value: true},
+		},
+	})
+	iwd.add(fakeIWDDevice, prop.Map{
+		iwdDeviceIface: {
+			"Name":    {Value: "wlan0"},
+			"Powered": {Value: true},
+			"Adapter": {Value: fakeIWDAdapter},
+			"Mode":    {Value: "station", Writable: true},
+		},
+		iwdStationIface: {
+			"State":            {Value: "connected"},
+			"ConnectedNetwork": {Value: fakeIWDHome},
+			"Scanning":         {Value: false},
+		},
+	})
+	iwd.export(fakeIWDStation{iwd}, fakeIWDDevice, iwdStationIface)
+	iwd.export(fakeIWDAccessPoint{iwd}, fakeIWDDevice, iwdAccessPointIface)
+
+	for path, network := range map[dbus.ObjectPath][2]string{
+		fakeIWDHome:      {"HomeWifi", "psk"},
+		fakeIWDNeighbour: {"Neighbour", "open"},
+	} {
+		iwd.add(path, prop.Map{
+			iwdNetworkIface: {
+				"Name":      {Value: network[0]},
+				"Type":      {Value: network[1]},
+				"Device":    {Value: fakeIWDDevice},
+				"Connected": {Value: path == fakeIWDHome},
+			},
+		})
+		iwd.export(fakeIWDNetwork{iwd, path}, path, iwdNetworkIface)
+	}
+	iwd.add(fakeIWDKnownHome, prop.Map{
+		iwdKnownNetworkIface: {
+			"Name":        {Value: "HomeWifi"},
+			"Type":        {Value: "psk"},
+			"AutoConnect": {Value: true, Writable: true},
+		},
+	})
+	iwd.export(fakeIWDKnownNetwork{iwd, fakeIWDKnownHome}, fakeIWDKnownHome, iwdKnownNetworkIface)
+
+	reply, err := conn.RequestName(iwdBusName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("requesting %s: %v", iwdBusName, err)
+	}
+	return iwd
+}
+
+func (iwd *fakeIWD) export(v interface{}, path dbus.ObjectPath, iface string) {
+	if err := iwd.conn.Export(v, path, iface); err != nil {
+		iwd.t.Fatal(err)
+	}
+}
+
+func (iwd *fakeIWD) add(path dbus.ObjectPath, props prop.Map) {
+	p, err := prop.Export(iwd.conn, path, props)
+	if err != nil {
+		iwd.t.Fatal(err)
+	}
+	iwd.mu.Lock()
+	defer iwd.mu.Unlock()
+	iwd.objects[path] = p
+	for iface := range props {
+		iwd.ifaces[path] = append(iwd.ifaces[path], iface)
+	}
+}
+
+func (iwd *fakeIWD) get(path dbus.ObjectPath, iface, name string) interface{} {
+	iwd.mu.Lock()
+	defer iwd.mu.Unlock()
+	return iwd.objects[path].GetMust(iface, name)
+}
+
+func (iwd *fakeIWD) state() (connected []dbus.ObjectPath, started string) {
+	iwd.mu.Lock()
+	defer iwd.mu.Unlock()
+	return append([]dbus.ObjectPath(nil), iwd.connected...), iwd.started
+}
+
+func (m fakeIWDManager) GetManagedObjects() (map[dbus.ObjectPath]map[string]map[string]dbus.Variant, *dbus.Error) {
+	m.iwd.mu.Lock()
+	defer m.iwd.mu.Unlock()
+	objects := make(map[dbus.ObjectPath]map[string]map[string]dbus.Variant)
+	for path, p := range m.iwd.objects {
+		objects[path] = make(map[string]map[string]dbus.Variant)
+		for _, iface := range m.iwd.ifaces[path] {
+			props, err := p.GetAll(iface)
+			if err != nil {
+				return nil, err
+			}
+			objects[path][iface] = props
+		}
+	}
+	return objects, nil
+}
+
+func (s fakeIWDStation) Scan() *dbus.Error {
+	s.iwd.mu.Lock()
+	defer s.iwd.mu.Unlock()
+	if s.iwd.scanBusy {
+		return dbus.NewError("net.connman.iwd.InProgress", []interface{}{"Operation already in progress"})
+	}
+	return nil
+}
+
+func (s fakeIWDStation) ConnectHiddenNetwork(ssid string) *dbus.Error {
+	s.iwd.mu.Lock()
+	defer s.iwd.mu.Unlock()
+	if ssid != "Hidden" {
+		return dbus.NewError("net.connman.iwd.NotFound", []interface{}{"Not found"})
+	}
+	s.iwd.hidden = append(s.iwd.hidden, ssid)
+	return nil
+}
+
+func (s fakeIWDStation) GetOrderedNetworks() ([]struct {
+	Path   dbus.ObjectPath
+	Signal int16
+}, *dbus.Error) {
+	return []struct {
+		Path   dbus.ObjectPath
+		Signal int16
+	}{{fakeIWDHome, -6400}, {fakeIWDNeighbour, -7800}}, nil
+}
+
+func (a fakeIWDAccessPoint) StartProfile(ssid string) *dbus.Error {
+	a.iwd.mu.Lock()
+	defer a.iwd.mu.Unlock()
+	a.iwd.started = ssid
+	return nil
+}
+
+func (a fakeIWDAccessPoint) Stop() *dbus.Error {
+	a.iwd.mu.Lock()
+	defer a.iwd.mu.Unlock()
+	a.iwd.started = ""
+	return nil
+}
+
+func (n fakeIWDNetwork) Connect() *dbus.Error {
+	n.iwd.mu.Lock()
+	defer n.iwd.mu.Unlock()
+	n.iwd.connected = append(n.iwd.connected, n.path)
+	return nil
+}
+
+func (k fakeIWDKnownNetwork) Forget() *dbus.Error {
+	k.iwd.mu.Lock()
+	defer k.iwd.mu.Unlock()
+	delete(k.iwd.objects, k.path)
+	delete(k.iwd.ifaces, k.path)
+	return nil
+}
+
+func newTestIWDManager(t *testing.T, runner *FakeRunner) (*iwdManager, *fakeIWD) {
+	service, client := startTestBus(t)
+	fake := newFakeIWD(t, service)
+	return &iwdManager{
+		conn:     client,
+		status:   NetworkStatus{APSSID: testAPSSID},
+		settings: DefaultSettings(),
+		runner:   runner,
+		sleep:    func(time.Duration) {},
+		stateDir: t.TempDir(),
+	}, fake
+}
+
+func TestIWDGetNetworkStatus(t *testing.T) {
+	runner := NewFakeRunner().
+		On("ip -4 -o addr show dev wlan0", recorded(t, "ip_addr_wlan0.txt"), nil).
+		On("ip -4 -o addr show dev eth0", "", nil).
+		On("ping -I wlan0 -c 1 -W 2 1.1.1.1", recorded(t, "ping_ok.txt"), nil)
+	nm, _ := newTestIWDManager(t, runner)
+
+	status, err := nm.GetNetworkStatus()
+	if err != nil {
+		t.Fatalf("GetNetworkStatus: %v", err)
+	}
+	want := NetworkStatus{
+		State:        "Connected",
+		Connectivity: "Full",
+		WifiHW:       "Enabled",
+		Wifi:         "Enabled",
+		WifiSSID:     "HomeWifi",
+		APSSID:       testAPSSID,
+		SignalStr:    72,
+		Mode:         ModeClient,
+		IPs: NetworkIPs{
+			WifiIP:         "192.168.1.23",
+			WifiState:      "online",
+			WifiIPv4Method: IPMethodAuto,
+			WifiIPv6Method: IPMethodAuto,
+			EthState:       "offline",
+		},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("GetNetworkStatus() = %+v, want %+v", status, want)
+	}
+}
+
+func TestIWDFindAvailableNetworks(t *testing.T) {
+	nm, fake := newTestIWDManager(t, NewFakeRunner())
+	fake.mu.Lock()
+	fake.scanBusy = true
+	fake.mu.Unlock()
+
+	networks, err := nm.FindAvailableNetworks()
+	if err != nil {
+		t.Fatalf("FindAvailableNetworks: %v", err)
+	}
+	if len(networks) != 2 || networks[0].SSID != "HomeWifi" || networks[1].SSID != "Neighbour" {
+		t.Fatalf("FindAvailableNetworks() = %+v, want [HomeWifi Neighbour]", networks)
+	}
+	if !networks[0].InUse || networks[0].Security != SecurityWPA2PSK || networks[1].Security != SecurityOpen {
+		t.Errorf("FindAvailableNetworks() = %+v, want connected WPA2 HomeWifi and open Neighbour", networks)
+	}
+}
+
+func TestIWDModifyNetworkConnection(t *testing.T) {
+	nm, _ := newTestIWDManager(t, NewFakeRunner())
+
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Office", Password: "hunter22", AutoConnect: true}); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	profile, err := os.ReadFile(filepath.Join(nm.stateDir, "Office.psk"))
+	if err != nil {
+		t.Fatalf("reading profile: %v", err)
+	}
+	if !strings.Contains(string(profile), "Passphrase=hunter22") || !strings.Contains(string(profile), "AutoConnect=true") {
+		t.Errorf("profile = %q, want passphrase and autoconnect", profile)
+	}
+
+	// Updating without a password keeps the stored passphrase
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Office"}); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	if got := nm.profilePassphrase("Office"); got != "hunter22" {
+		t.Errorf("passphrase = %q, want hunter22", got)
+	}
+
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Café", AutoConnect: true}); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(nm.stateDir, "=436166c3a9.open")); err != nil {
+		t.Errorf("expected hex encoded open profile: %v", err)
+	}
+}
+
+func TestIWDModifyNetworkConnectionPSK(t *testing.T) {
+	nm, _ := newTestIWDManager(t, NewFakeRunner())
+
+	err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Office", Password: "hunter22\n[IPv4]\nAddress=10.0.0.1"})
+	if err == nil {
+		t.Error("expected an error for a password with a line break")
+	}
+	if _, err := os.Stat(filepath.Join(nm.stateDir, "Office.psk")); err == nil {
+		t.Error("profile written for an invalid password")
+	}
+
+	key := strings.Repeat("0f1e", 16)
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Office", Password: key}); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	profile, err := os.ReadFile(filepath.Join(nm.stateDir, "Office.psk"))
+	if err != nil {
+		t.Fatalf("reading profile: %v", err)
+	}
+	if !strings.Contains(string(profile), "\nPreSharedKey="+key+"\n") || strings.Contains(string(profile), "Passphrase=") {
+		t.Errorf("profile = %q, want the hex key as PreSharedKey", profile)
+	}
+	// Updating without a password keeps the key
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Office"}); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	if got := nm.profilePassphrase("Office"); got != key {
+		t.Errorf("key = %q, want %q", got, key)
+	}
+}
+
+func TestIWDModifyNetworkConnectionSecurity(t *testing.T) {
+	nm, _ := newTestIWDManager(t, NewFakeRunner())
+
+	// iwd reports WPA3 networks as psk and OWE networks as open
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "HomeWifi", Password: "hunter22", Security: SecurityWPA3SAE}); err != nil {
+		t.Fatalf("ModifyNetworkConnection(WPA3-SAE): %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(nm.stateDir, "HomeWifi.psk")); err != nil {
+		t.Errorf("expected psk profile: %v", err)
+	}
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Neighbour", Security: SecurityOWE}); err != nil {
+		t.Fatalf("ModifyNetworkConnection(OWE): %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(nm.stateDir, "Neighbour.open")); err != nil {
+		t.Errorf("expected open profile: %v", err)
+	}
+
+	err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Neighbour", Password: "hunter22", Security: SecurityWPA3SAE})
+	if !errors.Is(err, ErrSecurityMismatch) {
+		t.Errorf("WPA3-SAE for an open network: err = %v, want ErrSecurityMismatch", err)
+	}
+	err = nm.ModifyNetworkConnection(ConnectionConfig{SSID: "HomeWifi", Security: SecurityOWE})
+	if !errors.Is(err, ErrSecurityMismatch) {
+		t.Errorf("OWE for a psk network: err = %v, want ErrSecurityMismatch", err)
+	}
+}
+
+func TestIWDModifyNetworkConnectionEnterprise(t *testing.T) {
+	nm, _ := newTestIWDManager(t, NewFakeRunner())
+	nm.settings.CertDir = t.TempDir()
+
+	err := nm.ModifyNetworkConnection(ConnectionConfig{
+		SSID: "Corp",
+		Enterprise: &EnterpriseConfig{
+			EAP:               EAPTTLS,
+			Identity:          "alice",
+			AnonymousIdentity: "anonymous",
+			Password:          "s3cret",
+			Phase2:            Phase2PAP,
+		},
+	})
+	if err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	profile, err := os.ReadFile(filepath.Join(nm.stateDir, "Corp.8021x"))
+	if err != nil {
+		t.Fatalf("reading profile: %v", err)
+	}
+	for _, line := range []string{
+		"EAP-Method=TTLS",
+		"EAP-Identity=anonymous",
+		"EAP-TTLS-Phase2-Method=Tunneled-PAP",
+		"EAP-TTLS-Phase2-Identity=alice",
+		"EAP-TTLS-Phase2-Password=s3cret",
+	} {
+		if !strings.Contains(string(profile), line+"\n") {
+			t.Errorf("profile = %q, want %s", profile, line)
+		}
+	}
+
+	// Updating without enterprise settings keeps the stored ones
+	for _, update := range []ConnectionConfig{
+		{SSID: "Corp", AutoConnect: true},
+		{SSID: "Corp", Security: SecurityEnterprise},
+	} {
+		if err := nm.ModifyNetworkConnection(update); err != nil {
+			t.Fatalf("ModifyNetworkConnection(%+v): %v", update, err)
+		}
+		updated, err := os.ReadFile(filepath.Join(nm.stateDir, "Corp.8021x"))
+		if err != nil {
+			t.Fatalf("reading profile: %v", err)
+		}
+		if got, want := iniSection(string(updated), "Security"), iniSection(string(profile), "Security"); got != want {
+			t.Errorf("[Security] after %+v = %q, want %q", update, got, want)
+		}
+		if update.AutoConnect != strings.Contains(string(updated), "AutoConnect=true") {
+			t.Errorf("profile = %q, want AutoConnect=%t", updated, update.AutoConnect)
+		}
+	}
+}
+
+func TestIWDSetIPv4Config(t *testing.T) {
+	nm, _ := newTestIWDManager(t, NewFakeRunner())
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Office", Password: "hunter22"}); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+
+	err := nm.SetIPv4Config("Office", IPv4Config{
+		Method:  IPMethodManual,
+		Address: "192.168.1.50/24",
+		Gateway: "192.168.1.1",
+		DNS:     []string{"1.1.1.1", "9.9.9.9"},
+	})
+	if err != nil {
+		t.Fatalf("SetIPv4Config: %v", err)
+	}
+	if method := nm.profileMethod("Office"); method != IPMethodManual {
+		t.Errorf("profileMethod() = %q, want manual", method)
+	}
+
+	// Updating the network keeps its IPv4 section
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Office", AutoConnect: true}); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	profile, _ := os.ReadFile(filepath.Join(nm.stateDir, "Office.psk"))
+	want := "[Settings]\nAutoConnect=true\n\n[Security]\nPassphrase=hunter22\n" +
+		"\n[IPv4]\nAddress=192.168.1.50\nNetmask=255.255.255.0\nGateway=192.168.1.1\nDNS=1.1.1.1 9.9.9.9\n"
+	if string(profile) != want {
+		t.Errorf("profile = %q, want %q", profile, want)
+	}
+
+	if err := nm.SetIPv4Config("Office", IPv4Config{Method: IPMethodAuto}); err != nil {
+		t.Fatalf("SetIPv4Config (dhcp): %v", err)
+	}
+	if method := nm.profileMethod("Office"); method != IPMethodAuto {
+		t.Errorf("profileMethod() = %q, want auto", method)
+	}
+	if err := nm.SetIPv4Config("", IPv4Config{Method: IPMethodAuto}); err == nil {
+		t.Error("expected an error for the Ethernet interface")
+	}
+}
+
+func TestIWDSetIPv6Config(t *testing.T) {
+	nm, _ := newTestIWDManager(t, NewFakeRunner())
+	conn := ConnectionConfig{SSID: "Office", Password: "hunter22", IPv4: &IPv4Config{Method: IPMethodManual, Address: "192.168.1.50/24"}}
+	if err := nm.ModifyNetworkConnection(conn); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+
+	err := nm.SetIPv6Config("Office", IPv6Config{Method: IPMethodManual, Address: "2001:db8::50/64", Gateway: "fe80::1"})
+	if err != nil {
+		t.Fatalf("SetIPv6Config: %v", err)
+	}
+	if method := nm.profileIPv6Method("Office"); method != IPMethodManual {
+		t.Errorf("profileIPv6Method() = %q, want manual", method)
+	}
+
+	// Updating the network keeps both IP sections
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Office"}); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	profile, _ := os.ReadFile(filepath.Join(nm.stateDir, "Office.psk"))
+	want := "[Settings]\nAutoConnect=false\n\n[Security]\nPassphrase=hunter22\n" +
+		"\n[IPv4]\nAddress=192.168.1.50\nNetmask=255.255.255.0\n" +
+		"\n[IPv6]\nAddress=2001:db8::50/64\nGateway=fe80::1\n"
+	if string(profile) != want {
+		t.Errorf("profile = %q, want %q", profile, want)
+	}
+
+	if err := nm.SetIPv6Config("Office", IPv6Config{Method: IPMethodDisabled}); err != nil {
+		t.Fatalf("SetIPv6Config (disabled): %v", err)
+	}
+	if method := nm.profileIPv6Method("Office"); method != IPMethodDisabled {
+		t.Errorf("profileIPv6Method() = %q, want disabled", method)
+	}
+	if err := nm.SetIPv6Config("Office", IPv6Config{Method: IPMethodDHCP}); err == nil {
+		t.Error("expected an error for DHCPv6 only")
+	}
+}
+
+func TestIWDKnownNetworks(t *testing.T) {
+	nm, fake := newTestIWDManager(t, NewFakeRunner())
+
+	connections, err := nm.GetConfiguredConnections()
+	if err != nil {
+		t.Fatalf("GetConfiguredConnections: %v", err)
+	}
+	if len(connections) != 1 || connections[0].SSID != "HomeWifi" {
+		t.Fatalf("GetConfiguredConnections() = %v, want HomeWifi", connections)
+	}
+
+	if err := nm.SetAutoConnectConnection("HomeWifi", false); err != nil {
+		t.Fatalf("SetAutoConnectConnection: %v", err)
+	}
+	if fake.get(fakeIWDKnownHome, iwdKnownNetworkIface, "AutoConnect") != false {
+		t.Error("AutoConnect was not disabled")
+	}
+
+	if err := nm.RemoveNetworkConnection("HomeWifi"); err != nil {
+		t.Fatalf("RemoveNetworkConnection: %v", err)
+	}
+	if connections, _ := nm.GetConfiguredConnections(); len(connections) != 0 {
+		t.Errorf("GetConfiguredConnections() = %v after forgetting, want none", connections)
+	}
+}
+
+func TestIWDHiddenNetwork(t *testing.T) {
+	nm, fake := newTestIWDManager(t, NewFakeRunner())
+
+	if err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Hidden", Password: "hunter22", Hidden: true}); err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	profile, err := os.ReadFile(filepath.Join(nm.stateDir, "Hidden.psk"))
+	if err != nil || !strings.Contains(string(profile), "Hidden=true\n") {
+		t.Errorf("profile = %q, %v; want Hidden=true", profile, err)
+	}
+
+	if err := nm.ConnectNetwork("Hidden"); err != nil {
+		t.Fatalf("ConnectNetwork: %v", err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.hidden) != 1 || fake.hidden[0] != "Hidden" {
+		t.Errorf("hidden connects = %v, want [Hidden]", fake.hidden)
+	}
+}
+
+func TestIWDConnectAndAPMode(t *testing.T) {
+	nm, fake := newTestIWDManager(t, NewFakeRunner())
+
+	if err := nm.ConnectNetwork("Neighbour"); err != nil {
+		t.Fatalf("ConnectNetwork: %v", err)
+	}
+	if connected, _ := fake.state(); len(connected) != 1 || connected[0] != fakeIWDNeighbour {
+		t.Errorf("connected = %v, want Neighbour", connected)
+	}
+
+	if err := nm.SetWifiMode(ModeAP); err != nil {
+		t.Fatalf("SetWifiMode(ap): %v", err)
+	}
+	if _, started := fake.state(); started != testAPSSID {
+		t.Errorf("started AP profile = %q, want %q", started, testAPSSID)
+	}
+	if err := nm.SetWifiMode(ModeClient); err != nil {
+		t.Fatalf("SetWifiMode(client): %v", err)
+	}
+	if fake.get(fakeIWDDevice, iwdDeviceIface, "Mode") != "station" {
+		t.Error("device was not switched back to station mode")
+	}
+}
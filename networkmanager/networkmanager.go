@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,8 +34,18 @@ type NetworkIPs struct {
 	WifiState  string
 	EthernetIP string
 	EthState   string
-	APIP       string
-	APState    string
+	// IPv4 method of the active connections, IPMethodAuto or IPMethodManual
+	WifiIPv4Method string
+	EthIPv4Method  string
+	// Global IPv6 addresses with prefix length and the IPv6 method of the active connections
+	WifiIPv6       []string
+	EthIPv6        []string
+	WifiIPv6Method string
+	EthIPv6Method  string
+	// Gateway of the IPv6 default route
+	IPv6Gateway string
+	APIP        string
+	APState     string
 }
 
 type ConnectionInfo struct {
@@ -46,29 +56,50 @@ type ConnectionInfo struct {
 type NetworkManager interface {
 	SetupAPConnection() error
 	ManageOfflineAP(connectionLossTimeout time.Duration) error
+	ManageCaptiveDNS() error
 
 	// Network Status
 	GetNetworkStatus() (NetworkStatus, error)
+	// GetWifiMode is a cheaper way to get the Mode of the status
+	GetWifiMode() string
 	SetWifiMode(mode string) error
 
+	// Access Point Clients
+	GetAPClients() ([]APClient, error)
+	DisconnectAPClient(mac string) error
+
 	// Network Configuration
-	FindAvailableNetworks() ([]string, error)
+	FindAvailableNetworks() ([]ScanResult, error)
 	GetConfiguredConnections() ([]ConnectionInfo, error)
-	ModifyNetworkConnection(ssid, password string, autoConnect bool) error
+	ModifyNetworkConnection(conn ConnectionConfig) error
 	RemoveNetworkConnection(ssid string) error
 	SetAutoConnectConnection(ssid string, autoConnect bool) error
 	ConnectNetwork(ssid string) error
+	// An empty SSID configures the Ethernet connection
+	SetIPv4Config(ssid string, config IPv4Config) error
+	SetIPv6Config(ssid string, config IPv6Config) error
 }
 
 type networkManager struct {
-	status NetworkStatus
+	status   NetworkStatus
+	settings Settings
+	runner   CommandRunner
+	sleep    func(time.Duration)
 }
 
-func New() NetworkManager {
+// New returns a NetworkManager that drives nmcli through the given runner.
+// A nil runner executes commands on the host.
+func New(settings Settings, runner CommandRunner) NetworkManager {
+	if runner == nil {
+		runner = ExecRunner{}
+	}
 	nm := &networkManager{
 		status: NetworkStatus{
-			APSSID: "Optistok-AP-" + randSeq(4),
+			APSSID: settings.apSSID(),
 		},
+		settings: settings,
+		runner:   runner,
+		sleep:    time.Sleep,
 	}
 	nm.GetNetworkStatus()
 	return nm
@@ -84,8 +115,7 @@ func randSeq(n int) string {
 }
 
 func (nm *networkManager) GetNetworkStatus() (NetworkStatus, error) {
-	cmd := exec.Command("nmcli", "g")
-	output, err := cmd.Output()
+	output, err := nm.output("nmcli", "g")
 	if err != nil {
 		return nm.status, err
 	}
@@ -117,10 +147,10 @@ func (nm *networkManager) GetNetworkStatus() (NetworkStatus, error) {
 		Connectivity: setCase.String(connectivity),
 		WifiHW:       setCase.String(wifiHW),
 		Wifi:         setCase.String(wifi),
-		WifiSSID:     getWifiSSID(),
-		SignalStr:    getWifiSignal(),
-		Mode:         getWifiMode(nm.status.APSSID),
-		IPs:          getNetworkIps(),
+		WifiSSID:     nm.getWifiSSID(),
+		SignalStr:    nm.getWifiSignal(),
+		Mode:         nm.getWifiMode(nm.status.APSSID),
+		IPs:          nm.getNetworkIps(),
 	}
 	nm.status = networkStatus
 	return networkStatus, nil
@@ -129,8 +159,7 @@ func (nm *networkManager) GetNetworkStatus() (NetworkStatus, error) {
 // Switches between client and AP modes
 func (nm *networkManager) SetWifiMode(mode string) error {
 	// Get current active connections
-	cmd := exec.Command("nmcli", "-t", "-f", "NAME,TYPE,DEVICE", "con", "show", "--active")
-	output, err := cmd.Output()
+	output, err := nm.output("nmcli", "-t", "-f", "NAME,TYPE,DEVICE", "con", "show", "--active")
 	if err != nil {
 		return fmt.Errorf("failed to get active connections: %v", err)
 	}
@@ -143,33 +172,31 @@ func (nm *networkManager) SetWifiMode(mode string) error {
 			return fmt.Errorf("must have active client connection for ap mode")
 		}
 		if !hasAP {
-			err = verifyAPConnection(nm.status.APSSID)
+			err = nm.verifyAPConnection(nm.status.APSSID)
 			if err != nil {
 				return err
 			}
-			cmd = exec.Command("nmcli", "con", "up", nm.status.APSSID)
-			output, err := cmd.CombinedOutput()
+			output, err := nm.combinedOutput("nmcli", "con", "up", nm.status.APSSID)
 			if err != nil {
 				return fmt.Errorf("failed to create AP connection: %v\nOutput: %s", err, output)
 			}
-			time.Sleep(time.Second)
-			newMode := getWifiMode(nm.status.APSSID)
+			nm.sleep(time.Second)
+			newMode := nm.getWifiMode(nm.status.APSSID)
 			if newMode != "ap" {
 				return fmt.Errorf("mode change verification failed")
 			}
 		}
 	case ModeClient:
 		if hasAP {
-			cmd = exec.Command("nmcli", "con", "down", nm.status.APSSID)
-			if err := cmd.Run(); err != nil {
+			if err := nm.run("nmcli", "con", "down", nm.status.APSSID); err != nil {
 				return fmt.Errorf("failed to disable AP mode: %v", err)
 			}
 		}
 		if !hasClient {
 			return fmt.Errorf("no active client connection")
 		}
-		time.Sleep(time.Second)
-		newMode := getWifiMode(nm.status.APSSID)
+		nm.sleep(time.Second)
+		newMode := nm.getWifiMode(nm.status.APSSID)
 		if newMode != "inactive" && newMode != "client" {
 			return fmt.Errorf("mode change verification failed")
 		}
@@ -180,76 +207,101 @@ func (nm *networkManager) SetWifiMode(mode string) error {
 	return nil
 }
 
-// Creates a new AP connection for wlan0 if it doesn't exist
+// Creates the AP connection for the wifi interface, or updates it when the SSID or passphrase changed
 func (nm *networkManager) SetupAPConnection() error {
-	// Check if AP connection already exists
-	cmd := exec.Command("nmcli", "connection", "show", nm.status.APSSID)
-	if err := cmd.Run(); err == nil {
-		return nil
+	exists := nm.run("nmcli", "connection", "show", nm.status.APSSID) == nil
+
+	// Remove AP profiles left behind by older versions, Optistok-AP-*
+	nm.removeExistingAPs()
+	if err := configureSharedDnsmasq(nm.settings); err != nil {
+		log.Println(err)
 	}
 
-	// Remove all existing AP interfaces, PiFi-AP-*
-	removeExistingAPs()
+	settings := []string{
+		"connection.autoconnect", "no",
+		"802-11-wireless.ssid", nm.status.APSSID,
+		"802-11-wireless.mode", "ap",
+		"802-11-wireless.band", "bg",
+		"ipv4.method", "shared",
+		"ipv6.method", "disabled",
+	}
+	switch {
+	case nm.settings.APPassphrase == "":
+	case nm.settings.APSecurity == APSecurityWPA3:
+		settings = append(settings,
+			"802-11-wireless-security.key-mgmt", "sae",
+			"802-11-wireless-security.psk", nm.settings.APPassphrase)
+	default:
+		settings = append(settings,
+			"802-11-wireless-security.key-mgmt", "wpa-psk",
+			"802-11-wireless-security.proto", "rsn",
+			"802-11-wireless-security.pairwise", "ccmp",
+			"802-11-wireless-security.group", "ccmp",
+			"802-11-wireless-security.psk", nm.settings.APPassphrase)
+	}
+
+	if exists {
+		// Drop the security setting first so switching between open and protected works
+		nm.run("nmcli", "connection", "modify", nm.status.APSSID, "remove", "802-11-wireless-security")
+		args := append([]string{"connection", "modify", nm.status.APSSID}, settings...)
+		if output, err := nm.combinedOutput("nmcli", args...); err != nil {
+			return fmt.Errorf("failed to update AP connection: %v\nOutput: %s", err, output)
+		}
+		return nil
+	}
 
 	// Create AP connection with required settings
-	cmd = exec.Command("nmcli", "connection", "add",
+	args := append([]string{"connection", "add",
 		"type", "wifi",
-		"ifname", "wlan0",
+		"ifname", nm.settings.WifiInterface,
 		"con-name", nm.status.APSSID,
-		"autoconnect", "no",
-		"ssid", nm.status.APSSID,
-		"mode", "ap",
-		"ipv4.method", "shared",
-		"ipv6.method", "disabled",
-		"802-11-wireless.band", "bg",
-	)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
+	}, settings...)
+	if output, err := nm.combinedOutput("nmcli", args...); err != nil {
 		return fmt.Errorf("failed to create AP connection: %v\nOutput: %s", err, output)
 	}
 
-	cmd = exec.Command("nmcli", "connection", "show", nm.status.APSSID)
-	if err := cmd.Run(); err != nil {
+	if err := nm.run("nmcli", "connection", "show", nm.status.APSSID); err != nil {
 		return fmt.Errorf("AP connection verification failed: %v", err)
 	}
 	return nil
 }
 
-// Scan for available networks and returns a list of SSIDs
-func (nm *networkManager) FindAvailableNetworks() ([]string, error) {
+// Scan for available networks, grouped by SSID
+func (nm *networkManager) FindAvailableNetworks() ([]ScanResult, error) {
 	// Perform a network rescan
-	scanCmd := exec.Command("nmcli", "device", "wifi", "rescan")
-	if err := scanCmd.Run(); err != nil {
+	if err := nm.run("nmcli", "device", "wifi", "rescan"); err != nil {
 		return nil, fmt.Errorf("failed to initiate network scan: %v", err)
 	}
-	time.Sleep(2 * time.Second)
+	nm.sleep(2 * time.Second)
+	return nm.scanResults()
+}
 
-	// List available networks
-	cmd := exec.Command("nmcli", "--fields", "SSID", "device", "wifi", "list", "--rescan", "yes")
-	output, err := cmd.Output()
+// Returns the networks found by the last scan without rescanning
+func (nm *networkManager) scanResults() ([]ScanResult, error) {
+	output, err := nm.output("nmcli", "-t", "-f", "IN-USE,SSID,BSSID,SIGNAL,FREQ,SECURITY", "device", "wifi", "list", "--rescan", "no")
 	if err != nil {
 		return nil, fmt.Errorf("failed to list available networks: %v", err)
 	}
 
-	seenNetworks := make(map[string]bool)
-	networks := make([]string, 0)
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		ssid := strings.TrimSpace(line)
-		if ssid != "" && ssid != "SSID" && !seenNetworks[ssid] {
-			seenNetworks[ssid] = true
-			networks = append(networks, ssid)
+	scanned := make([]scannedBSS, 0)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := splitTerse(line)
+		if len(fields) < 6 {
+			continue
 		}
+		signal, _ := strconv.ParseInt(fields[3], 10, 32)
+		freq, _ := strconv.ParseUint(strings.TrimSuffix(fields[4], " MHz"), 10, 32)
+		scanned = append(scanned, scannedBSS{
+			ssid: strings.TrimSpace(fields[1]),
+			BSS:  newBSS(fields[2], int32(signal), uint32(freq), nmcliSecurity(fields[5]), fields[0] == "*"),
+		})
 	}
-
-	return networks, nil
+	return groupScanResults(scanned), nil
 }
 
 // Get a list of configured connections
 func (nm *networkManager) GetConfiguredConnections() ([]ConnectionInfo, error) {
-	cmd := exec.Command("nmcli", "-t", "-f", "NAME,TYPE,DEVICE", "connection", "show")
-	output, err := cmd.Output()
+	output, err := nm.output("nmcli", "-t", "-f", "NAME,TYPE,DEVICE", "connection", "show")
 	if err != nil {
 		return nil, fmt.Errorf("failed to list configured connections: %v", err)
 	}
@@ -264,8 +316,7 @@ func (nm *networkManager) GetConfiguredConnections() ([]ConnectionInfo, error) {
 		fields := strings.Split(line, ":")
 		if len(fields) >= 2 && fields[1] == "802-11-wireless" {
 			connName := fields[0]
-			pskCmd := exec.Command("nmcli", "-t", "-f", "802-11-wireless-security.psk", "connection", "show", connName)
-			pskOutput, _ := pskCmd.Output()
+			pskOutput, _ := nm.output("nmcli", "-t", "-f", "802-11-wireless-security.psk", "connection", "show", connName)
 			password := strings.TrimSpace(string(pskOutput))
 			connections = append(connections, ConnectionInfo{
 				SSID:     connName,
@@ -278,21 +329,47 @@ func (nm *networkManager) GetConfiguredConnections() ([]ConnectionInfo, error) {
 }
 
 // Modify a connection if it exists, otherwise create a new one
-func (nm *networkManager) ModifyNetworkConnection(ssid, password string, autoConnect bool) error {
-	checkCmd := exec.Command("nmcli", "connection", "show", ssid)
-	if err := checkCmd.Run(); err == nil {
+func (nm *networkManager) ModifyNetworkConnection(conn ConnectionConfig) error {
+	var ipArgs []string
+	if conn.IPv4 != nil {
+		if err := conn.IPv4.Validate(); err != nil {
+			return err
+		}
+		ipArgs = ipv4Args(*conn.IPv4)
+	}
+	if conn.IPv6 != nil {
+		if err := conn.IPv6.Validate(); err != nil {
+			return err
+		}
+		ipArgs = append(ipArgs, ipv6Args(*conn.IPv6)...)
+	}
+	exists := nm.run("nmcli", "connection", "show", conn.SSID) == nil
+	keep := exists && conn.keepsSecurity()
+	var security []string
+	if !keep {
+		if err := resolveSecurity(&conn, nm.scanResults); err != nil {
+			return err
+		}
+		var err error
+		if security, err = nm.securityArgs(conn); err != nil {
+			return err
+		}
+	}
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	autoConnect := yesNo[conn.AutoConnect]
+
+	if exists {
 		// Connection exists - modify it
-		args := []string{"connection", "modify", ssid}
-		if password != "" {
-			args = append(args,
-				"802-11-wireless-security.key-mgmt", "wpa-psk",
-				"802-11-wireless-security.psk", password)
+		if !keep && conn.Security == SecurityOpen {
+			if output, err := nm.combinedOutput("nmcli", "connection", "modify", conn.SSID, "remove", "802-11-wireless-security"); err != nil {
+				return fmt.Errorf("failed to modify connection: %v\nOutput: %s", err, output)
+			}
 		}
-		args = append(args, "connection.autoconnect",
-			map[bool]string{true: "yes", false: "no"}[autoConnect])
+		args := append([]string{"connection", "modify", conn.SSID}, security...)
+		args = append(args, "connection.autoconnect", autoConnect, "802-11-wireless.hidden", yesNo[conn.Hidden])
+		args = append(args, ipArgs...)
 
-		cmd := exec.Command("nmcli", args...)
-		if output, err := cmd.CombinedOutput(); err != nil {
+		if output, err := nm.combinedOutput("nmcli", args...); err != nil {
 			return fmt.Errorf("failed to modify connection: %v\nOutput: %s", err, output)
 		}
 		return nil
@@ -302,30 +379,118 @@ func (nm *networkManager) ModifyNetworkConnection(ssid, password string, autoCon
 	args := []string{
 		"connection", "add",
 		"type", "wifi",
-		"ifname", "wlan0",
-		"con-name", ssid,
-		"autoconnect", map[bool]string{true: "yes", false: "no"}[autoConnect],
-		"ssid", ssid,
+		"ifname", nm.settings.WifiInterface,
+		"con-name", conn.SSID,
+		"autoconnect", autoConnect,
+		"ssid", conn.SSID,
 	}
-
-	if password != "" {
-		args = append(args,
-			"802-11-wireless-security.key-mgmt", "wpa-psk",
-			"802-11-wireless-security.psk", password)
+	if conn.Hidden {
+		args = append(args, "802-11-wireless.hidden", "yes")
 	}
+	args = append(args, security...)
+	args = append(args, ipArgs...)
 
-	cmd := exec.Command("nmcli", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := nm.combinedOutput("nmcli", args...); err != nil {
 		return fmt.Errorf("failed to create connection: %v\nOutput: %s", err, output)
 	}
 
 	return nil
 }
 
+// Set the IPv4 configuration of a saved connection. An active connection
+// is reapplied so the change takes effect immediately.
+func (nm *networkManager) SetIPv4Config(ssid string, config IPv4Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	return nm.modifyIPConfig(ssid, "IPv4", ipv4Args(config))
+}
+
+// Set the IPv6 configuration of a saved connection
+func (nm *networkManager) SetIPv6Config(ssid string, config IPv6Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	return nm.modifyIPConfig(ssid, "IPv6", ipv6Args(config))
+}
+
+// Modifies the IP settings of the connection of an SSID, or of the active
+// Ethernet connection, and reapplies them when the connection is active
+func (nm *networkManager) modifyIPConfig(ssid, family string, ipArgs []string) error {
+	name, iface := ssid, nm.settings.WifiInterface
+	if ssid == "" {
+		iface = nm.settings.EthernetInterface
+	}
+	active := nm.deviceConnection(iface)
+	if name == "" {
+		if name = active; name == "" {
+			return fmt.Errorf("no connection found for %s", iface)
+		}
+	}
+
+	args := append([]string{"connection", "modify", name}, ipArgs...)
+	if output, err := nm.combinedOutput("nmcli", args...); err != nil {
+		return fmt.Errorf("failed to set %s configuration: %v\nOutput: %s", family, err, output)
+	}
+	if active == name {
+		if output, err := nm.combinedOutput("nmcli", "device", "reapply", iface); err != nil {
+			return fmt.Errorf("failed to apply %s configuration: %v\nOutput: %s", family, err, output)
+		}
+	}
+	return nil
+}
+
+// Returns the nmcli arguments for the security settings of a connection
+func (nm *networkManager) securityArgs(conn ConnectionConfig) ([]string, error) {
+	switch conn.Security {
+	case SecurityOpen:
+		return nil, nil
+	case SecurityOWE:
+		return []string{"802-11-wireless-security.key-mgmt", "owe"}, nil
+	case SecurityWPA2PSK, SecurityWPA3SAE:
+		return []string{
+			"802-11-wireless-security.key-mgmt", keyMgmt[conn.Security],
+			"802-11-wireless-security.psk", conn.Password,
+		}, nil
+	}
+
+	e := conn.Enterprise
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	certs, err := writeCertificates(nm.settings.CertDir, conn.SSID, e)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"802-11-wireless-security.key-mgmt", "wpa-eap",
+		"802-1x.eap", e.EAP,
+		"802-1x.identity", e.Identity,
+		"802-1x.anonymous-identity", e.AnonymousIdentity,
+	}
+	if e.EAP != EAPTLS {
+		args = append(args, "802-1x.phase2-auth", e.Phase2)
+	}
+	if e.Password != "" {
+		args = append(args, "802-1x.password", e.Password)
+	}
+	if certs.caCert != "" {
+		args = append(args, "802-1x.ca-cert", certs.caCert)
+	}
+	if certs.clientCert != "" {
+		args = append(args, "802-1x.client-cert", certs.clientCert)
+	}
+	if certs.privateKey != "" {
+		args = append(args,
+			"802-1x.private-key", certs.privateKey,
+			"802-1x.private-key-password", e.PrivateKeyPassword)
+	}
+	return args, nil
+}
+
 // Remove a saved connection by name
 func (nm *networkManager) RemoveNetworkConnection(ssid string) error {
-	cmd := exec.Command("nmcli", "connection", "delete", ssid)
-	if err := cmd.Run(); err != nil {
+	if err := nm.run("nmcli", "connection", "delete", ssid); err != nil {
 		return fmt.Errorf("failed to delete connection: %v", err)
 	}
 	return nil
@@ -338,10 +503,8 @@ func (nm *networkManager) SetAutoConnectConnection(ssid string, autoConnect bool
 		autoConnectStr = "yes"
 	}
 
-	cmd := exec.Command("nmcli", "connection", "modify", ssid,
+	output, err := nm.combinedOutput("nmcli", "connection", "modify", ssid,
 		"connection.autoconnect", autoConnectStr)
-
-	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to set autoconnect for %s: %v\nOutput: %s",
 			ssid, err, output)
@@ -352,8 +515,7 @@ func (nm *networkManager) SetAutoConnectConnection(ssid string, autoConnect bool
 
 // Connect to a saved network by name
 func (nm *networkManager) ConnectNetwork(ssid string) error {
-	cmd := exec.Command("nmcli", "connection", "up", ssid)
-	output, err := cmd.CombinedOutput()
+	output, err := nm.combinedOutput("nmcli", "connection", "up", ssid)
 	if err != nil {
 		return fmt.Errorf("failed to connect to %s: %v\nOutput: %s", ssid, err, output)
 	}
@@ -362,20 +524,39 @@ func (nm *networkManager) ConnectNetwork(ssid string) error {
 
 // Enable the AP if there's no internet connection for a certain amount of time. This will run in the background.
 func (nm *networkManager) ManageOfflineAP(connectionLossTimeout time.Duration) error {
-	for {
-		apMode := getWifiMode(nm.status.APSSID)
-		if !nm.checkWlanConnection() && apMode != "ap" {
-			log.Println("Device offline, waiting for recovery...")
-			time.Sleep(connectionLossTimeout)
-			if !nm.checkWlanConnection() {
-				log.Println("No connection after timeout, enabling AP mode")
-				if err := nm.ConnectNetwork(nm.status.APSSID); err != nil {
-					log.Printf("Failed to enable AP mode: %v", err)
-				}
-			} else {
-				log.Println("Device connection recovered")
-			}
-		}
-		time.Sleep(60 * time.Second)
+	return manageOfflineAP(nm, nm.sleep, nm.settings.PollInterval, connectionLossTimeout)
+}
+
+// Returns ModeAP, ModeClient or the state of the wifi interface
+func (nm *networkManager) GetWifiMode() string {
+	return nm.currentMode()
+}
+
+// List the clients of the access point with the leases of NetworkManager's dnsmasq
+func (nm *networkManager) GetAPClients() ([]APClient, error) {
+	if nm.currentMode() != ModeAP {
+		return []APClient{}, nil
 	}
+	return apClients(nm.runner, nm.settings.WifiInterface, nmLeaseFile(nm.settings.WifiInterface))
+}
+
+// Disconnect a client from the access point
+func (nm *networkManager) DisconnectAPClient(mac string) error {
+	if nm.currentMode() != ModeAP {
+		return fmt.Errorf("failed to disconnect %s: not in AP mode", mac)
+	}
+	return disconnectAPClient(nm.runner, nm.settings.WifiInterface, mac)
+}
+
+// Answer DNS queries of AP clients with the AP address while AP mode is active. This will run in the background.
+func (nm *networkManager) ManageCaptiveDNS() error {
+	return manageCaptiveDNS(nm, nm.runner, nm.settings, nm.sleep)
+}
+
+func (nm *networkManager) currentMode() string {
+	return nm.getWifiMode(nm.status.APSSID)
+}
+
+func (nm *networkManager) enableAP() error {
+	return nm.ConnectNetwork(nm.status.APSSID)
 }
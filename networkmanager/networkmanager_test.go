@@ -0,0 +1,416 @@
+package networkmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAPSSID = "Optistok-AP-TEST"
+
+func recorded(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("reading recorded output %s: %v", name, err)
+	}
+	return string(data)
+}
+
+func newTestManager(runner *FakeRunner) *networkManager {
+	settings := DefaultSettings()
+	settings.DnsmasqSharedDir = ""
+	return &networkManager{
+		status:   NetworkStatus{APSSID: testAPSSID},
+		settings: settings,
+		runner:   runner,
+		sleep:    func(time.Duration) {},
+	}
+}
+
+func recordStatus(t *testing.T, runner *FakeRunner, general string) {
+	runner.
+		On("nmcli g", recorded(t, general), nil).
+		On("nmcli -t -f active,ssid dev wifi", recorded(t, "nmcli_wifi_active_ssid.txt"), nil).
+		On("nmcli -f IN-USE,SIGNAL dev wifi list", recorded(t, "nmcli_wifi_signal.txt"), nil).
+		On("nmcli -t -f NAME,TYPE,DEVICE con show --active", recorded(t, "nmcli_active_client.txt"), nil).
+		On("nmcli -g IP4.ADDRESS dev show wlan0", recorded(t, "nmcli_ip4_wlan0.txt"), nil).
+		On("nmcli -g IP4.ADDRESS dev show eth0", "", errors.New("exit status 10")).
+		On("nmcli -g GENERAL.CONNECTION device show wlan0", "HomeWifi\n", nil).
+		On("nmcli -g ipv4.method connection show HomeWifi", "auto\n", nil).
+		On("nmcli -g ipv6.method connection show HomeWifi", "dhcp\n", nil).
+		On("ip -6 -o addr show dev wlan0 scope global", recorded(t, "ip_addr6_wlan0.txt"), nil)
+}
+
+func TestGetNetworkStatus(t *testing.T) {
+	runner := NewFakeRunner()
+	recordStatus(t, runner, "nmcli_general_connected.txt")
+	nm := newTestManager(runner)
+
+	status, err := nm.GetNetworkStatus()
+	if err != nil {
+		t.Fatalf("GetNetworkStatus: %v", err)
+	}
+	want := NetworkStatus{
+		State:        "Connected",
+		Connectivity: "Full",
+		WifiHW:       "Enabled",
+		Wifi:         "Enabled",
+		WifiSSID:     "HomeWifi",
+		APSSID:       testAPSSID,
+		SignalStr:    72,
+		Mode:         ModeClient,
+		IPs: NetworkIPs{
+			WifiIP:         "192.168.1.23",
+			WifiState:      "online",
+			WifiIPv4Method: IPMethodAuto,
+			WifiIPv6:       []string{"2001:db8:1::23/64", "fd00::23/64"},
+			WifiIPv6Method: IPMethodDHCP,
+			EthState:       "offline",
+		},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("GetNetworkStatus() = %+v, want %+v", status, want)
+	}
+}
+
+func TestGetNetworkStatusSiteOnly(t *testing.T) {
+	runner := NewFakeRunner()
+	recordStatus(t, runner, "nmcli_general_site_only.txt")
+	nm := newTestManager(runner)
+
+	status, err := nm.GetNetworkStatus()
+	if err != nil {
+		t.Fatalf("GetNetworkStatus: %v", err)
+	}
+	if status.State != "Connected (Site Only)" {
+		t.Errorf("State = %q, want %q", status.State, "Connected (Site Only)")
+	}
+	if status.Connectivity != "Limited" {
+		t.Errorf("Connectivity = %q, want %q", status.Connectivity, "Limited")
+	}
+}
+
+func TestGetNetworkStatusNmcliFailure(t *testing.T) {
+	runner := NewFakeRunner().On("nmcli g", "", errors.New("exit status 8"))
+	nm := newTestManager(runner)
+
+	status, err := nm.GetNetworkStatus()
+	if err == nil {
+		t.Fatal("expected error when nmcli fails")
+	}
+	if status.APSSID != testAPSSID {
+		t.Errorf("APSSID = %q, want previous status to be returned", status.APSSID)
+	}
+}
+
+func TestSetWifiModeAP(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli -t -f NAME,TYPE,DEVICE con show --active", recorded(t, "nmcli_active_client.txt"), nil).
+		On("nmcli -t -f NAME,TYPE,DEVICE con show --active", recorded(t, "nmcli_active_ap.txt"), nil).
+		On("nmcli connection show "+testAPSSID, "", nil).
+		On("nmcli con up "+testAPSSID, "Connection successfully activated", nil)
+	nm := newTestManager(runner)
+
+	if err := nm.SetWifiMode(ModeAP); err != nil {
+		t.Fatalf("SetWifiMode(ap): %v", err)
+	}
+	if !runner.Called("nmcli con up " + testAPSSID) {
+		t.Error("expected AP connection to be brought up")
+	}
+}
+
+func TestSetWifiModeAPRequiresClient(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli -t -f NAME,TYPE,DEVICE con show --active", recorded(t, "nmcli_active_none.txt"), nil)
+	nm := newTestManager(runner)
+
+	if err := nm.SetWifiMode(ModeAP); err == nil {
+		t.Fatal("expected error without an active client connection")
+	}
+}
+
+func TestSetWifiModeClient(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli -t -f NAME,TYPE,DEVICE con show --active", recorded(t, "nmcli_active_ap.txt"), nil).
+		On("nmcli -t -f NAME,TYPE,DEVICE con show --active", recorded(t, "nmcli_active_client.txt"), nil).
+		On("nmcli con down "+testAPSSID, "", nil)
+	nm := newTestManager(runner)
+
+	if err := nm.SetWifiMode(ModeClient); err != nil {
+		t.Fatalf("SetWifiMode(client): %v", err)
+	}
+	if !runner.Called("nmcli con down " + testAPSSID) {
+		t.Error("expected AP connection to be taken down")
+	}
+}
+
+func TestSetWifiModeUnsupported(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli -t -f NAME,TYPE,DEVICE con show --active", recorded(t, "nmcli_active_client.txt"), nil)
+	nm := newTestManager(runner)
+
+	if err := nm.SetWifiMode("mesh"); err == nil {
+		t.Fatal("expected error for unsupported mode")
+	}
+}
+
+func TestManageOfflineAPEnablesAP(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli -t -f NAME,TYPE,DEVICE con show --active", recorded(t, "nmcli_active_none.txt"), nil).
+		On("nmcli -t -f DEVICE,STATE device", recorded(t, "nmcli_device_disconnected.txt"), nil).
+		On("nmcli connection up "+testAPSSID, "Connection successfully activated", nil)
+	nm := newTestManager(runner)
+
+	if !checkOfflineAP(nm, nm.sleep, 30*time.Second) {
+		t.Error("checkOfflineAP didn't report the fallback to AP mode")
+	}
+	if !runner.Called("nmcli connection up " + testAPSSID) {
+		t.Error("expected AP mode to be enabled after the offline timeout")
+	}
+}
+
+func TestManageOfflineAPRecovers(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli -t -f NAME,TYPE,DEVICE con show --active", recorded(t, "nmcli_active_client.txt"), nil).
+		On("nmcli -t -f DEVICE,STATE device", recorded(t, "nmcli_device_disconnected.txt"), nil).
+		On("nmcli -t -f DEVICE,STATE device", recorded(t, "nmcli_device_connected.txt"), nil).
+		On("ping -I wlan0 -c 1 -W 2 1.1.1.1", recorded(t, "ping_ok.txt"), nil)
+	nm := newTestManager(runner)
+
+	var slept time.Duration
+	nm.sleep = func(d time.Duration) { slept += d }
+
+	checkOfflineAP(nm, nm.sleep, 30*time.Second)
+	if slept != 30*time.Second {
+		t.Errorf("slept %v, want the connection loss timeout", slept)
+	}
+	if runner.Called("nmcli connection up " + testAPSSID) {
+		t.Error("AP mode should not be enabled once the connection recovers")
+	}
+}
+
+func TestManageOfflineAPOnline(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli -t -f NAME,TYPE,DEVICE con show --active", recorded(t, "nmcli_active_client.txt"), nil).
+		On("nmcli -t -f DEVICE,STATE device", recorded(t, "nmcli_device_connected.txt"), nil).
+		On("ping -I wlan0 -c 1 -W 2 1.1.1.1", recorded(t, "ping_ok.txt"), nil)
+	nm := newTestManager(runner)
+
+	checkOfflineAP(nm, nm.sleep, 30*time.Second)
+	for _, call := range runner.Calls() {
+		if call == "nmcli connection up "+testAPSSID {
+			t.Error("AP mode should not be enabled while online")
+		}
+	}
+}
+
+func TestSetupAPConnectionCreates(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli connection show "+testAPSSID, "", errors.New("exit status 10")).
+		On("nmcli connection show "+testAPSSID, "connection.id: "+testAPSSID, nil).
+		On("nmcli -t -f NAME connection show", "HomeWifi\nOptistok-AP-OLD\n", nil).
+		On("nmcli connection delete Optistok-AP-OLD", "", nil).
+		On("nmcli connection add type wifi ifname wlan0 con-name "+testAPSSID+
+			" connection.autoconnect no 802-11-wireless.ssid "+testAPSSID+
+			" 802-11-wireless.mode ap 802-11-wireless.band bg ipv4.method shared ipv6.method disabled"+
+			" 802-11-wireless-security.key-mgmt wpa-psk 802-11-wireless-security.proto rsn"+
+			" 802-11-wireless-security.pairwise ccmp 802-11-wireless-security.group ccmp"+
+			" 802-11-wireless-security.psk technician", "", nil)
+	nm := newTestManager(runner)
+	nm.settings.APPassphrase = "technician"
+
+	if err := nm.SetupAPConnection(); err != nil {
+		t.Fatalf("SetupAPConnection: %v", err)
+	}
+	if !runner.Called("nmcli connection delete Optistok-AP-OLD") {
+		t.Error("stale AP profile was not removed")
+	}
+}
+
+func TestSetupAPConnectionUpdatesExisting(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli connection show "+testAPSSID, "connection.id: "+testAPSSID, nil).
+		On("nmcli -t -f NAME connection show", testAPSSID+"\n", nil).
+		On("nmcli connection modify "+testAPSSID+" remove 802-11-wireless-security", "", nil).
+		On("nmcli connection modify "+testAPSSID+
+			" connection.autoconnect no 802-11-wireless.ssid "+testAPSSID+
+			" 802-11-wireless.mode ap 802-11-wireless.band bg ipv4.method shared ipv6.method disabled"+
+			" 802-11-wireless-security.key-mgmt sae 802-11-wireless-security.psk technician", "", nil)
+	nm := newTestManager(runner)
+	nm.settings.APPassphrase = "technician"
+	nm.settings.APSecurity = APSecurityWPA3
+
+	if err := nm.SetupAPConnection(); err != nil {
+		t.Fatalf("SetupAPConnection: %v", err)
+	}
+	for _, call := range runner.Calls() {
+		if strings.Contains(call, "delete") || strings.Contains(call, "add") {
+			t.Errorf("existing AP profile should be updated in place, got %q", call)
+		}
+	}
+}
+
+func TestFindAvailableNetworks(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli device wifi rescan", "", nil).
+		On("nmcli -t -f IN-USE,SSID,BSSID,SIGNAL,FREQ,SECURITY device wifi list --rescan no", recorded(t, "nmcli_wifi_list.txt"), nil)
+	nm := newTestManager(runner)
+
+	networks, err := nm.FindAvailableNetworks()
+	if err != nil {
+		t.Fatalf("FindAvailableNetworks: %v", err)
+	}
+	want := []ScanResult{
+		{SSID: "HomeWifi", Signal: 72, Security: SecurityWPA2PSK, InUse: true, BSSIDs: []BSS{
+			{BSSID: "b8:27:eb:00:00:01", Signal: 72, Frequency: 2437, Channel: 6, Band: Band2GHz, Security: SecurityWPA2PSK, InUse: true},
+			{BSSID: "b8:27:eb:00:00:03", Signal: 30, Frequency: 5745, Channel: 149, Band: Band5GHz, Security: SecurityWPA2WPA3},
+		}},
+		{SSID: "Office:5G", Signal: 51, Security: SecurityEnterprise, BSSIDs: []BSS{
+			{BSSID: "b8:27:eb:00:00:04", Signal: 51, Frequency: 5955, Channel: 1, Band: Band6GHz, Security: SecurityEnterprise},
+		}},
+		{SSID: "Neighbour", Signal: 45, Security: SecurityOpen, BSSIDs: []BSS{
+			{BSSID: "b8:27:eb:00:00:02", Signal: 45, Frequency: 5180, Channel: 36, Band: Band5GHz, Security: SecurityOpen},
+		}},
+	}
+	if !reflect.DeepEqual(networks, want) {
+		t.Errorf("FindAvailableNetworks() = %+v, want %+v", networks, want)
+	}
+}
+
+func TestModifyNetworkConnectionEnterprise(t *testing.T) {
+	runner := NewFakeRunner()
+	nm := newTestManager(runner)
+	nm.settings.CertDir = t.TempDir()
+	caCert := filepath.Join(nm.settings.CertDir, "436f7270-ca.pem")
+	runner.
+		On("nmcli connection show Corp", "", errors.New("exit status 10")).
+		On("nmcli connection add type wifi ifname wlan0 con-name Corp autoconnect yes ssid Corp"+
+			" 802-11-wireless-security.key-mgmt wpa-eap 802-1x.eap peap 802-1x.identity alice"+
+			" 802-1x.anonymous-identity anonymous 802-1x.phase2-auth mschapv2 802-1x.password s3cret"+
+			" 802-1x.ca-cert "+caCert, "", nil)
+
+	err := nm.ModifyNetworkConnection(ConnectionConfig{
+		SSID:        "Corp",
+		AutoConnect: true,
+		Enterprise: &EnterpriseConfig{
+			EAP:               EAPPEAP,
+			Identity:          "alice",
+			AnonymousIdentity: "anonymous",
+			Password:          "s3cret",
+			CACert:            []byte(testCert),
+		},
+	})
+	if err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+	if data, err := os.ReadFile(caCert); err != nil || string(data) != testCert {
+		t.Errorf("CA certificate = %q, %v", data, err)
+	}
+}
+
+func TestModifyNetworkConnectionSecurity(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli -t -f IN-USE,SSID,BSSID,SIGNAL,FREQ,SECURITY device wifi list --rescan no", recorded(t, "nmcli_wifi_list.txt"), nil).
+		On("nmcli connection show HomeWifi", "", errors.New("exit status 10")).
+		On("nmcli connection add type wifi ifname wlan0 con-name HomeWifi autoconnect no ssid HomeWifi"+
+			" 802-11-wireless-security.key-mgmt sae 802-11-wireless-security.psk hunter22", "", nil)
+	nm := newTestManager(runner)
+
+	// Only the 5 GHz access point supports WPA3
+	err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "HomeWifi", Password: "hunter22", Security: SecurityWPA3SAE})
+	if err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+
+	err = nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Neighbour", Password: "hunter22", Security: SecurityWPA2PSK})
+	if !errors.Is(err, ErrSecurityMismatch) {
+		t.Errorf("ModifyNetworkConnection() = %v, want ErrSecurityMismatch", err)
+	}
+	for _, call := range runner.Calls() {
+		if strings.Contains(call, "con-name Neighbour") {
+			t.Errorf("profile must not be created on a security mismatch, got %q", call)
+		}
+	}
+}
+
+func TestModifyNetworkConnectionHidden(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli -t -f IN-USE,SSID,BSSID,SIGNAL,FREQ,SECURITY device wifi list --rescan no", recorded(t, "nmcli_wifi_list.txt"), nil).
+		On("nmcli connection show Basement", "", errors.New("exit status 10")).
+		On("nmcli connection add type wifi ifname wlan0 con-name Basement autoconnect yes ssid Basement 802-11-wireless.hidden yes"+
+			" 802-11-wireless-security.key-mgmt wpa-psk 802-11-wireless-security.psk hunter22", "", nil)
+	nm := newTestManager(runner)
+
+	err := nm.ModifyNetworkConnection(ConnectionConfig{SSID: "Basement", Password: "hunter22", AutoConnect: true, Hidden: true})
+	if err != nil {
+		t.Fatalf("ModifyNetworkConnection: %v", err)
+	}
+}
+
+func TestSetIPv4Config(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli -g GENERAL.CONNECTION device show wlan0", "HomeWifi\n", nil).
+		On("nmcli connection modify HomeWifi ipv4.method manual ipv4.addresses 192.168.1.50/24 ipv4.gateway 192.168.1.1"+
+			" ipv4.dns 1.1.1.1,9.9.9.9 ipv4.dns-search lan", "", nil).
+		On("nmcli device reapply wlan0", "", nil).
+		On("nmcli -g GENERAL.CONNECTION device show eth0", "Wired connection 1\n", nil).
+		On("nmcli connection modify Wired connection 1 ipv4.method auto ipv4.addresses  ipv4.gateway  ipv4.dns  ipv4.dns-search ", "", nil).
+		On("nmcli device reapply eth0", "", nil)
+	nm := newTestManager(runner)
+
+	err := nm.SetIPv4Config("HomeWifi", IPv4Config{
+		Method:  IPMethodManual,
+		Address: "192.168.1.50/24",
+		Gateway: "192.168.1.1",
+		DNS:     []string{"1.1.1.1", "9.9.9.9"},
+		Search:  []string{"lan"},
+	})
+	if err != nil {
+		t.Fatalf("SetIPv4Config: %v", err)
+	}
+	if err := nm.SetIPv4Config("", IPv4Config{Method: IPMethodAuto}); err != nil {
+		t.Fatalf("SetIPv4Config (ethernet): %v", err)
+	}
+	if !runner.Called("nmcli device reapply wlan0") || !runner.Called("nmcli device reapply eth0") {
+		t.Errorf("active connections were not reapplied, calls: %v", runner.Calls())
+	}
+
+	if err := nm.SetIPv4Config("HomeWifi", IPv4Config{Method: IPMethodManual, Address: "192.168.1.50"}); err == nil {
+		t.Error("expected an error for an address without prefix")
+	}
+}
+
+func TestSetIPv6Config(t *testing.T) {
+	runner := NewFakeRunner().
+		On("nmcli -g GENERAL.CONNECTION device show wlan0", "", nil).
+		On("nmcli connection modify Office ipv6.method manual ipv6.addresses 2001:db8::50/64 ipv6.gateway fe80::1"+
+			" ipv6.dns 2001:db8::53", "", nil).
+		On("nmcli -g GENERAL.CONNECTION device show eth0", "Wired connection 1\n", nil).
+		On("nmcli connection modify Wired connection 1 ipv6.method disabled ipv6.addresses  ipv6.gateway  ipv6.dns ", "", nil).
+		On("nmcli device reapply eth0", "", nil)
+	nm := newTestManager(runner)
+
+	err := nm.SetIPv6Config("Office", IPv6Config{
+		Method:  IPMethodManual,
+		Address: "2001:db8::50/64",
+		Gateway: "fe80::1",
+		DNS:     []string{"2001:db8::53"},
+	})
+	if err != nil {
+		t.Fatalf("SetIPv6Config: %v", err)
+	}
+	if runner.Called("nmcli device reapply wlan0") {
+		t.Error("an inactive connection must not be reapplied")
+	}
+	if err := nm.SetIPv6Config("", IPv6Config{Method: IPMethodDisabled}); err != nil {
+		t.Fatalf("SetIPv6Config (ethernet): %v", err)
+	}
+	if !runner.Called("nmcli device reapply eth0") {
+		t.Errorf("the active connection was not reapplied, calls: %v", runner.Calls())
+	}
+}
@@ -3,32 +3,40 @@ package networkmanager
 import (
 	"context"
 	"fmt"
-	"os/exec"
 	"strconv"
 	"strings"
-	"time"
 )
 
-func checkInterfaceExists(name string) bool {
-	cmd := exec.Command("iw", "dev")
-	output, err := cmd.Output()
+func (nm *networkManager) output(name string, args ...string) ([]byte, error) {
+	return nm.runner.Output(context.Background(), name, args...)
+}
+
+func (nm *networkManager) combinedOutput(name string, args ...string) ([]byte, error) {
+	return nm.runner.CombinedOutput(context.Background(), name, args...)
+}
+
+func (nm *networkManager) run(name string, args ...string) error {
+	_, err := nm.output(name, args...)
+	return err
+}
+
+func (nm *networkManager) checkInterfaceExists(name string) bool {
+	output, err := nm.output("iw", "dev")
 	if err != nil {
 		return false
 	}
 	return strings.Contains(string(output), name)
 }
 
-func verifyAPConnection(apName string) error {
-	cmd := exec.Command("nmcli", "connection", "show", apName)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("AP connection not configured. Run: sudo nmcli connection add type wifi ifname wlan0 con-name PiFi-AP autoconnect no ssid PiFi mode ap 802-11-wireless.band bg")
+func (nm *networkManager) verifyAPConnection(apName string) error {
+	if err := nm.run("nmcli", "connection", "show", apName); err != nil {
+		return fmt.Errorf("AP connection not configured. Run: sudo nmcli connection add type wifi ifname %s con-name PiFi-AP autoconnect no ssid PiFi mode ap 802-11-wireless.band bg", nm.settings.WifiInterface)
 	}
 	return nil
 }
 
-func getWifiSignal() int32 {
-	cmd := exec.Command("nmcli", "-f", "IN-USE,SIGNAL", "dev", "wifi", "list")
-	output, err := cmd.Output()
+func (nm *networkManager) getWifiSignal() int32 {
+	output, err := nm.output("nmcli", "-f", "IN-USE,SIGNAL", "dev", "wifi", "list")
 	if err != nil {
 		return -1
 	}
@@ -49,9 +57,8 @@ func getWifiSignal() int32 {
 	return -1
 }
 
-func getWifiMode(apName string) string {
-	cmd := exec.Command("nmcli", "-t", "-f", "NAME,TYPE,DEVICE", "con", "show", "--active")
-	output, err := cmd.Output()
+func (nm *networkManager) getWifiMode(apName string) string {
+	output, err := nm.output("nmcli", "-t", "-f", "NAME,TYPE,DEVICE", "con", "show", "--active")
 	if err != nil {
 		return "unknown"
 	}
@@ -69,9 +76,8 @@ func getWifiMode(apName string) string {
 	return "inactive"
 }
 
-func getWifiSSID() string {
-	cmd := exec.Command("nmcli", "-t", "-f", "active,ssid", "dev", "wifi")
-	output, err := cmd.Output()
+func (nm *networkManager) getWifiSSID() string {
+	output, err := nm.output("nmcli", "-t", "-f", "active,ssid", "dev", "wifi")
 	if err != nil {
 		return ""
 	}
@@ -86,9 +92,8 @@ func getWifiSSID() string {
 	return ""
 }
 
-func getWifiIP() string {
-	cmd := exec.Command("nmcli", "-g", "IP4.ADDRESS", "dev", "show", "wlan0")
-	output, err := cmd.Output()
+func (nm *networkManager) getWifiIP() string {
+	output, err := nm.output("nmcli", "-g", "IP4.ADDRESS", "dev", "show", nm.settings.WifiInterface)
 	if err != nil {
 		return "not connected"
 	}
@@ -105,9 +110,8 @@ func getWifiIP() string {
 	return ip
 }
 
-func getEthernetIP() string {
-	cmd := exec.Command("nmcli", "-g", "IP4.ADDRESS", "dev", "show", "eth0")
-	output, err := cmd.Output()
+func (nm *networkManager) getEthernetIP() string {
+	output, err := nm.output("nmcli", "-g", "IP4.ADDRESS", "dev", "show", nm.settings.EthernetInterface)
 	if err != nil {
 		return "not connected"
 	}
@@ -123,69 +127,152 @@ func getEthernetIP() string {
 	return ip
 }
 
-func getNetworkIps() NetworkIPs {
+func (nm *networkManager) getNetworkIps() NetworkIPs {
 	status := NetworkIPs{
 		WifiState: "offline",
 		EthState:  "offline",
 	}
 
 	// Check WiFi
-	if output, err := exec.Command("nmcli", "-g", "IP4.ADDRESS", "dev", "show", "wlan0").Output(); err == nil {
+	if output, err := nm.output("nmcli", "-g", "IP4.ADDRESS", "dev", "show", nm.settings.WifiInterface); err == nil {
 		if ip := strings.TrimSpace(string(output)); ip != "" {
 			status.WifiIP = strings.Split(ip, "/")[0]
 			status.WifiState = "online"
+			status.WifiIPv4Method = nm.connectionMethod(nm.settings.WifiInterface, "ipv4.method")
 		}
 	}
 
 	// Check Ethernet
-	if output, err := exec.Command("nmcli", "-g", "IP4.ADDRESS", "dev", "show", "eth0").Output(); err == nil {
+	if output, err := nm.output("nmcli", "-g", "IP4.ADDRESS", "dev", "show", nm.settings.EthernetInterface); err == nil {
 		if ip := strings.TrimSpace(string(output)); ip != "" {
 			status.EthernetIP = strings.Split(ip, "/")[0]
 			status.EthState = "online"
+			status.EthIPv4Method = nm.connectionMethod(nm.settings.EthernetInterface, "ipv4.method")
 		}
 	}
+
+	addIPv6Status(nm.runner, nm.settings, &status)
+	if status.WifiState == "online" || len(status.WifiIPv6) > 0 {
+		status.WifiIPv6Method = nm.connectionMethod(nm.settings.WifiInterface, "ipv6.method")
+	}
+	if status.EthState == "online" || len(status.EthIPv6) > 0 {
+		status.EthIPv6Method = nm.connectionMethod(nm.settings.EthernetInterface, "ipv6.method")
+	}
 	return status
 }
 
-func (nm *networkManager) pingTest() bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+// Returns the name of the connection active on the interface, or an empty string
+func (nm *networkManager) deviceConnection(iface string) string {
+	output, err := nm.output("nmcli", "-g", "GENERAL.CONNECTION", "device", "show", iface)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
 
-	cmd := exec.CommandContext(ctx, "ping", "-I", "wlan0", "-c", "1", "-W", "2", "1.1.1.1")
-	return cmd.Run() == nil
+// Returns the ipv4.method or ipv6.method of the connection active on the interface
+func (nm *networkManager) connectionMethod(iface, setting string) string {
+	name := nm.deviceConnection(iface)
+	if name == "" {
+		return ""
+	}
+	output, err := nm.output("nmcli", "-g", setting, "connection", "show", name)
+	if err != nil {
+		return ""
+	}
+	return ipMethod(strings.TrimSpace(string(output)))
+}
+
+// Returns the nmcli arguments for an IPv4 configuration, DHCP clears the static settings
+func ipv4Args(config IPv4Config) []string {
+	return []string{
+		"ipv4.method", config.Method,
+		"ipv4.addresses", config.Address,
+		"ipv4.gateway", config.Gateway,
+		"ipv4.dns", strings.Join(config.DNS, ","),
+		"ipv4.dns-search", strings.Join(config.Search, ","),
+	}
+}
+
+// Returns the nmcli arguments for an IPv6 configuration
+func ipv6Args(config IPv6Config) []string {
+	return []string{
+		"ipv6.method", config.Method,
+		"ipv6.addresses", config.Address,
+		"ipv6.gateway", config.Gateway,
+		"ipv6.dns", strings.Join(config.DNS, ","),
+	}
 }
 
-func (nm *networkManager) checkWlanConnection() bool {
-	cmd := exec.Command("nmcli", "-t", "-f", "DEVICE,STATE", "device")
-	output, err := cmd.CombinedOutput()
+func (nm *networkManager) wlanOnline() bool {
+	output, err := nm.combinedOutput("nmcli", "-t", "-f", "DEVICE,STATE", "device")
 	if err != nil {
 		return false
 	}
 	for _, line := range strings.Split(string(output), "\n") {
-		if strings.HasPrefix(line, "wlan0:connected") {
-			return nm.pingTest()
+		if strings.HasPrefix(line, nm.settings.WifiInterface+":connected") {
+			return pingTest(nm.runner, nm.settings)
 		}
 	}
 	return false
 }
 
-func removeExistingAPs() error {
+func (nm *networkManager) removeExistingAPs() error {
 	// Get all connections
-	cmd := exec.Command("nmcli", "-t", "-f", "NAME", "connection", "show")
-	output, err := cmd.Output()
+	output, err := nm.output("nmcli", "-t", "-f", "NAME", "connection", "show")
 	if err != nil {
 		return fmt.Errorf("failed to list connections: %v", err)
 	}
 
-	// Find and delete PiFi-AP-* connections
+	// Find and delete Optistok-AP-* connections other than the current AP
 	connections := strings.Split(string(output), "\n")
 	for _, conn := range connections {
-		if strings.HasPrefix(conn, "Optistok-AP-") {
-			deleteCmd := exec.Command("nmcli", "connection", "delete", conn)
-			if err := deleteCmd.Run(); err != nil {
+		if strings.HasPrefix(conn, legacyAPPrefix) && conn != nm.status.APSSID {
+			if err := nm.run("nmcli", "connection", "delete", conn); err != nil {
 				return fmt.Errorf("failed to delete connection %s: %v", conn, err)
 			}
 		}
 	}
 	return nil
 }
+
+// Splits a line of nmcli terse output on unescaped colons
+func splitTerse(line string) []string {
+	fields := make([]string, 0)
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
+// Maps the SECURITY column of nmcli, e.g. "WPA1 WPA2" or "WPA2 802.1X"
+func nmcliSecurity(flags string) string {
+	words := strings.Fields(flags)
+	switch {
+	case contains(words, "802.1X"):
+		return SecurityEnterprise
+	case contains(words, "WPA3") && contains(words, "WPA2"):
+		return SecurityWPA2WPA3
+	case contains(words, "WPA3"):
+		return SecurityWPA3SAE
+	case contains(words, "WPA2"):
+		return SecurityWPA2PSK
+	case contains(words, "WPA1"):
+		return SecurityWPAPSK
+	case contains(words, "WEP"):
+		return SecurityWEP
+	case contains(words, "OWE") || contains(words, "OWE-TM"):
+		return SecurityOWE
+	}
+	return SecurityOpen
+}
@@ -0,0 +1,47 @@
+package networkmanager
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// offlineAPBackend is the part of a backend needed to fall back to AP mode when offline.
+type offlineAPBackend interface {
+	currentMode() string
+	wlanOnline() bool
+	enableAP() error
+}
+
+// Runs a single iteration of the offline AP check, reporting whether it fell back to AP mode
+func checkOfflineAP(b offlineAPBackend, sleep func(time.Duration), connectionLossTimeout time.Duration) bool {
+	if !b.wlanOnline() && b.currentMode() != ModeAP {
+		log.Println("Device offline, waiting for recovery...")
+		sleep(connectionLossTimeout)
+		if !b.wlanOnline() {
+			log.Println("No connection after timeout, enabling AP mode")
+			if err := b.enableAP(); err != nil {
+				log.Printf("Failed to enable AP mode: %v", err)
+				return false
+			}
+			return true
+		}
+		log.Println("Device connection recovered")
+	}
+	return false
+}
+
+func manageOfflineAP(b offlineAPBackend, sleep func(time.Duration), pollInterval, connectionLossTimeout time.Duration) error {
+	for {
+		checkOfflineAP(b, sleep, connectionLossTimeout)
+		sleep(pollInterval)
+	}
+}
+
+func pingTest(runner CommandRunner, settings Settings) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := runner.Output(ctx, "ping", "-I", settings.WifiInterface, "-c", "1", "-W", "2", settings.PingTarget)
+	return err == nil
+}
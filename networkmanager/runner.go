@@ -0,0 +1,136 @@
+package networkmanager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// CommandRunner executes the external tools (nmcli, iw, ping) the network manager relies on.
+type CommandRunner interface {
+	// Output runs the command and returns its standard output.
+	Output(ctx context.Context, name string, args ...string) ([]byte, error)
+	// CombinedOutput runs the command and returns its standard output and standard error.
+	CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error)
+	// Stream starts a long running command and returns its standard output as it is
+	// written. Closing the reader stops the command.
+	Stream(ctx context.Context, name string, args ...string) (io.ReadCloser, error)
+}
+
+// ExecRunner runs commands on the host using os/exec.
+type ExecRunner struct{}
+
+func (ExecRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).Output()
+}
+
+func (ExecRunner) CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+func (ExecRunner) Stream(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &commandStream{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+type commandStream struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (s *commandStream) Close() error {
+	s.cmd.Process.Kill()
+	s.ReadCloser.Close()
+	s.cmd.Wait()
+	return nil
+}
+
+// FakeResponse is a recorded result for a single command invocation.
+type FakeResponse struct {
+	Output string
+	Err    error
+}
+
+// FakeRunner replays recorded command output instead of executing anything.
+// Responses are keyed by the full command line, e.g. "nmcli -t -f NAME connection show".
+// When several responses are recorded for the same command they are returned in order,
+// and the last one is repeated once the queue is drained.
+type FakeRunner struct {
+	mu        sync.Mutex
+	responses map[string][]FakeResponse
+	calls     []string
+}
+
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{responses: make(map[string][]FakeResponse)}
+}
+
+// On records the output and error returned for the given command line.
+func (f *FakeRunner) On(cmdline, output string, err error) *FakeRunner {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[cmdline] = append(f.responses[cmdline], FakeResponse{Output: output, Err: err})
+	return f
+}
+
+// Calls returns every command line executed so far, in order.
+func (f *FakeRunner) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// Called reports whether the given command line has been executed.
+func (f *FakeRunner) Called(cmdline string) bool {
+	for _, call := range f.Calls() {
+		if call == cmdline {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FakeRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return f.replay(name, args)
+}
+
+func (f *FakeRunner) CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return f.replay(name, args)
+}
+
+// Stream returns the recorded output at once, as if the command exited afterwards
+func (f *FakeRunner) Stream(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	output, err := f.replay(name, args)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(string(output))), nil
+}
+
+func (f *FakeRunner) replay(name string, args []string) ([]byte, error) {
+	cmdline := strings.Join(append([]string{name}, args...), " ")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, cmdline)
+
+	queue, ok := f.responses[cmdline]
+	if !ok || len(queue) == 0 {
+		return nil, fmt.Errorf("fake runner: no response recorded for %q", cmdline)
+	}
+	resp := queue[0]
+	if len(queue) > 1 {
+		f.responses[cmdline] = queue[1:]
+	}
+	return []byte(resp.Output), resp.Err
+}
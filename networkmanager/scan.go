@@ -0,0 +1,150 @@
+package networkmanager
+
+import (
+	"sort"
+	"strings"
+)
+
+// Security types of scanned access points and client profiles
+const (
+	SecurityOpen       = "open"
+	SecurityOWE        = "owe"
+	SecurityWEP        = "wep"
+	SecurityWPAPSK     = "wpa-psk"
+	SecurityWPA2PSK    = "wpa2-psk"
+	SecurityWPA3SAE    = "wpa3-sae"
+	SecurityWPA2WPA3   = "wpa2-wpa3"
+	SecurityEnterprise = "wpa-eap"
+)
+
+// Frequency bands
+const (
+	Band2GHz = "2.4GHz"
+	Band5GHz = "5GHz"
+	Band6GHz = "6GHz"
+)
+
+// BSS is a single access point seen in a scan
+type BSS struct {
+	BSSID string `json:"bssid"`
+	// Signal is the signal quality in percent
+	Signal    int32  `json:"signal"`
+	Frequency uint32 `json:"frequency"`
+	Channel   int    `json:"channel"`
+	Band      string `json:"band"`
+	Security  string `json:"security"`
+	InUse     bool   `json:"inUse"`
+}
+
+// ScanResult groups all access points broadcasting the same SSID.
+// Signal and Security are those of the strongest access point.
+type ScanResult struct {
+	SSID     string `json:"ssid"`
+	Signal   int32  `json:"signal"`
+	Security string `json:"security"`
+	InUse    bool   `json:"inUse"`
+	BSSIDs   []BSS  `json:"bssids"`
+}
+
+// Bands returns the distinct bands the SSID is available on
+func (r ScanResult) Bands() []string {
+	bands := make([]string, 0)
+	for _, bss := range r.BSSIDs {
+		if bss.Band != "" && !contains(bands, bss.Band) {
+			bands = append(bands, bss.Band)
+		}
+	}
+	sort.Strings(bands)
+	return bands
+}
+
+type scannedBSS struct {
+	ssid string
+	BSS
+}
+
+// Groups scanned access points by SSID, strongest first. The network in use is listed first.
+func groupScanResults(scanned []scannedBSS) []ScanResult {
+	index := make(map[string]int)
+	results := make([]ScanResult, 0)
+	for _, s := range scanned {
+		if s.ssid == "" {
+			continue
+		}
+		i, ok := index[s.ssid]
+		if !ok {
+			i = len(results)
+			index[s.ssid] = i
+			results = append(results, ScanResult{SSID: s.ssid, Signal: -1})
+		}
+		r := &results[i]
+		r.BSSIDs = append(r.BSSIDs, s.BSS)
+		r.InUse = r.InUse || s.InUse
+		if s.Signal > r.Signal {
+			r.Signal = s.Signal
+			r.Security = s.Security
+		}
+	}
+	for i := range results {
+		sort.SliceStable(results[i].BSSIDs, func(a, b int) bool {
+			return results[i].BSSIDs[a].Signal > results[i].BSSIDs[b].Signal
+		})
+	}
+	sort.SliceStable(results, func(a, b int) bool {
+		if results[a].InUse != results[b].InUse {
+			return results[a].InUse
+		}
+		return results[a].Signal > results[b].Signal
+	})
+	return results
+}
+
+// Returns the channel number of a frequency in MHz
+func frequencyChannel(freq uint32) int {
+	switch {
+	case freq == 2484:
+		return 14
+	case freq >= 2412 && freq < 2484:
+		return int(freq-2407) / 5
+	case freq >= 5955 && freq <= 7115:
+		return int(freq-5950) / 5
+	case freq >= 5000 && freq < 5955:
+		return int(freq-5000) / 5
+	}
+	return 0
+}
+
+// Returns the band of a frequency in MHz
+func frequencyBand(freq uint32) string {
+	switch {
+	case freq >= 2400 && freq < 2500:
+		return Band2GHz
+	case freq >= 5955 && freq <= 7115:
+		return Band6GHz
+	case freq >= 5000 && freq < 5955:
+		return Band5GHz
+	}
+	return ""
+}
+
+// Fills in the channel and band from the frequency
+func newBSS(bssid string, signal int32, freq uint32, security string, inUse bool) BSS {
+	return BSS{
+		BSSID:     strings.ToLower(bssid),
+		Signal:    signal,
+		Frequency: freq,
+		Channel:   frequencyChannel(freq),
+		Band:      frequencyBand(freq),
+		Security:  security,
+		InUse:     inUse,
+	}
+}
+
+func contains(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
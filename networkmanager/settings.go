@@ -0,0 +1,50 @@
+package networkmanager
+
+import "time"
+
+// Settings holds the device specific values shared by all backends.
+type Settings struct {
+	// WifiInterface is used for both client and AP mode
+	WifiInterface string
+	// EthernetInterface is only reported in the status
+	EthernetInterface string
+	// APSSID is the network name of the access point, see ExpandAPSSID
+	APSSID string
+	// APPassphrase protects the access point when set, otherwise it is open
+	APPassphrase string
+	// APSecurity is APSecurityWPA2 or APSecurityWPA3
+	APSecurity string
+	// PingTarget is pinged over the wifi interface to check connectivity
+	PingTarget string
+	// PollInterval is the delay between offline AP checks
+	PollInterval time.Duration
+	// CertDir stores the certificates of enterprise profiles
+	CertDir string
+	// CaptiveDNS answers all DNS queries of AP clients with the AP address, see ManageCaptiveDNS
+	CaptiveDNS bool
+	// DnsmasqSharedDir holds the configuration of NetworkManager's dnsmasq for shared
+	// connections, which the nmcli and dbus backends adapt to CaptiveDNS. Empty leaves it alone.
+	DnsmasqSharedDir string
+}
+
+// DefaultSettings returns the settings of a stock Raspberry Pi.
+func DefaultSettings() Settings {
+	return Settings{
+		WifiInterface:     "wlan0",
+		EthernetInterface: "eth0",
+		APSecurity:        APSecurityWPA2,
+		PingTarget:        "1.1.1.1",
+		PollInterval:      60 * time.Second,
+		CertDir:           "/var/lib/pifi/certs",
+		CaptiveDNS:        true,
+		DnsmasqSharedDir:  "/etc/NetworkManager/dnsmasq-shared.d",
+	}
+}
+
+// Returns the configured AP SSID, or a random one like older versions when none is set
+func (s Settings) apSSID() string {
+	if s.APSSID != "" {
+		return s.APSSID
+	}
+	return legacyAPPrefix + randSeq(4)
+}
@@ -0,0 +1,257 @@
+package networkmanager
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// NetworkManager prints many lines while connecting, the status is read once they stop
+	watchDebounce = 500 * time.Millisecond
+	// Delay before restarting nmcli monitor when it exits
+	monitorRestartDelay = 5 * time.Second
+	// Events queued per Watch channel, later events are dropped for consumers that fall behind
+	watchBuffer = 16
+)
+
+// Watcher keeps a snapshot of the network status up to date and publishes the
+// changes as StatusEvents. With the nmcli and dbus backends it follows nmcli monitor
+// and re-reads the status within a second of a change, the other backends are
+// polled every PollInterval. The status is also re-read after every configuration
+// change made through the Watcher.
+//
+// Watcher is a NetworkManager whose GetNetworkStatus and GetWifiMode return the
+// snapshot and whose ManageOfflineAP checks the connection on every event.
+type Watcher struct {
+	NetworkManager
+	runner   CommandRunner
+	settings Settings
+	monitor  bool
+	sleep    func(time.Duration)
+
+	wake chan struct{}
+
+	mu          sync.Mutex
+	status      NetworkStatus
+	known       bool
+	subscribers map[chan StatusEvent]struct{}
+}
+
+// NewWatcher returns a Watcher for nm, which must be started with Run
+func NewWatcher(nm NetworkManager, runner CommandRunner, settings Settings) *Watcher {
+	_, nmcli := nm.(*networkManager)
+	_, dbus := nm.(*dbusManager)
+	return &Watcher{
+		NetworkManager: nm,
+		runner:         runner,
+		settings:       settings,
+		monitor:        nmcli || dbus,
+		sleep:          time.Sleep,
+		wake:           make(chan struct{}, 1),
+		subscribers:    make(map[chan StatusEvent]struct{}),
+	}
+}
+
+// Run reads the status and keeps it up to date until ctx is done
+func (w *Watcher) Run(ctx context.Context) {
+	changed := make(chan struct{}, 1)
+	if w.monitor {
+		go w.runMonitor(ctx, changed)
+	}
+	for {
+		w.update()
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		case <-time.After(w.settings.PollInterval):
+		case <-changed:
+			w.settle(ctx, changed)
+		}
+	}
+}
+
+// Waits until no change was reported for watchDebounce
+func (w *Watcher) settle(ctx context.Context, changed chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-time.After(watchDebounce):
+			return
+		}
+	}
+}
+
+// Runs nmcli monitor, reporting every line it prints as a change
+func (w *Watcher) runMonitor(ctx context.Context, changed chan<- struct{}) {
+	for ctx.Err() == nil {
+		stream, err := w.runner.Stream(ctx, "nmcli", "monitor")
+		if err != nil {
+			log.Printf("Failed to start nmcli monitor: %v", err)
+		} else {
+			scanner := bufio.NewScanner(stream)
+			for scanner.Scan() {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+			stream.Close()
+		}
+		if ctx.Err() == nil {
+			w.sleep(monitorRestartDelay)
+		}
+	}
+}
+
+// Re-reads the status and publishes the changes
+func (w *Watcher) update() {
+	status, err := w.NetworkManager.GetNetworkStatus()
+	if err != nil {
+		log.Printf("Failed to update network status: %v", err)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.known {
+		for _, event := range StatusEvents(w.status, status, time.Now()) {
+			w.publish(event)
+		}
+	}
+	w.status, w.known = status, true
+}
+
+// Sends an event to every subscriber without blocking, w.mu must be held
+func (w *Watcher) publish(event StatusEvent) {
+	for ch := range w.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Refresh re-reads the status now instead of waiting for the next change or poll
+func (w *Watcher) Refresh() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Watch returns a channel receiving every StatusEvent until ctx is done
+func (w *Watcher) Watch(ctx context.Context) <-chan StatusEvent {
+	ch := make(chan StatusEvent, watchBuffer)
+	w.mu.Lock()
+	w.subscribers[ch] = struct{}{}
+	w.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.subscribers, ch)
+		close(ch)
+	}()
+	return ch
+}
+
+// GetNetworkStatus returns the snapshot, reading the status before the first update
+func (w *Watcher) GetNetworkStatus() (NetworkStatus, error) {
+	w.mu.Lock()
+	status, known := w.status, w.known
+	w.mu.Unlock()
+	if !known {
+		return w.NetworkManager.GetNetworkStatus()
+	}
+	return status, nil
+}
+
+func (w *Watcher) GetWifiMode() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.known {
+		return w.NetworkManager.GetWifiMode()
+	}
+	return w.status.Mode
+}
+
+// FindAvailableNetworks publishes an EventScanCompleted after scanning
+func (w *Watcher) FindAvailableNetworks() ([]ScanResult, error) {
+	networks, err := w.NetworkManager.FindAvailableNetworks()
+	if err != nil {
+		return networks, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.publish(StatusEvent{
+		Type:       EventScanCompleted,
+		Time:       time.Now(),
+		Mode:       w.status.Mode,
+		WifiIP:     w.status.IPs.WifiIP,
+		EthernetIP: w.status.IPs.EthernetIP,
+		Networks:   len(networks),
+	})
+	return networks, nil
+}
+
+// ManageOfflineAP checks the connection on every event and every PollInterval and
+// publishes an EventAPFallback when it enables the AP
+func (w *Watcher) ManageOfflineAP(connectionLossTimeout time.Duration) error {
+	b, ok := w.NetworkManager.(offlineAPBackend)
+	if !ok {
+		return w.NetworkManager.ManageOfflineAP(connectionLossTimeout)
+	}
+	events := w.Watch(context.Background())
+	for {
+		if checkOfflineAP(b, w.sleep, connectionLossTimeout) {
+			w.mu.Lock()
+			w.publish(StatusEvent{Type: EventAPFallback, Time: time.Now(), Mode: ModeAP, SSID: w.status.APSSID})
+			w.mu.Unlock()
+			w.Refresh()
+		}
+		select {
+		case <-events:
+		case <-time.After(w.settings.PollInterval):
+		}
+	}
+}
+
+func (w *Watcher) SetWifiMode(mode string) error {
+	defer w.Refresh()
+	return w.NetworkManager.SetWifiMode(mode)
+}
+
+func (w *Watcher) ConnectNetwork(ssid string) error {
+	defer w.Refresh()
+	return w.NetworkManager.ConnectNetwork(ssid)
+}
+
+func (w *Watcher) ModifyNetworkConnection(conn ConnectionConfig) error {
+	defer w.Refresh()
+	return w.NetworkManager.ModifyNetworkConnection(conn)
+}
+
+func (w *Watcher) RemoveNetworkConnection(ssid string) error {
+	defer w.Refresh()
+	return w.NetworkManager.RemoveNetworkConnection(ssid)
+}
+
+func (w *Watcher) SetAutoConnectConnection(ssid string, autoConnect bool) error {
+	defer w.Refresh()
+	return w.NetworkManager.SetAutoConnectConnection(ssid, autoConnect)
+}
+
+func (w *Watcher) SetIPv4Config(ssid string, config IPv4Config) error {
+	defer w.Refresh()
+	return w.NetworkManager.SetIPv4Config(ssid, config)
+}
+
+func (w *Watcher) SetIPv6Config(ssid string, config IPv6Config) error {
+	defer w.Refresh()
+	return w.NetworkManager.SetIPv6Config(ssid, config)
+}
@@ -0,0 +1,114 @@
+package networkmanager
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns the statuses in order, repeating the last one
+type fakeStatusManager struct {
+	NetworkManager
+	mu       sync.Mutex
+	statuses []NetworkStatus
+}
+
+func (f *fakeStatusManager) GetNetworkStatus() (NetworkStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := f.statuses[0]
+	if len(f.statuses) > 1 {
+		f.statuses = f.statuses[1:]
+	}
+	return status, nil
+}
+
+func (f *fakeStatusManager) SetWifiMode(mode string) error {
+	return nil
+}
+
+func (f *fakeStatusManager) FindAvailableNetworks() ([]ScanResult, error) {
+	return []ScanResult{{SSID: "Home"}, {SSID: "Cafe"}}, nil
+}
+
+func newTestWatcher(runner *FakeRunner, statuses ...NetworkStatus) *Watcher {
+	settings := DefaultSettings()
+	settings.PollInterval = time.Hour
+	return NewWatcher(&fakeStatusManager{statuses: statuses}, runner, settings)
+}
+
+func receiveEvent(t *testing.T, ch <-chan StatusEvent) StatusEvent {
+	t.Helper()
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(3 * time.Second):
+		t.Fatal("no event received")
+	}
+	return StatusEvent{}
+}
+
+var (
+	watchHome = NetworkStatus{Mode: ModeClient, WifiSSID: "Home", APSSID: testAPSSID}
+	watchAP   = NetworkStatus{Mode: ModeAP, WifiSSID: testAPSSID, APSSID: testAPSSID}
+)
+
+func TestWatcherMonitor(t *testing.T) {
+	runner := NewFakeRunner().On("nmcli monitor", "wlan0: disconnected\nwlan0: using connection 'Optistok-AP-TEST'\n", nil)
+	w := newTestWatcher(runner, watchHome, watchAP)
+	w.monitor = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// nmcli monitor isn't restarted after the recorded output ends
+	w.sleep = func(time.Duration) { <-ctx.Done() }
+	events := w.Watch(ctx)
+	go w.Run(ctx)
+
+	for _, want := range []string{EventModeChanged, EventAPEnabled, EventDisconnected} {
+		if got := receiveEvent(t, events); got.Type != want {
+			t.Errorf("event %s, want %s", got.Type, want)
+		}
+	}
+	if status, err := w.GetNetworkStatus(); err != nil || status.Mode != ModeAP {
+		t.Errorf("GetNetworkStatus = %+v, %v, want the AP snapshot", status, err)
+	}
+	if mode := w.GetWifiMode(); mode != ModeAP {
+		t.Errorf("GetWifiMode = %q, want %q", mode, ModeAP)
+	}
+	if !runner.Called("nmcli monitor") {
+		t.Error("nmcli monitor was not started")
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatcherRefresh(t *testing.T) {
+	// Without nmcli monitor changes are only seen by polling or after configuration changes
+	w := newTestWatcher(NewFakeRunner(), watchAP, watchHome)
+	if w.monitor {
+		t.Fatal("a fake backend is monitored with nmcli")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := w.Watch(ctx)
+	go w.Run(ctx)
+
+	if err := w.SetWifiMode(ModeClient); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{EventModeChanged, EventConnected} {
+		if got := receiveEvent(t, events); got.Type != want {
+			t.Errorf("event %s, want %s", got.Type, want)
+		}
+	}
+
+	if _, err := w.FindAvailableNetworks(); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveEvent(t, events); got.Type != EventScanCompleted || got.Networks != 2 {
+		t.Errorf("event = %+v, want %s with 2 networks", got, EventScanCompleted)
+	}
+}
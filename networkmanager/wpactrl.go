@@ -0,0 +1,105 @@
+package networkmanager
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var wpaCtrlCounter uint32
+
+// wpaCtrl speaks the wpa_supplicant control interface protocol (the one wpa_cli uses)
+// over the per-interface unix datagram socket.
+type wpaCtrl struct {
+	path    string
+	timeout time.Duration
+}
+
+// Sends a single command and returns the reply. FAIL replies are returned as errors.
+func (c *wpaCtrl) request(cmd string) (string, error) {
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("pifi-wpa-%d-%d", os.Getpid(), atomic.AddUint32(&wpaCtrlCounter, 1)))
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: local, Net: "unixgram"},
+		&net.UnixAddr{Name: c.path, Net: "unixgram"})
+	if err != nil {
+		return "", fmt.Errorf("failed to open wpa_supplicant control socket: %v", err)
+	}
+	defer os.Remove(local)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return "", fmt.Errorf("failed to send %s: %v", cmd, err)
+	}
+
+	buf := make([]byte, 16384)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return "", fmt.Errorf("no reply to %s: %v", cmd, err)
+		}
+		reply := string(buf[:n])
+		// Skip unsolicited event messages, e.g. "<3>CTRL-EVENT-SCAN-RESULTS"
+		if strings.HasPrefix(reply, "<") {
+			continue
+		}
+		trimmed := strings.TrimSpace(reply)
+		if trimmed == "FAIL" || strings.HasPrefix(trimmed, "FAIL-") || trimmed == "UNKNOWN COMMAND" {
+			return "", fmt.Errorf("wpa_supplicant rejected %s: %s", strings.Fields(cmd)[0], trimmed)
+		}
+		return reply, nil
+	}
+}
+
+// Parses key=value replies such as STATUS and SIGNAL_POLL
+func parseWPAKeyValues(reply string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(reply, "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// Decodes the printf-style escaping wpa_supplicant uses for SSIDs
+func unescapeWPAString(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'e':
+			b.WriteByte(0x1b)
+		case 'x':
+			var c byte
+			if i+2 < len(s) {
+				if _, err := fmt.Sscanf(s[i+1:i+3], "%02x", &c); err == nil {
+					b.WriteByte(c)
+					i += 2
+					continue
+				}
+			}
+			b.WriteString(`\x`)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,684 @@
+package networkmanager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WPACtrlDir holds the per-interface wpa_supplicant control sockets on dhcpcd based images.
+const WPACtrlDir = "/run/wpa_supplicant"
+
+const (
+	apAddress = "10.42.0.1/24"
+
+	hostapdConf = `interface=%s
+driver=nl80211
+ssid=%s
+hw_mode=g
+channel=6
+auth_algs=1
+wmm_enabled=0
+`
+	hostapdWPA2Conf = `wpa=2
+wpa_key_mgmt=WPA-PSK
+rsn_pairwise=CCMP
+wpa_passphrase=%s
+`
+	hostapdWPA3Conf = `wpa=2
+wpa_key_mgmt=SAE
+rsn_pairwise=CCMP
+ieee80211w=2
+sae_password=%s
+`
+	dnsmasqConf = `interface=%s
+bind-interfaces
+dhcp-range=10.42.0.10,10.42.0.254,255.255.255.0,12h
+dhcp-option=option:router,10.42.0.1
+dhcp-leasefile=%s
+`
+)
+
+type wpaManager struct {
+	ctrl      *wpaCtrl
+	status    NetworkStatus
+	settings  Settings
+	runner    CommandRunner
+	sleep     func(time.Duration)
+	configDir string
+	runDir    string
+	// dhcpcdConf holds the static IPv4 configuration of networks and the Ethernet interface
+	dhcpcdConf string
+}
+
+// NewWPA returns a NetworkManager for images running dhcpcd and wpa_supplicant.
+// Client networks are managed through the wpa_supplicant control socket at ctrlPath,
+// and the AP is served by hostapd and dnsmasq.
+func NewWPA(ctrlPath string, settings Settings, runner CommandRunner) NetworkManager {
+	if runner == nil {
+		runner = ExecRunner{}
+	}
+	nm := &wpaManager{
+		ctrl: &wpaCtrl{path: ctrlPath, timeout: 10 * time.Second},
+		status: NetworkStatus{
+			APSSID: settings.apSSID(),
+		},
+		settings:   settings,
+		runner:     runner,
+		sleep:      time.Sleep,
+		configDir:  "/etc/pifi",
+		runDir:     "/run",
+		dhcpcdConf: DefaultDHCPCDConf,
+	}
+	nm.GetNetworkStatus()
+	return nm
+}
+
+func (nm *wpaManager) output(name string, args ...string) ([]byte, error) {
+	return nm.runner.Output(context.Background(), name, args...)
+}
+
+func (nm *wpaManager) combinedOutput(name string, args ...string) ([]byte, error) {
+	return nm.runner.CombinedOutput(context.Background(), name, args...)
+}
+
+func (nm *wpaManager) hostapdPidFile() string {
+	return filepath.Join(nm.runDir, "pifi-hostapd.pid")
+}
+
+func (nm *wpaManager) dnsmasqPidFile() string {
+	return filepath.Join(nm.runDir, "pifi-dnsmasq.pid")
+}
+
+func (nm *wpaManager) GetNetworkStatus() (NetworkStatus, error) {
+	reply, err := nm.ctrl.request("STATUS")
+	if err != nil {
+		return nm.status, err
+	}
+	wpaStatus := parseWPAKeyValues(reply)
+
+	networkStatus := NetworkStatus{
+		APSSID:       nm.status.APSSID,
+		State:        "Disconnected",
+		Connectivity: "None",
+		WifiHW:       "Enabled",
+		Wifi:         "Enabled",
+		SignalStr:    -1,
+		Mode:         nm.currentMode(),
+		IPs:          ipNetworkIps(nm.runner, nm.settings),
+	}
+	if wpaStatus["wpa_state"] == "INTERFACE_DISABLED" {
+		networkStatus.Wifi = "Disabled"
+	}
+	if wpaStatus["wpa_state"] == "COMPLETED" {
+		networkStatus.WifiSSID = unescapeWPAString(wpaStatus["ssid"])
+		networkStatus.SignalStr = nm.getWifiSignal()
+		selector := dhcpcdSelector(networkStatus.WifiSSID, "")
+		if networkStatus.IPs.WifiState == "online" {
+			networkStatus.IPs.WifiIPv4Method = dhcpcdMethod(nm.dhcpcdConf, selector)
+		}
+		if networkStatus.IPs.WifiState == "online" || len(networkStatus.IPs.WifiIPv6) > 0 {
+			networkStatus.IPs.WifiIPv6Method = dhcpcdIPv6Method(nm.dhcpcdConf, selector)
+		}
+	}
+	ethSelector := dhcpcdSelector("", nm.settings.EthernetInterface)
+	if networkStatus.IPs.EthState == "online" {
+		networkStatus.IPs.EthIPv4Method = dhcpcdMethod(nm.dhcpcdConf, ethSelector)
+	}
+	if networkStatus.IPs.EthState == "online" || len(networkStatus.IPs.EthIPv6) > 0 {
+		networkStatus.IPs.EthIPv6Method = dhcpcdIPv6Method(nm.dhcpcdConf, ethSelector)
+	}
+	if networkStatus.IPs.WifiState == "online" || networkStatus.IPs.EthState == "online" {
+		networkStatus.State = "Connected"
+		networkStatus.Connectivity = "Limited"
+		if pingTest(nm.runner, nm.settings) {
+			networkStatus.Connectivity = "Full"
+		}
+	}
+
+	nm.status = networkStatus
+	return networkStatus, nil
+}
+
+// Converts the RSSI reported by SIGNAL_POLL into the 0-100 scale nmcli uses
+func (nm *wpaManager) getWifiSignal() int32 {
+	reply, err := nm.ctrl.request("SIGNAL_POLL")
+	if err != nil {
+		return -1
+	}
+	rssi, err := strconv.Atoi(parseWPAKeyValues(reply)["RSSI"])
+	if err != nil {
+		return -1
+	}
+	return rssiToQuality(rssi)
+}
+
+func rssiToQuality(rssi int) int32 {
+	quality := 2 * (rssi + 100)
+	if quality < 0 {
+		quality = 0
+	} else if quality > 100 {
+		quality = 100
+	}
+	return int32(quality)
+}
+
+func (nm *wpaManager) apRunning() bool {
+	_, err := nm.output("pgrep", "-F", nm.hostapdPidFile())
+	return err == nil
+}
+
+func (nm *wpaManager) currentMode() string {
+	if nm.apRunning() {
+		return ModeAP
+	}
+	reply, err := nm.ctrl.request("STATUS")
+	if err != nil {
+		return "unknown"
+	}
+	if parseWPAKeyValues(reply)["wpa_state"] == "COMPLETED" {
+		return ModeClient
+	}
+	return "inactive"
+}
+
+// Switches between client and AP modes
+func (nm *wpaManager) SetWifiMode(mode string) error {
+	switch mode {
+	case ModeAP:
+		if nm.apRunning() {
+			return nil
+		}
+		if err := nm.startAP(); err != nil {
+			return err
+		}
+		nm.sleep(time.Second)
+		if nm.currentMode() != ModeAP {
+			return fmt.Errorf("mode change verification failed")
+		}
+	case ModeClient:
+		if nm.apRunning() {
+			if err := nm.stopAP(); err != nil {
+				return fmt.Errorf("failed to disable AP mode: %v", err)
+			}
+		}
+		if _, err := nm.ctrl.request("RECONNECT"); err != nil {
+			return fmt.Errorf("no active client connection: %v", err)
+		}
+	default:
+		return fmt.Errorf("unsupported mode: %s", mode)
+	}
+	return nil
+}
+
+func (nm *wpaManager) startAP() error {
+	if _, err := os.Stat(filepath.Join(nm.configDir, "hostapd.conf")); err != nil {
+		return fmt.Errorf("AP not configured: %v", err)
+	}
+	if _, err := nm.ctrl.request("DISCONNECT"); err != nil {
+		return fmt.Errorf("failed to release %s from wpa_supplicant: %v", nm.settings.WifiInterface, err)
+	}
+	if output, err := nm.combinedOutput("ip", "addr", "replace", apAddress, "dev", nm.settings.WifiInterface); err != nil {
+		return fmt.Errorf("failed to assign AP address: %v\nOutput: %s", err, output)
+	}
+	if output, err := nm.combinedOutput("hostapd", "-B", "-P", nm.hostapdPidFile(),
+		filepath.Join(nm.configDir, "hostapd.conf")); err != nil {
+		return fmt.Errorf("failed to start hostapd: %v\nOutput: %s", err, output)
+	}
+	if output, err := nm.combinedOutput("dnsmasq",
+		"--conf-file="+filepath.Join(nm.configDir, "dnsmasq.conf"),
+		"--pid-file="+nm.dnsmasqPidFile()); err != nil {
+		return fmt.Errorf("failed to start dnsmasq: %v\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+func (nm *wpaManager) stopAP() error {
+	nm.output("pkill", "-F", nm.dnsmasqPidFile())
+	if output, err := nm.combinedOutput("pkill", "-F", nm.hostapdPidFile()); err != nil {
+		return fmt.Errorf("failed to stop hostapd: %v\nOutput: %s", err, output)
+	}
+	nm.output("ip", "addr", "del", apAddress, "dev", nm.settings.WifiInterface)
+	return nil
+}
+
+// Writes the hostapd and dnsmasq configuration used for AP mode
+func (nm *wpaManager) SetupAPConnection() error {
+	if err := os.MkdirAll(nm.configDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", nm.configDir, err)
+	}
+	hostapd := fmt.Sprintf(hostapdConf, nm.settings.WifiInterface, nm.status.APSSID)
+	switch {
+	case nm.settings.APPassphrase == "":
+	case nm.settings.APSecurity == APSecurityWPA3:
+		hostapd += fmt.Sprintf(hostapdWPA3Conf, nm.settings.APPassphrase)
+	default:
+		hostapd += fmt.Sprintf(hostapdWPA2Conf, nm.settings.APPassphrase)
+	}
+	if err := os.WriteFile(filepath.Join(nm.configDir, "hostapd.conf"), []byte(hostapd), 0o600); err != nil {
+		return fmt.Errorf("failed to write hostapd config: %v", err)
+	}
+	dnsmasq := fmt.Sprintf(dnsmasqConf, nm.settings.WifiInterface, filepath.Join(nm.runDir, "pifi-dnsmasq.leases"))
+	if nm.settings.CaptiveDNS {
+		dnsmasq += dnsmasqCaptiveConf
+	}
+	if err := os.WriteFile(filepath.Join(nm.configDir, "dnsmasq.conf"), []byte(dnsmasq), 0o644); err != nil {
+		return fmt.Errorf("failed to write dnsmasq config: %v", err)
+	}
+	return nil
+}
+
+// Scan for available networks, grouped by SSID
+func (nm *wpaManager) FindAvailableNetworks() ([]ScanResult, error) {
+	if _, err := nm.ctrl.request("SCAN"); err != nil && !strings.Contains(err.Error(), "FAIL-BUSY") {
+		return nil, fmt.Errorf("failed to initiate network scan: %v", err)
+	}
+	nm.sleep(2 * time.Second)
+	return nm.scanResults()
+}
+
+// Returns the networks found by the last scan without rescanning
+func (nm *wpaManager) scanResults() ([]ScanResult, error) {
+	reply, err := nm.ctrl.request("SCAN_RESULTS")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list available networks: %v", err)
+	}
+	var current string
+	if status, err := nm.ctrl.request("STATUS"); err == nil {
+		if values := parseWPAKeyValues(status); values["wpa_state"] == "COMPLETED" {
+			current = values["bssid"]
+		}
+	}
+
+	scanned := make([]scannedBSS, 0)
+	// bssid / frequency / signal level / flags / ssid
+	for _, line := range strings.Split(reply, "\n")[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 5 {
+			continue
+		}
+		freq, _ := strconv.ParseUint(fields[1], 10, 32)
+		rssi, _ := strconv.Atoi(fields[2])
+		scanned = append(scanned, scannedBSS{
+			ssid: strings.TrimSpace(unescapeWPAString(fields[4])),
+			BSS:  newBSS(fields[0], rssiToQuality(rssi), uint32(freq), wpaSecurity(fields[3]), fields[0] == current),
+		})
+	}
+	return groupScanResults(scanned), nil
+}
+
+// Maps scan result flags such as [WPA2-PSK-CCMP][ESS] to a security type
+func wpaSecurity(flags string) string {
+	switch {
+	case strings.Contains(flags, "-EAP"):
+		return SecurityEnterprise
+	case strings.Contains(flags, "SAE") && strings.Contains(flags, "PSK"):
+		return SecurityWPA2WPA3
+	case strings.Contains(flags, "SAE"):
+		return SecurityWPA3SAE
+	case strings.Contains(flags, "WPA2-PSK") || strings.Contains(flags, "RSN-PSK"):
+		return SecurityWPA2PSK
+	case strings.Contains(flags, "WPA-PSK"):
+		return SecurityWPAPSK
+	case strings.Contains(flags, "OWE"):
+		return SecurityOWE
+	case strings.Contains(flags, "WEP"):
+		return SecurityWEP
+	}
+	return SecurityOpen
+}
+
+type wpaNetwork struct {
+	id       string
+	ssid     string
+	disabled bool
+	current  bool
+}
+
+func (nm *wpaManager) listNetworks() ([]wpaNetwork, error) {
+	reply, err := nm.ctrl.request("LIST_NETWORKS")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list configured connections: %v", err)
+	}
+	networks := make([]wpaNetwork, 0)
+	// network id / ssid / bssid / flags
+	for _, line := range strings.Split(reply, "\n")[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		network := wpaNetwork{id: fields[0], ssid: unescapeWPAString(fields[1])}
+		if len(fields) >= 4 {
+			network.disabled = strings.Contains(fields[3], "[DISABLED]")
+			network.current = strings.Contains(fields[3], "[CURRENT]")
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (nm *wpaManager) findNetwork(ssid string) (string, error) {
+	networks, err := nm.listNetworks()
+	if err != nil {
+		return "", err
+	}
+	for _, network := range networks {
+		if network.ssid == ssid {
+			return network.id, nil
+		}
+	}
+	return "", fmt.Errorf("connection %s not found", ssid)
+}
+
+// Get a list of configured connections
+func (nm *wpaManager) GetConfiguredConnections() ([]ConnectionInfo, error) {
+	networks, err := nm.listNetworks()
+	if err != nil {
+		return nil, err
+	}
+	connections := make([]ConnectionInfo, 0, len(networks))
+	for _, network := range networks {
+		// wpa_supplicant only returns the passphrase when built with CONFIG_CTRL_IFACE_SECRETS
+		psk, err := nm.ctrl.request("GET_NETWORK " + network.id + " psk")
+		password := strings.Trim(strings.TrimSpace(psk), `"`)
+		if err != nil || password == "*" {
+			password = ""
+		}
+		connections = append(connections, ConnectionInfo{
+			SSID:     network.ssid,
+			Password: password,
+		})
+	}
+	return connections, nil
+}
+
+func (nm *wpaManager) setNetwork(id, key, value string) error {
+	if _, err := nm.ctrl.request(fmt.Sprintf("SET_NETWORK %s %s %s", id, key, value)); err != nil {
+		return fmt.Errorf("failed to set %s: %v", key, err)
+	}
+	return nil
+}
+
+func (nm *wpaManager) setAutoConnect(id string, autoConnect bool) error {
+	cmd := "DISABLE_NETWORK " + id
+	if autoConnect {
+		cmd = "ENABLE_NETWORK " + id + " no-connect"
+	}
+	_, err := nm.ctrl.request(cmd)
+	return err
+}
+
+func (nm *wpaManager) saveConfig() error {
+	if _, err := nm.ctrl.request("SAVE_CONFIG"); err != nil {
+		return fmt.Errorf("failed to save wpa_supplicant config: %v", err)
+	}
+	return nil
+}
+
+// Modify a connection if it exists, otherwise create a new one
+func (nm *wpaManager) ModifyNetworkConnection(conn ConnectionConfig) error {
+	if conn.IPv4 != nil {
+		if err := conn.IPv4.Validate(); err != nil {
+			return err
+		}
+	}
+	if conn.IPv6 != nil {
+		if err := conn.IPv6.Validate(); err != nil {
+			return err
+		}
+	}
+	id, err := nm.findNetwork(conn.SSID)
+	keep := err == nil && conn.keepsSecurity()
+	if !keep {
+		if err := resolveSecurity(&conn, nm.scanResults); err != nil {
+			return err
+		}
+		// Passphrases are sent quoted, wpa_supplicant has no way to escape quotes in them
+		if (conn.Security == SecurityWPA2PSK || conn.Security == SecurityWPA3SAE) &&
+			strings.ContainsFunc(conn.Password, func(c rune) bool { return c == '"' || c < 0x20 || c == 0x7f }) {
+			return fmt.Errorf("password for %s must not contain quotes or control characters", conn.SSID)
+		}
+	}
+	if conn.Enterprise != nil {
+		if err := conn.Enterprise.Validate(); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		reply, err := nm.ctrl.request("ADD_NETWORK")
+		if err != nil {
+			return fmt.Errorf("failed to create connection: %v", err)
+		}
+		id = strings.TrimSpace(reply)
+		// Hex encoding avoids quoting issues with unusual SSIDs
+		if err := nm.setNetwork(id, "ssid", fmt.Sprintf("%x", conn.SSID)); err != nil {
+			return fmt.Errorf("failed to create connection: %v", err)
+		}
+	}
+
+	switch {
+	case keep:
+		// The stored security settings are left unchanged
+	case conn.Security == SecurityEnterprise:
+		if err := nm.setEnterprise(id, conn.SSID, conn.Enterprise); err != nil {
+			return fmt.Errorf("failed to modify connection: %v", err)
+		}
+	default:
+		if err := nm.setSecurity(id, conn); err != nil {
+			return fmt.Errorf("failed to modify connection: %v", err)
+		}
+	}
+	// scan_ssid makes wpa_supplicant probe for networks that don't broadcast their SSID
+	if err := nm.setNetwork(id, "scan_ssid", map[bool]string{true: "1", false: "0"}[conn.Hidden]); err != nil {
+		return fmt.Errorf("failed to modify connection: %v", err)
+	}
+	if err := nm.setAutoConnect(id, conn.AutoConnect); err != nil {
+		return fmt.Errorf("failed to modify connection: %v", err)
+	}
+	if err := nm.saveConfig(); err != nil {
+		return err
+	}
+	if conn.IPv4 != nil {
+		if err := nm.SetIPv4Config(conn.SSID, *conn.IPv4); err != nil {
+			return err
+		}
+	}
+	if conn.IPv6 != nil {
+		return nm.SetIPv6Config(conn.SSID, *conn.IPv6)
+	}
+	return nil
+}
+
+// Set the IPv4 configuration of a network or the Ethernet interface in dhcpcd.conf.
+// dhcpcd is asked to rebind the interface so the change takes effect immediately.
+func (nm *wpaManager) SetIPv4Config(ssid string, config IPv4Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	iface := nm.settings.WifiInterface
+	if ssid == "" {
+		iface = nm.settings.EthernetInterface
+	}
+	if err := writeDHCPCDConfig(nm.dhcpcdConf, dhcpcdSelector(ssid, iface), config); err != nil {
+		return fmt.Errorf("failed to set IPv4 configuration: %v", err)
+	}
+	if output, err := nm.combinedOutput("dhcpcd", "-n", iface); err != nil {
+		return fmt.Errorf("failed to apply IPv4 configuration: %v\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+// Set the IPv6 configuration of a network or the Ethernet interface in dhcpcd.conf
+func (nm *wpaManager) SetIPv6Config(ssid string, config IPv6Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	iface := nm.settings.WifiInterface
+	if ssid == "" {
+		iface = nm.settings.EthernetInterface
+	}
+	if err := writeDHCPCDIPv6Config(nm.dhcpcdConf, dhcpcdSelector(ssid, iface), config); err != nil {
+		return fmt.Errorf("failed to set IPv6 configuration: %v", err)
+	}
+	if output, err := nm.combinedOutput("dhcpcd", "-n", iface); err != nil {
+		return fmt.Errorf("failed to apply IPv6 configuration: %v\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+// Sets the network block variables of open, OWE and pre-shared key networks.
+// SAE and OWE require management frame protection. Quoted psk values are passphrases,
+// 64 digit hex keys are sent unquoted.
+func (nm *wpaManager) setSecurity(id string, conn ConnectionConfig) error {
+	psk := `"` + conn.Password + `"`
+	if hexPSK(conn.Password) {
+		psk = conn.Password
+	}
+	values := map[string][][2]string{
+		SecurityOpen:    {{"key_mgmt", "NONE"}, {"ieee80211w", "0"}},
+		SecurityOWE:     {{"key_mgmt", "OWE"}, {"ieee80211w", "2"}},
+		SecurityWPA2PSK: {{"key_mgmt", "WPA-PSK"}, {"ieee80211w", "0"}, {"psk", psk}},
+		SecurityWPA3SAE: {{"key_mgmt", "SAE"}, {"ieee80211w", "2"}, {"sae_password", `"` + conn.Password + `"`}},
+	}[conn.Security]
+	for _, v := range values {
+		if err := nm.setNetwork(id, v[0], v[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets the 802.1X network block variables, string values are quoted
+func (nm *wpaManager) setEnterprise(id, ssid string, e *EnterpriseConfig) error {
+	certs, err := writeCertificates(nm.settings.CertDir, ssid, e)
+	if err != nil {
+		return err
+	}
+	values := [][2]string{
+		{"key_mgmt", "WPA-EAP"},
+		{"eap", strings.ToUpper(e.EAP)},
+		{"identity", `"` + e.Identity + `"`},
+	}
+	if e.AnonymousIdentity != "" {
+		values = append(values, [2]string{"anonymous_identity", `"` + e.AnonymousIdentity + `"`})
+	}
+	if e.EAP != EAPTLS {
+		values = append(values, [2]string{"phase2", `"auth=` + strings.ToUpper(e.Phase2) + `"`})
+	}
+	if e.Password != "" {
+		values = append(values, [2]string{"password", `"` + e.Password + `"`})
+	}
+	if certs.caCert != "" {
+		values = append(values, [2]string{"ca_cert", `"` + certs.caCert + `"`})
+	}
+	if certs.clientCert != "" {
+		values = append(values, [2]string{"client_cert", `"` + certs.clientCert + `"`})
+	}
+	if certs.privateKey != "" {
+		values = append(values, [2]string{"private_key", `"` + certs.privateKey + `"`})
+		if e.PrivateKeyPassword != "" {
+			values = append(values, [2]string{"private_key_passwd", `"` + e.PrivateKeyPassword + `"`})
+		}
+	}
+	for _, v := range values {
+		if err := nm.setNetwork(id, v[0], v[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove a saved connection by name
+func (nm *wpaManager) RemoveNetworkConnection(ssid string) error {
+	id, err := nm.findNetwork(ssid)
+	if err != nil {
+		return fmt.Errorf("failed to delete connection: %v", err)
+	}
+	if _, err := nm.ctrl.request("REMOVE_NETWORK " + id); err != nil {
+		return fmt.Errorf("failed to delete connection: %v", err)
+	}
+	return nm.saveConfig()
+}
+
+// Set autoconnect for a saved connection by name
+func (nm *wpaManager) SetAutoConnectConnection(ssid string, autoConnect bool) error {
+	id, err := nm.findNetwork(ssid)
+	if err != nil {
+		return fmt.Errorf("failed to set autoconnect for %s: %v", ssid, err)
+	}
+	if err := nm.setAutoConnect(id, autoConnect); err != nil {
+		return fmt.Errorf("failed to set autoconnect for %s: %v", ssid, err)
+	}
+	return nm.saveConfig()
+}
+
+// Connect to a saved network by name. The AP name starts hostapd instead.
+func (nm *wpaManager) ConnectNetwork(ssid string) error {
+	if ssid == nm.status.APSSID {
+		if err := nm.startAP(); err != nil {
+			return fmt.Errorf("failed to connect to %s: %v", ssid, err)
+		}
+		return nil
+	}
+
+	id, err := nm.findNetwork(ssid)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", ssid, err)
+	}
+	if nm.apRunning() {
+		if err := nm.stopAP(); err != nil {
+			return fmt.Errorf("failed to connect to %s: %v", ssid, err)
+		}
+	}
+	if _, err := nm.ctrl.request("SELECT_NETWORK " + id); err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", ssid, err)
+	}
+	return nil
+}
+
+// Enable the AP if there's no internet connection for a certain amount of time. This will run in the background.
+func (nm *wpaManager) ManageOfflineAP(connectionLossTimeout time.Duration) error {
+	return manageOfflineAP(nm, nm.sleep, nm.settings.PollInterval, connectionLossTimeout)
+}
+
+// Returns ModeAP, ModeClient or the state of the wifi interface
+func (nm *wpaManager) GetWifiMode() string {
+	return nm.currentMode()
+}
+
+// List the clients of the access point with their dnsmasq leases
+func (nm *wpaManager) GetAPClients() ([]APClient, error) {
+	if nm.currentMode() != ModeAP {
+		return []APClient{}, nil
+	}
+	return apClients(nm.runner, nm.settings.WifiInterface, filepath.Join(nm.runDir, "pifi-dnsmasq.leases"))
+}
+
+// Disconnect a client from the access point
+func (nm *wpaManager) DisconnectAPClient(mac string) error {
+	if nm.currentMode() != ModeAP {
+		return fmt.Errorf("failed to disconnect %s: not in AP mode", mac)
+	}
+	return disconnectAPClient(nm.runner, nm.settings.WifiInterface, mac)
+}
+
+// Answer DNS queries of AP clients with the AP address while AP mode is active. This will run in the background.
+func (nm *wpaManager) ManageCaptiveDNS() error {
+	return manageCaptiveDNS(nm, nm.runner, nm.settings, nm.sleep)
+}
+
+func (nm *wpaManager) wlanOnline() bool {
+	reply, err := nm.ctrl.request("STATUS")
+	if err != nil || parseWPAKeyValues(reply)["wpa_state"] != "COMPLETED" {
+		return false
+	}
+	return pingTest(nm.runner, nm.settings)
+}
+
+func (nm *wpaManager) enableAP() error {
+	return nm.ConnectNetwork(nm.status.APSSID)
+}
@@ -0,0 +1,369 @@
+// Package webhooks posts status events to the configured URLs, signed with HMAC-SHA256.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/HanzalaGun/pifi/networkmanager"
+)
+
+// Headers of webhook requests
+const (
+	// SignatureHeader is "sha256=" followed by the hex HMAC-SHA256 of the body, see Sign
+	SignatureHeader = "X-PiFi-Signature"
+	EventHeader     = "X-PiFi-Event"
+	// DeliveryHeader is the ID of the payload, which is sent again when a retry follows a timeout
+	DeliveryHeader = "X-PiFi-Delivery"
+)
+
+// Events webhooks can be configured for, all of them by default
+var Events = []string{
+	networkmanager.EventConnected,
+	networkmanager.EventDisconnected,
+	networkmanager.EventModeChanged,
+	networkmanager.EventAPEnabled,
+	networkmanager.EventAPFallback,
+	networkmanager.EventIPChanged,
+}
+
+const (
+	// The oldest deliveries are dropped beyond this, so a long time offline doesn't fill the disk
+	maxQueue        = 500
+	minBackoff      = 10 * time.Second
+	maxBackoff      = 15 * time.Minute
+	deliveryTimeout = 10 * time.Second
+)
+
+// Webhook receives the Events of a device as JSON Payloads
+type Webhook struct {
+	URL    string
+	Secret string
+	// Events limits the events sent, all Events when empty
+	Events []string
+}
+
+func (w Webhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return slices.Contains(Events, event)
+	}
+	return slices.Contains(w.Events, event)
+}
+
+// Payload is the body of webhook requests, the event with the device it happened on
+type Payload struct {
+	ID     string `json:"id"`
+	Device string `json:"device"`
+	networkmanager.StatusEvent
+}
+
+// A payload waiting to be sent to URL. Secrets aren't stored, they are taken from
+// the config when sending.
+type delivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Event       string          `json:"event"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+}
+
+// Dispatcher queues the payloads in a JSON file and sends them in order to each URL.
+// Failed deliveries are retried with exponential backoff, and right away once the
+// device is connected again.
+type Dispatcher struct {
+	path     string
+	device   string
+	webhooks map[string]Webhook
+	hooks    []Webhook
+	client   *http.Client
+	now      func() time.Time
+	wake     chan struct{}
+
+	mu    sync.Mutex
+	queue []delivery
+}
+
+// Open returns a Dispatcher for webhooks keeping its queue at path. Queued payloads
+// for URLs that are no longer configured are dropped.
+func Open(path string, webhooks []Webhook, device string) (*Dispatcher, error) {
+	d := &Dispatcher{
+		path:     path,
+		device:   device,
+		webhooks: make(map[string]Webhook),
+		hooks:    webhooks,
+		client:   &http.Client{Timeout: deliveryTimeout},
+		now:      time.Now,
+		wake:     make(chan struct{}, 1),
+	}
+	for _, hook := range webhooks {
+		d.webhooks[hook.URL] = hook
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook queue: %v", err)
+	}
+	var queue []delivery
+	if err := json.Unmarshal(data, &queue); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	for _, entry := range queue {
+		if _, ok := d.webhooks[entry.URL]; ok {
+			d.queue = append(d.queue, entry)
+		}
+	}
+	if len(d.queue) > 0 {
+		log.Printf("%d webhook deliveries queued", len(d.queue))
+	}
+	return d, nil
+}
+
+// Watch queues every event until the channel is closed
+func (d *Dispatcher) Watch(events <-chan networkmanager.StatusEvent) {
+	for event := range events {
+		d.Enqueue(event)
+	}
+}
+
+// Enqueue queues event for the webhooks that want it. Events that show the device
+// is connected again reset the backoff of the queued deliveries.
+func (d *Dispatcher) Enqueue(event networkmanager.StatusEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if online(event) {
+		for i := range d.queue {
+			d.queue[i].Attempts, d.queue[i].NextAttempt = 0, time.Time{}
+		}
+	}
+	for _, hook := range d.hooks {
+		if !hook.wants(event.Type) {
+			continue
+		}
+		id, err := newID()
+		if err != nil {
+			log.Printf("Failed to queue webhook: %v", err)
+			return
+		}
+		body, err := json.Marshal(Payload{ID: id, Device: d.device, StatusEvent: event})
+		if err != nil {
+			log.Printf("Failed to queue webhook: %v", err)
+			return
+		}
+		d.queue = append(d.queue, delivery{ID: id, URL: hook.URL, Event: event.Type, Body: body})
+	}
+	if len(d.queue) > maxQueue {
+		log.Printf("Webhook queue full, dropping %d deliveries", len(d.queue)-maxQueue)
+		d.queue = slices.Clone(d.queue[len(d.queue)-maxQueue:])
+	}
+	if err := d.save(); err != nil {
+		log.Println(err)
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// The device has an address again after being offline or in AP mode
+func online(event networkmanager.StatusEvent) bool {
+	switch event.Type {
+	case networkmanager.EventConnected:
+		return true
+	case networkmanager.EventIPChanged:
+		return event.Mode == networkmanager.ModeClient && (event.WifiIP != "" || event.EthernetIP != "")
+	}
+	return false
+}
+
+// Run sends the queued payloads until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	for {
+		next := d.deliver(ctx)
+		var retry <-chan time.Time
+		if !next.IsZero() {
+			retry = time.After(next.Sub(d.now()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-retry:
+		}
+	}
+}
+
+// Sends the first payload of every URL that is due, and returns when the next
+// payload is due, zero when the queue is empty
+func (d *Dispatcher) deliver(ctx context.Context) time.Time {
+	d.mu.Lock()
+	var due []delivery
+	for _, entry := range d.heads() {
+		if !entry.NextAttempt.After(d.now()) {
+			due = append(due, entry)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, entry := range due {
+		err := d.send(ctx, entry)
+		var rejected *rejectedError
+		switch {
+		case err == nil:
+			d.remove(entry.ID)
+		case errors.As(err, &rejected):
+			log.Printf("Webhook %s rejected %s, dropping it: %v", entry.URL, entry.Event, err)
+			d.remove(entry.ID)
+		default:
+			log.Printf("Failed to send %s to webhook %s: %v", entry.Event, entry.URL, err)
+			d.retryLater(entry.ID)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var next time.Time
+	for _, entry := range d.heads() {
+		// Payloads queued during this round are due now
+		at := entry.NextAttempt
+		if at.IsZero() {
+			at = d.now()
+		}
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next
+}
+
+// Returns the first queued delivery of every URL, d.mu must be held
+func (d *Dispatcher) heads() []delivery {
+	seen := make(map[string]bool)
+	var heads []delivery
+	for _, entry := range d.queue {
+		if !seen[entry.URL] {
+			seen[entry.URL] = true
+			heads = append(heads, entry)
+		}
+	}
+	return heads
+}
+
+func (d *Dispatcher) remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queue = slices.DeleteFunc(d.queue, func(entry delivery) bool { return entry.ID == id })
+	if err := d.save(); err != nil {
+		log.Println(err)
+	}
+}
+
+func (d *Dispatcher) retryLater(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := slices.IndexFunc(d.queue, func(entry delivery) bool { return entry.ID == id })
+	if i < 0 {
+		return
+	}
+	d.queue[i].Attempts++
+	d.queue[i].NextAttempt = d.now().Add(backoff(d.queue[i].Attempts))
+	if err := d.save(); err != nil {
+		log.Println(err)
+	}
+}
+
+// Doubles from minBackoff after every failed attempt, up to maxBackoff
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+// A failure that retrying won't fix
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (d *Dispatcher) send(ctx context.Context, entry delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, entry.URL, bytes.NewReader(entry.Body))
+	if err != nil {
+		return &rejectedError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PiFi")
+	req.Header.Set(SignatureHeader, Sign(d.webhooks[entry.URL].Secret, entry.Body))
+	req.Header.Set(EventHeader, entry.Event)
+	req.Header.Set(DeliveryHeader, entry.ID)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	// Other client errors mean the payload itself was refused
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return &rejectedError{err: fmt.Errorf("unexpected status %s", resp.Status)}
+	}
+	return fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// Sign returns the value of the SignatureHeader for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Writes the queue to a temporary file first so a crash doesn't lose it, d.mu must be held
+func (d *Dispatcher) save() error {
+	data, err := json.Marshal(d.queue)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.path), 0o700); err != nil {
+		return fmt.Errorf("failed to save webhook queue: %v", err)
+	}
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save webhook queue: %v", err)
+	}
+	if err := os.Rename(tmp, d.path); err != nil {
+		return fmt.Errorf("failed to save webhook queue: %v", err)
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
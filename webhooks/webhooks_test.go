@@ -0,0 +1,160 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HanzalaGun/pifi/networkmanager"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	payloads []Payload
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, status int) (*receiver, *httptest.Server) {
+	rec := &receiver{status: status}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if rec.status == http.StatusOK {
+			var payload Payload
+			if err := json.Unmarshal(body, &payload); err != nil {
+				t.Errorf("invalid payload %s: %v", body, err)
+			}
+			rec.payloads = append(rec.payloads, payload)
+			rec.headers = append(rec.headers, r.Header)
+			rec.bodies = append(rec.bodies, body)
+		}
+		w.WriteHeader(rec.status)
+	}))
+	t.Cleanup(srv.Close)
+	return rec, srv
+}
+
+func (rec *receiver) setStatus(status int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.status = status
+}
+
+func TestDeliver(t *testing.T) {
+	all, allSrv := newReceiver(t, http.StatusOK)
+	fallback, fallbackSrv := newReceiver(t, http.StatusOK)
+	d, err := Open(filepath.Join(t.TempDir(), "webhooks.json"), []Webhook{
+		{URL: allSrv.URL, Secret: "s3cret"},
+		{URL: fallbackSrv.URL, Secret: "other", Events: []string{networkmanager.EventAPFallback}},
+	}, "pifi-kitchen")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	d.Enqueue(networkmanager.StatusEvent{Type: networkmanager.EventDisconnected, Time: now, Mode: networkmanager.ModeClient, SSID: "Home"})
+	d.Enqueue(networkmanager.StatusEvent{Type: networkmanager.EventAPFallback, Time: now, Mode: networkmanager.ModeAP, SSID: "PiFi-AP"})
+	d.Enqueue(networkmanager.StatusEvent{Type: networkmanager.EventScanCompleted, Time: now, Networks: 3})
+	for !d.deliver(context.Background()).IsZero() {
+	}
+
+	if len(all.payloads) != 2 || all.payloads[0].Type != networkmanager.EventDisconnected || all.payloads[1].Type != networkmanager.EventAPFallback {
+		t.Fatalf("payloads = %+v, want disconnected and ap-fallback", all.payloads)
+	}
+	payload, header := all.payloads[0], all.headers[0]
+	if payload.Device != "pifi-kitchen" || payload.SSID != "Home" || payload.ID == "" || !payload.Time.Equal(now) {
+		t.Errorf("payload = %+v", payload)
+	}
+	if header.Get(SignatureHeader) != Sign("s3cret", all.bodies[0]) {
+		t.Errorf("signature %q doesn't match the body", header.Get(SignatureHeader))
+	}
+	if header.Get(EventHeader) != networkmanager.EventDisconnected || header.Get(DeliveryHeader) != payload.ID {
+		t.Errorf("headers = %v", header)
+	}
+	if len(fallback.payloads) != 1 || fallback.payloads[0].Type != networkmanager.EventAPFallback {
+		t.Errorf("filtered payloads = %+v, want ap-fallback", fallback.payloads)
+	}
+	if fallback.headers[0].Get(SignatureHeader) != Sign("other", fallback.bodies[0]) {
+		t.Error("signed with the secret of another webhook")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	rec, srv := newReceiver(t, http.StatusServiceUnavailable)
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	webhooks := []Webhook{{URL: srv.URL, Secret: "s3cret"}}
+	d, err := Open(path, webhooks, "pifi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	d.Enqueue(networkmanager.StatusEvent{Type: networkmanager.EventDisconnected, Mode: networkmanager.ModeClient, SSID: "Home"})
+	d.Enqueue(networkmanager.StatusEvent{Type: networkmanager.EventModeChanged, Mode: networkmanager.ModeAP})
+	if next := d.deliver(context.Background()); !next.Equal(now.Add(minBackoff)) {
+		t.Errorf("next attempt at %v, want %v", next, now.Add(minBackoff))
+	}
+	rec.setStatus(http.StatusOK)
+	d.deliver(context.Background())
+	if len(rec.payloads) != 0 {
+		t.Fatal("retried before the backoff")
+	}
+
+	// The queue survives a restart
+	d, err = Open(path, webhooks, "pifi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.now = func() time.Time { return now }
+	if len(d.queue) != 2 || d.queue[0].Attempts != 1 {
+		t.Fatalf("queue after restart = %+v", d.queue)
+	}
+
+	// Connecting again retries right away, in order
+	d.Enqueue(networkmanager.StatusEvent{Type: networkmanager.EventConnected, Mode: networkmanager.ModeClient, SSID: "Home"})
+	for !d.deliver(context.Background()).IsZero() {
+	}
+	var types []string
+	for _, payload := range rec.payloads {
+		types = append(types, payload.Type)
+	}
+	if len(types) != 3 || types[0] != networkmanager.EventDisconnected || types[1] != networkmanager.EventModeChanged || types[2] != networkmanager.EventConnected {
+		t.Errorf("delivered %v", types)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	_, srv := newReceiver(t, http.StatusBadRequest)
+	d, err := Open(filepath.Join(t.TempDir(), "webhooks.json"), []Webhook{{URL: srv.URL, Secret: "s3cret"}}, "pifi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Enqueue(networkmanager.StatusEvent{Type: networkmanager.EventConnected})
+	if next := d.deliver(context.Background()); !next.IsZero() || len(d.queue) != 0 {
+		t.Errorf("rejected payload kept: %+v", d.queue)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		4:  80 * time.Second,
+		10: maxBackoff,
+		99: maxBackoff,
+	} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}